@@ -0,0 +1,64 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"net"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+)
+
+var errDenied = &fiber.Error{
+	Code:    403002,
+	Message: "Access from your network is not allowed",
+}
+
+// true if the client ip is part of the allowlist, empty lists allow everyone
+func ClientAllowed(c *fiber.Ctx, conf *cfg.Config, allow []string) bool {
+	if len(allow) == 0 {
+		return true
+	}
+
+	return common.IPAllowed(net.ParseIP(ClientIP(c, conf)), allow)
+}
+
+// reject a client not matching the allowlist of an object
+func denyClient(c *fiber.Ctx, db *Db, object, target, apicontext string) error {
+	Audit(c, db, AuditDenied, object, target, apicontext, "client ip not in allowlist")
+
+	return JsonStatus(c, fiber.StatusForbidden, errDenied.Message+"!")
+}
+
+/*
+   Validate  the  allowlist given  by  the  user.  If none  has  been
+   given, the default allowlist of the api context will be used.
+*/
+func untaintAllow(conf *cfg.Config, allow []string, apicontext string) ([]string, error) {
+	if len(allow) == 0 {
+		return conf.ContextAllow(apicontext), nil
+	}
+
+	normalized, err := common.NormalizeAllowlist(allow)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusForbidden,
+			"Invalid allow list: "+err.Error())
+	}
+
+	return normalized, nil
+}
@@ -0,0 +1,76 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/valyala/fasthttp"
+)
+
+func TestClientIP(t *testing.T) {
+	conf := &cfg.Config{
+		TrustedProxies: []string{"127.0.0.1", "10.0.0.0/8"},
+		ProxyHeader:    fiber.HeaderXForwardedFor,
+	}
+
+	if err := conf.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply config defaults: " + err.Error())
+	}
+
+	var tests = []struct {
+		name   string
+		remote string
+		header string
+		expect string
+	}{
+		{"direct", "192.168.1.1", "", "192.168.1.1"},
+		{"untrusted-proxy", "192.168.1.1", "1.2.3.4", "192.168.1.1"},
+		{"trusted-proxy", "127.0.0.1", "1.2.3.4", "1.2.3.4"},
+		{"proxy-chain", "127.0.0.1", "1.2.3.4, 10.1.1.1", "1.2.3.4"},
+		{"forged-hop", "127.0.0.1", "6.6.6.6, 1.2.3.4", "1.2.3.4"},
+		{"garbage", "127.0.0.1", "1.2.3.4, garbage", "127.0.0.1"},
+		{"no-header", "127.0.0.1", "", "127.0.0.1"},
+	}
+
+	app := fiber.New()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fctx := &fasthttp.RequestCtx{}
+			fctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP(tt.remote)}, nil)
+			if tt.header != "" {
+				fctx.Request.Header.Set(fiber.HeaderXForwardedFor, tt.header)
+			}
+
+			c := app.AcquireCtx(fctx)
+			defer app.ReleaseCtx(c)
+
+			if ip := ClientIP(c, conf); ip != tt.expect {
+				t.Errorf("got %s, want %s", ip, tt.expect)
+			}
+
+			allowed := ClientAllowed(c, conf, []string{"1.2.3.0/24"})
+			if allowed != (tt.expect == "1.2.3.4") {
+				t.Errorf("allowlist check of %s returned %t", tt.expect, allowed)
+			}
+		})
+	}
+}
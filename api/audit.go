@@ -0,0 +1,276 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+const AuditBucket string = "audit"
+
+// audit actions
+const (
+	AuditCreate   = "create"
+	AuditModify   = "modify"
+	AuditDelete   = "delete"
+	AuditDownload = "download"
+	AuditExpire   = "expire"
+	AuditAuthFail = "authfail"
+	AuditDenied   = "denied"
+	AuditPreview  = "preview" // request which did not consume an upload
+	AuditAborted  = "aborted" // incomplete download, not counted
+)
+
+// names of audited objects
+const (
+	AuditUpload  = "upload"
+	AuditForm    = "form"
+	AuditLink    = "link"
+	AuditToken   = "token"
+	AuditContext = "context"
+)
+
+// incoming audit log filter, all fields are optional
+type AuditFilter struct {
+	Apicontext string `query:"apicontext"`
+	From       string `query:"from"` // RFC3339
+	To         string `query:"to"`   // RFC3339
+}
+
+/*
+   Audit keys consist of the  creation time in nanoseconds followed by
+   a sequence number,  both big endian. That way  bbolt keeps them in
+   chronological order and we can seek to the start of a time range.
+*/
+func auditKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[0:8], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:16], seq)
+	return key
+}
+
+// store an audit entry within an already running transaction
+func auditPut(tx *bolt.Tx, entry *common.AuditEntry) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(AuditBucket))
+	if err != nil {
+		return fmt.Errorf("create bucket: %s", err)
+	}
+
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return fmt.Errorf("audit sequence: %s", err)
+	}
+
+	if entry.Time.IsZero() {
+		entry.Time = common.Timestamp{Time: time.Now()}
+	}
+	entry.Id = strconv.FormatUint(seq, 10)
+
+	jsonentry, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("json marshalling failure: %s", err)
+	}
+
+	return bucket.Put(auditKey(entry.Time.Time, seq), jsonentry)
+}
+
+func (db *Db) AuditInsert(entry *common.AuditEntry) error {
+	err := db.update(func(tx *bolt.Tx) error {
+		return auditPut(tx, entry)
+	})
+
+	if err != nil {
+		Error("DB error: %s", err.Error())
+	}
+
+	return err
+}
+
+// return all audit entries matching the given context within from and to
+func (db *Db) AuditList(apicontext string, from, to time.Time) (*common.Response, error) {
+	response := &common.Response{}
+
+	err := db.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(AuditBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		cursor := bucket.Cursor()
+
+		k, j := cursor.First()
+		if !from.IsZero() {
+			k, j = cursor.Seek(auditKey(from, 0))
+		}
+
+		for ; k != nil; k, j = cursor.Next() {
+			entry := &common.AuditEntry{}
+			if err := json.Unmarshal(j, entry); err != nil {
+				return fmt.Errorf("unable to unmarshal json: %s", err)
+			}
+
+			if !to.IsZero() && entry.Time.After(to) {
+				break
+			}
+
+			if apicontext != "" && entry.Context != apicontext {
+				continue
+			}
+
+			response.Audit = append(response.Audit, entry)
+		}
+
+		return nil
+	})
+
+	return response, err
+}
+
+// remove audit entries older than the configured retention
+func DeleteExpiredAudit(conf *cfg.Config, db *Db) error {
+	if conf.AuditExpire == 0 {
+		return nil // keep forever
+	}
+
+	until := auditKey(time.Now().Add(-time.Duration(conf.AuditExpire)*time.Second), 0)
+
+	return db.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(AuditBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		cursor := bucket.Cursor()
+
+		// deleting the current key moves the cursor forward, hence First()
+		for k, _ := cursor.First(); k != nil && bytes.Compare(k, until) < 0; k, _ = cursor.First() {
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+/*
+   Prepare an audit entry. Request  details (id, client ip, user agent)
+   are taken from the fiber context.
+*/
+func newAuditEntry(c *fiber.Ctx, db *Db, action, object, target, apicontext, message string) *common.AuditEntry {
+	entry := &common.AuditEntry{
+		Action:    action,
+		Object:    object,
+		Target:    target,
+		Context:   apicontext,
+		Ip:        ClientIP(c, db.Config()),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		Message:   message,
+	}
+
+	if requestid, ok := c.Locals("requestid").(string); ok {
+		entry.RequestId = requestid
+	}
+
+	return entry
+}
+
+/*
+   Record  an operation  in the  audit trail. Audit  failures are only
+   logged, they never abort the request.
+*/
+func Audit(c *fiber.Ctx, db *Db, action, object, target, apicontext, message string) {
+	auditInsert(db, newAuditEntry(c, db, action, object, target, apicontext, message))
+}
+
+func auditInsert(db *Db, entry *common.AuditEntry) {
+	if err := db.AuditInsert(entry); err != nil {
+		Error("Failed to write audit entry for %s %s: %s", entry.Action, entry.Target, err.Error())
+	}
+}
+
+// record the removal of a used up object, called from go routines
+func auditExpired(db *Db, object, target, apicontext, reason string) {
+	auditInsert(db, &common.AuditEntry{
+		Action:  AuditExpire,
+		Object:  object,
+		Target:  target,
+		Context: apicontext,
+		Message: "expired after use: " + reason,
+	})
+}
+
+// super and auditors only: return the audit trail, filtered by context and time range
+func AuditList(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
+	// the API Context the request has been authenticated for
+	apicontext := GetPrincipal(c).Context
+
+	if !CanSeeAll(cfg, apicontext) {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Only the super context and auditors are allowed to access the audit log!")
+	}
+
+	filter := new(AuditFilter)
+	if err := c.QueryParser(filter); err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Unable to parse query: "+err.Error())
+	}
+
+	apifilter, err := common.Untaint(filter.Apicontext, cfg.RegKey)
+	if err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Invalid api context filter provided!")
+	}
+
+	var from, to time.Time
+
+	if filter.From != "" {
+		if from, err = time.Parse(time.RFC3339, filter.From); err != nil {
+			return JsonStatus(c, fiber.StatusForbidden,
+				"Invalid from timestamp provided: "+err.Error())
+		}
+	}
+
+	if filter.To != "" {
+		if to, err = time.Parse(time.RFC3339, filter.To); err != nil {
+			return JsonStatus(c, fiber.StatusForbidden,
+				"Invalid to timestamp provided: "+err.Error())
+		}
+	}
+
+	response, err := db.AuditList(apifilter, from, to)
+	if err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Unable to list audit log: "+err.Error())
+	}
+
+	// if we reached this point we can signal success
+	response.Success = true
+	response.Code = fiber.StatusOK
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
@@ -0,0 +1,87 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+	"testing"
+	"time"
+)
+
+func TestAudit(t *testing.T) {
+	c := &cfg.Config{DbFile: "audittest.db", AuditExpire: 3600}
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	now := time.Now()
+	entries := []*common.AuditEntry{
+		{Action: AuditCreate, Target: "1", Context: "foo", Time: common.Timestamp{Time: now.Add(-2 * time.Hour)}},
+		{Action: AuditDownload, Target: "1", Context: "foo", Time: common.Timestamp{Time: now.Add(-30 * time.Minute)}},
+		{Action: AuditDelete, Target: "2", Context: "bar", Time: common.Timestamp{Time: now}},
+	}
+
+	for _, entry := range entries {
+		if err := db.AuditInsert(entry); err != nil {
+			t.Errorf("Could not insert audit entry: " + err.Error())
+		}
+	}
+
+	var tests = []struct {
+		name    string
+		context string
+		from    time.Time
+		to      time.Time
+		expect  int
+	}{
+		{"all", "", time.Time{}, time.Time{}, 3},
+		{"context", "foo", time.Time{}, time.Time{}, 2},
+		{"from", "", now.Add(-time.Hour), time.Time{}, 2},
+		{"range", "", now.Add(-time.Hour), now.Add(-time.Minute), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := db.AuditList(tt.context, tt.from, tt.to)
+			if err != nil {
+				t.Errorf("Could not list audit entries: " + err.Error())
+			}
+
+			if len(response.Audit) != tt.expect {
+				t.Errorf("got %d audit entries, want %d", len(response.Audit), tt.expect)
+			}
+		})
+	}
+
+	// the oldest entry is beyond the retention of 1 hour
+	if err := DeleteExpiredAudit(c, db); err != nil {
+		t.Errorf("Could not delete expired audit entries: " + err.Error())
+	}
+
+	response, err := db.AuditList("", time.Time{}, time.Time{})
+	if err != nil {
+		t.Errorf("Could not list audit entries: " + err.Error())
+	}
+
+	if len(response.Audit) != 2 {
+		t.Errorf("got %d audit entries after cleanup, want 2", len(response.Audit))
+	}
+}
@@ -19,11 +19,13 @@ package api
 import (
 	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/hex"
 	"errors"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/keyauth/v2"
 	"github.com/tlinden/ephemerup/cfg"
 	"github.com/tlinden/ephemerup/common"
+	"sync"
 )
 
 // these vars can be savely global, since they don't change ever
@@ -37,13 +39,138 @@ var (
 		Code:    403001,
 		Message: "Invalid API key",
 	}
-
-	Apikeys []cfg.Apicontext
 )
 
+// accepted keys, replaced if api contexts change at runtime
+var apikeys = struct {
+	sync.RWMutex
+	contexts []cfg.Apicontext
+}{}
+
+/*
+   Keys which  matched an argon2id  key hash, so that the  expensive
+   verification only happens once per key. The map key is the context
+   plus the sha256 hash of the presented key.
+*/
+var verifiedKeys = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: map[string]bool{}}
+
+/*
+   Keys which matched none of  the argon2id key hashes, by sha256 hash
+   of the  key, so that guessing  the same key again  is cheap. Random
+   keys are bounded by the authfail rate limit.
+*/
+var rejectedKeys = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: map[string]bool{}}
+
+// forget all rejected keys if there are more, a bound on the memory used
+const maxRejectedKeys = 10000
+
 // fill from server: accepted keys
 func AuthSetApikeys(keys []cfg.Apicontext) {
-	Apikeys = keys
+	apikeys.Lock()
+	apikeys.contexts = keys
+	apikeys.Unlock()
+
+	verifiedKeys.Lock()
+	verifiedKeys.keys = map[string]bool{}
+	verifiedKeys.Unlock()
+
+	rejectedKeys.Lock()
+	rejectedKeys.keys = map[string]bool{}
+	rejectedKeys.Unlock()
+}
+
+// true if the key has been rejected by all argon2id key hashes before
+func keyRejected(hashedKey [sha256.Size]byte) bool {
+	rejectedKeys.Lock()
+	defer rejectedKeys.Unlock()
+
+	return rejectedKeys.keys[hex.EncodeToString(hashedKey[:])]
+}
+
+func rejectKey(hashedKey [sha256.Size]byte) {
+	rejectedKeys.Lock()
+	defer rejectedKeys.Unlock()
+
+	if len(rejectedKeys.keys) >= maxRejectedKeys {
+		rejectedKeys.keys = map[string]bool{}
+	}
+
+	rejectedKeys.keys[hex.EncodeToString(hashedKey[:])] = true
+}
+
+// true if the presented key matches a plaintext key or a sha256 key hash
+func apikeyMatches(apicontext *cfg.Apicontext, hashedKey [sha256.Size]byte) bool {
+	var hashedAPIKey []byte
+
+	switch apicontext.KeyHashType() {
+	case cfg.KeyHashSha256:
+		hashedAPIKey, _ = hex.DecodeString(apicontext.KeyHash)
+	case "":
+		sum := sha256.Sum256([]byte(apicontext.Key))
+		hashedAPIKey = sum[:]
+	default:
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(hashedAPIKey, hashedKey[:]) == 1
+}
+
+// true if the presented key matches an argon2id key hash
+func apikeyMatchesArgon2(apicontext *cfg.Apicontext, key string, hashedKey [sha256.Size]byte) bool {
+	if apicontext.KeyHashType() != cfg.KeyHashArgon2id {
+		return false
+	}
+
+	cachekey := apicontext.Context + hex.EncodeToString(hashedKey[:])
+
+	verifiedKeys.Lock()
+	verified := verifiedKeys.keys[cachekey]
+	verifiedKeys.Unlock()
+
+	if verified {
+		return true
+	}
+
+	match, err := VerifyPassword(key, apicontext.KeyHash)
+	if err != nil {
+		Warn("Invalid key hash of api context %s: %s", apicontext.Context, err)
+		return false
+	}
+
+	if match {
+		verifiedKeys.Lock()
+		verifiedKeys.keys[cachekey] = true
+		verifiedKeys.Unlock()
+	}
+
+	return match
+}
+
+// warn about api contexts still using plaintext keys
+func WarnPlaintextKeys(conf *cfg.Config) {
+	for _, apicontext := range conf.Apicontexts {
+		if apicontext.Key != "" {
+			Warn("Api context %s uses a plaintext key, use key_hash instead (see ephemerupd hash-key)",
+				apicontext.Context)
+		}
+	}
+}
+
+// true if the given apicontext is the configured super context
+func IsSuper(conf *cfg.Config, apicontext string) bool {
+	return conf.Super != "" && conf.Super == apicontext
+}
+
+// true if the apicontext may see the entries of all contexts: super and auditors
+func CanSeeAll(conf *cfg.Config, apicontext string) bool {
+	return IsSuper(conf, apicontext) ||
+		(apicontext != "" && conf.ContextRole(apicontext) == cfg.RoleAuditor)
 }
 
 // make sure we always return JSON encoded errors
@@ -54,13 +181,25 @@ func AuthErrHandler(ctx *fiber.Ctx, err error) error {
 		return ctx.JSON(errMissing)
 	}
 
+	if err == errDenied {
+		return ctx.JSON(errDenied)
+	}
+
 	return ctx.JSON(errInvalid)
 }
 
-// validator hook, validates  incoming api key against  form id, which
-// also acts as onetime api key
+/*
+   Validator hook, validates  an incoming api key against form tokens,
+   see FormToken(). A form token  only allows to upload using the form,
+   see RequireScope().
+*/
 func AuthValidateOnetimeKey(c *fiber.Ctx, key string, db *Db) (bool, error) {
-	resp, err := db.Get("", key, common.TypeForm)
+	id, err := ParseFormToken(db.Config(), key)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := db.Get("", id, common.TypeForm)
 	if err != nil {
 		return false, errors.New("Onetime key doesn't match any form id!")
 	}
@@ -69,60 +208,68 @@ func AuthValidateOnetimeKey(c *fiber.Ctx, key string, db *Db) (bool, error) {
 		return false, errors.New("db.Get(form) returned no results and no errors!")
 	}
 
-	sess, err := Sessionstore.Get(c)
-	if err != nil {
-		return false, errors.New("Could not retrieve session from Sessionstore: " + err.Error())
+	if !ClientAllowed(c, db.Config(), resp.Forms[0].Allow) {
+		return false, errDenied
 	}
 
-	// store the  result into the session, the 'formid'  key tells the
-	// upload handler that the apicontext it sees is in fact a form id
-	// and has to be deleted if set to asap.
-	sess.Set("apicontext", resp.Forms[0].Context)
-	sess.Set("formid", key)
-
-	if err := sess.Save(); err != nil {
-		return false, errors.New("Unable to save session store!")
-	}
+	// the 'formid' tells the upload handler that the upload has been
+	// made using a form, which has to be deleted if set to asap.
+	SetPrincipal(c, &Principal{
+		Context: resp.Forms[0].Context,
+		FormId:  id,
+		Scopes:  []string{ScopeFormUpload},
+	})
 
 	return true, nil
 }
 
 // validator hook, called by fiber via server keyauth.New()
-func AuthValidateAPIKey(c *fiber.Ctx, key string) (bool, error) {
-	// create a new session, it will be thrown away if something fails
-	sess, err := Sessionstore.Get(c)
-	if err != nil {
-		return false, errors.New("Unable to initialize session store from context!")
-	}
+func AuthValidateAPIKey(c *fiber.Ctx, conf *cfg.Config, key string) (bool, error) {
+	apikeys.RLock()
+	contexts := apikeys.contexts
+	apikeys.RUnlock()
 
-	// if Apikeys is empty, the server works unauthenticated
+	// if there are no keys, the server works unauthenticated
 	// FIXME: maybe always reject?
-	if len(Apikeys) == 0 {
-		sess.Set("apicontext", "default")
-
-		if err := sess.Save(); err != nil {
-			return false, errors.New("Unable to save session store!")
-		}
-
+	if len(contexts) == 0 {
+		SetPrincipal(c, &Principal{Context: "default", Scopes: roleScopes[cfg.RoleAdmin]})
 		return true, nil
 	}
 
-	// actual key comparison
-	for _, apicontext := range Apikeys {
-		hashedAPIKey := sha256.Sum256([]byte(apicontext.Key))
-		hashedKey := sha256.Sum256([]byte(key))
+	hashedKey := sha256.Sum256([]byte(key))
 
-		if subtle.ConstantTimeCompare(hashedAPIKey[:], hashedKey[:]) == 1 {
-			// apikey matches, register apicontext for later use by the handlers
-			sess.Set("apicontext", apicontext.Context)
+	// actual key comparison, argon2id is expensive by design, so the
+	// cheap comparisons come first
+	for i := range contexts {
+		if apikeyMatches(&contexts[i], hashedKey) {
+			return authorizeApicontext(c, conf, &contexts[i])
+		}
+	}
 
-			if err := sess.Save(); err != nil {
-				return false, errors.New("Unable to save session store!")
-			}
+	if keyRejected(hashedKey) {
+		return false, keyauth.ErrMissingOrMalformedAPIKey
+	}
 
-			return true, nil
+	for i := range contexts {
+		if apikeyMatchesArgon2(&contexts[i], key, hashedKey) {
+			return authorizeApicontext(c, conf, &contexts[i])
 		}
 	}
 
+	rejectKey(hashedKey)
+
 	return false, keyauth.ErrMissingOrMalformedAPIKey
 }
+
+func authorizeApicontext(c *fiber.Ctx, conf *cfg.Config, apicontext *cfg.Apicontext) (bool, error) {
+	if !ClientAllowed(c, conf, apicontext.Allow) {
+		return false, errDenied
+	}
+
+	// apikey matches, register apicontext for later use by the handlers
+	SetPrincipal(c, &Principal{
+		Context: apicontext.Context,
+		Scopes:  RoleScopes(conf, apicontext.Context),
+	})
+	return true, nil
+}
@@ -0,0 +1,404 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/keyauth/v2"
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+)
+
+func TestAuthPrincipal(t *testing.T) {
+	c := &cfg.Config{
+		Apicontexts: []cfg.Apicontext{{Context: "foo", Key: "fookey"}},
+	}
+
+	AuthSetApikeys(c.Apicontexts)
+	defer AuthSetApikeys(nil)
+
+	app := fiber.New()
+	auth := keyauth.New(keyauth.Config{
+		Validator: func(ctx *fiber.Ctx, key string) (bool, error) {
+			return AuthValidateAPIKey(ctx, c, key)
+		},
+		ErrorHandler: AuthErrHandler,
+	})
+
+	app.Get("/whoami", auth, func(ctx *fiber.Ctx) error {
+		return ctx.SendString(GetPrincipal(ctx).Context)
+	})
+
+	// no auth, no principal
+	app.Get("/public", func(ctx *fiber.Ctx) error {
+		return ctx.SendString("[" + GetPrincipal(ctx).Context + "]")
+	})
+
+	var tests = []struct {
+		name   string
+		path   string
+		key    string
+		status int
+		expect string
+	}{
+		{"valid-key", "/whoami", "fookey", fiber.StatusOK, "foo"},
+		{"invalid-key", "/whoami", "barkey", fiber.StatusForbidden, ""},
+		{"public", "/public", "", fiber.StatusOK, "[]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Request failed: " + err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			if tt.status == fiber.StatusOK && string(body) != tt.expect {
+				t.Errorf("got %q, want %q", body, tt.expect)
+			}
+
+			if cookie := resp.Header.Get("Set-Cookie"); cookie != "" {
+				t.Errorf("unexpected cookie issued: %s", cookie)
+			}
+		})
+	}
+}
+
+func TestAuthKeyHash(t *testing.T) {
+	argonhash, err := HashPassword("argonkey")
+	if err != nil {
+		t.Fatalf("Could not hash key: " + err.Error())
+	}
+
+	shahash := sha256.Sum256([]byte("shakey"))
+
+	c := &cfg.Config{
+		Apicontexts: []cfg.Apicontext{
+			{Context: "plain", Key: "plainkey"},
+			{Context: "sha", KeyHash: strings.ToUpper(hex.EncodeToString(shahash[:]))},
+			{Context: "argon", KeyHash: strings.TrimPrefix(argonhash, "$")},
+		},
+	}
+
+	if err := c.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply defaults: " + err.Error())
+	}
+
+	AuthSetApikeys(c.Apicontexts)
+	defer AuthSetApikeys(nil)
+
+	app := fiber.New()
+	auth := keyauth.New(keyauth.Config{
+		Validator: func(ctx *fiber.Ctx, key string) (bool, error) {
+			return AuthValidateAPIKey(ctx, c, key)
+		},
+		ErrorHandler: AuthErrHandler,
+	})
+
+	app.Get("/whoami", auth, func(ctx *fiber.Ctx) error {
+		return ctx.SendString(GetPrincipal(ctx).Context)
+	})
+
+	var tests = []struct {
+		name   string
+		key    string
+		status int
+		expect string
+	}{
+		{"plaintext", "plainkey", fiber.StatusOK, "plain"},
+		{"sha256", "shakey", fiber.StatusOK, "sha"},
+		{"argon2id", "argonkey", fiber.StatusOK, "argon"},
+		{"argon2id-cached", "argonkey", fiber.StatusOK, "argon"},
+		{"hash-as-key", hex.EncodeToString(shahash[:]), fiber.StatusForbidden, ""},
+		{"invalid", "barkey", fiber.StatusForbidden, ""},
+		{"invalid-cached", "barkey", fiber.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/whoami", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatalf("Request failed: " + err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			if tt.status == fiber.StatusOK && string(body) != tt.expect {
+				t.Errorf("got %q, want %q", body, tt.expect)
+			}
+		})
+	}
+
+	// not verified against the argon2id hash again
+	if !keyRejected(sha256.Sum256([]byte("barkey"))) {
+		t.Errorf("invalid key has not been remembered as rejected")
+	}
+
+	// but accepted, once a matching key hash is configured
+	barhash := sha256.Sum256([]byte("barkey"))
+	AuthSetApikeys(append(c.Apicontexts, cfg.Apicontext{Context: "bar", KeyHash: hex.EncodeToString(barhash[:])}))
+	if keyRejected(barhash) {
+		t.Errorf("rejected keys survived a change of the api keys")
+	}
+
+	invalid := []cfg.Apicontext{
+		{Context: "both", Key: "key", KeyHash: hex.EncodeToString(shahash[:])},
+		{Context: "none"},
+		{Context: "garbage", KeyHash: "md5:abc"},
+	}
+
+	for _, apicontext := range invalid {
+		conf := &cfg.Config{Apicontexts: []cfg.Apicontext{apicontext}}
+		if err := conf.ApplyDefaults(); err == nil {
+			t.Errorf("api context %s: invalid key settings accepted", apicontext.Context)
+		}
+	}
+}
+
+func TestFormTokenScope(t *testing.T) {
+	c := &cfg.Config{
+		DbFile:        "formtokentest.db",
+		Apicontexts:   []cfg.Apicontext{{Context: "foo", Key: "fookey"}},
+		SigningSecret: []byte("secret"),
+	}
+
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	form := common.Form{Id: asapId, Context: "foo", Expire: "1d", Type: common.TypeForm}
+	if err := db.Insert(form.Id, form); err != nil {
+		t.Fatalf("Could not insert form: " + err.Error())
+	}
+
+	token := FormToken(c, form.Id)
+
+	if id, err := ParseFormToken(c, token); err != nil || id != form.Id {
+		t.Errorf("Could not parse form token: %v", err)
+	}
+
+	auth := SetupAuthStore(c, db)
+	defer AuthSetApikeys(nil)
+
+	app := fiber.New()
+	app.Post("/uploads", auth, RequireScope(db, ScopeUpload, ScopeFormUpload), func(ctx *fiber.Ctx) error {
+		return ctx.SendString(GetPrincipal(ctx).FormId)
+	})
+	app.Get("/uploads", auth, RequireScope(db, ScopeList), func(ctx *fiber.Ctx) error {
+		return ctx.SendString("list")
+	})
+
+	var tests = []struct {
+		name   string
+		method string
+		key    string
+		status int
+	}{
+		{"form-token-upload", "POST", token, fiber.StatusOK},
+		{"form-token-list", "GET", token, fiber.StatusForbidden},
+		{"form-id-upload", "POST", form.Id, fiber.StatusForbidden},
+		{"tampered-token", "POST", form.Id + ".AAAA", fiber.StatusForbidden},
+		{"apikey-upload", "POST", "fookey", fiber.StatusOK},
+		{"apikey-list", "GET", "fookey", fiber.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/uploads", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Request failed: " + err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestRoles(t *testing.T) {
+	c := &cfg.Config{
+		DbFile:     "rolestest.db",
+		StorageDir: ".",
+		Super:      "adm",
+		Apicontexts: []cfg.Apicontext{
+			{Context: "adm", Key: "admkey"},
+			{Context: "ro", Key: "rokey", Role: cfg.RoleReadOnly},
+			{Context: "up", Key: "upkey", Role: cfg.RoleUploadOnly},
+			{Context: "fm", Key: "fmkey", Role: cfg.RoleFormManager},
+			{Context: "aud", Key: "audkey", Role: cfg.RoleAuditor},
+			{Context: "team", Key: "teamkey"}, // admin, but not super
+		},
+	}
+
+	if err := c.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply config defaults: " + err.Error())
+	}
+
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	for _, ctx := range []string{"adm", "ro"} {
+		upload := common.Upload{Id: ctx + "-upload", Context: ctx, Expire: "1d", Type: common.TypeUpload}
+		if err := db.Insert(upload.Id, upload); err != nil {
+			t.Fatalf("Could not insert upload: " + err.Error())
+		}
+	}
+
+	form := common.Form{Id: "fm-form", Context: "fm", Expire: "1d", Type: common.TypeForm}
+	if err := db.Insert(form.Id, form); err != nil {
+		t.Fatalf("Could not insert form: " + err.Error())
+	}
+
+	auth := SetupAuthStore(c, db)
+	defer AuthSetApikeys(nil)
+
+	app := fiber.New()
+	app.Get("/uploads", auth, RequireScope(db, ScopeList), func(ctx *fiber.Ctx) error {
+		return UploadsList(ctx, c, db)
+	})
+	app.Delete("/uploads/:id", auth, RequireScope(db, ScopeDelete), func(ctx *fiber.Ctx) error {
+		return SendResponse(ctx, "", UploadDelete(ctx, c, db))
+	})
+	app.Get("/forms", auth, RequireScope(db, ScopeForms, ScopeList), func(ctx *fiber.Ctx) error {
+		return FormsList(ctx, c, db)
+	})
+	app.Put("/uploads/:id", auth, RequireScope(db, ScopeModify), func(ctx *fiber.Ctx) error {
+		return UploadModify(ctx, c, db)
+	})
+	app.Get("/audit", auth, RequireScope(db, ScopeAudit), func(ctx *fiber.Ctx) error {
+		return AuditList(ctx, c, db)
+	})
+	app.Post("/tokens", auth, RequireScope(db, ScopeTokens), func(ctx *fiber.Ctx) error {
+		return TokenCreate(ctx, c, db)
+	})
+
+	var tests = []struct {
+		name    string
+		method  string
+		path    string
+		key     string
+		status  int
+		uploads int
+		forms   int
+	}{
+		{"readonly-list", "GET", "/uploads", "rokey", fiber.StatusOK, 1, 0},
+		{"readonly-forms", "GET", "/forms", "rokey", fiber.StatusOK, 0, 0},
+		{"readonly-delete", "DELETE", "/uploads/ro-upload", "rokey", fiber.StatusForbidden, 0, 0},
+		{"readonly-audit", "GET", "/audit", "rokey", fiber.StatusForbidden, 0, 0},
+		{"uploadonly-list", "GET", "/uploads", "upkey", fiber.StatusForbidden, 0, 0},
+		{"formmanager-forms", "GET", "/forms", "fmkey", fiber.StatusOK, 0, 1},
+		{"formmanager-list", "GET", "/uploads", "fmkey", fiber.StatusForbidden, 0, 0},
+		{"auditor-list", "GET", "/uploads", "audkey", fiber.StatusOK, 2, 0},
+		{"auditor-forms", "GET", "/forms", "audkey", fiber.StatusOK, 0, 1},
+		{"auditor-audit", "GET", "/audit", "audkey", fiber.StatusOK, 0, 0},
+		{"auditor-delete", "DELETE", "/uploads/ro-upload", "audkey", fiber.StatusForbidden, 0, 0},
+		{"auditor-tokens", "POST", "/tokens", "audkey", fiber.StatusForbidden, 0, 0},
+		{"uploadonly-modify", "PUT", "/uploads/adm-upload", "upkey", fiber.StatusForbidden, 0, 0},
+		{"admin-modify", "PUT", "/uploads/adm-upload", "admkey", fiber.StatusOK, 1, 0},
+		{"admin-audit", "GET", "/audit", "teamkey", fiber.StatusForbidden, 0, 0},
+		{"super-audit", "GET", "/audit", "admkey", fiber.StatusOK, 0, 0},
+		{"admin-delete-foreign", "DELETE", "/uploads/ro-upload", "admkey", fiber.StatusOK, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"scopes":["list"]}`))
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Request failed: " + err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+
+			response := &common.Response{}
+			if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+				t.Errorf("response is not json: %s", err)
+			}
+
+			if len(response.Uploads) != tt.uploads || len(response.Forms) != tt.forms {
+				t.Errorf("got %d uploads and %d forms, want %d and %d",
+					len(response.Uploads), len(response.Forms), tt.uploads, tt.forms)
+			}
+		})
+	}
+
+	// principals without scopes are allowed nothing
+	if (&Principal{Context: "adm"}).Allowed(ScopeList) {
+		t.Errorf("principal without scopes allowed to list")
+	}
+
+	// the db enforces roles on its own
+	if err := db.Delete("up", "adm-upload"); err != ErrForbidden {
+		t.Errorf("upload-only context deleted an upload: %v", err)
+	}
+
+	if _, err := db.List("up", "", "", common.TypeUpload); err != ErrForbidden {
+		t.Errorf("upload-only context listed uploads: %v", err)
+	}
+
+	if err := db.Delete("ro", "adm-upload"); err != ErrForbidden {
+		t.Errorf("read-only context deleted an upload: %v", err)
+	}
+
+	if err := db.Delete("fm", "adm-upload"); err != ErrForbidden {
+		t.Errorf("form-manager context deleted an upload: %v", err)
+	}
+
+	if err := db.Delete("fm", "fm-form"); err != nil {
+		t.Errorf("form-manager context could not delete its form: %v", err)
+	}
+}
@@ -28,7 +28,7 @@ import (
 )
 
 func DeleteExpiredUploads(conf *cfg.Config, db *Db) error {
-	err := db.bolt.Update(func(tx *bolt.Tx) error {
+	err := db.update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(Bucket))
 
 		if bucket == nil {
@@ -46,9 +46,35 @@ func DeleteExpiredUploads(conf *cfg.Config, db *Db) error {
 					return nil
 				}
 
+				if passwords := tx.Bucket([]byte(PasswordBucket)); passwords != nil {
+					if err := passwords.Delete([]byte(id)); err != nil {
+						Error("Failed to delete password of %s: %s", id, err.Error())
+					}
+				}
+
+				if err := deleteShortId(tx, j); err != nil {
+					Error("Failed to delete short id of %s: %s", id, err.Error())
+				}
+
 				cleanup(filepath.Join(conf.StorageDir, upload.Id))
 
-				Log("Cleaned up upload " + upload.Id)
+				object := AuditUpload
+				if upload.Type == common.TypeForm {
+					object = AuditForm
+				}
+
+				if err := auditPut(tx, &common.AuditEntry{
+					Action:  AuditExpire,
+					Object:  object,
+					Target:  upload.Id,
+					Context: upload.Context,
+					Message: "expired after " + upload.Expire,
+				}); err != nil {
+					Error("Failed to write audit entry for %s: %s", upload.Id, err.Error())
+				}
+
+				metricDeletions.Inc(object)
+				Info("Cleaned up upload %s", upload.Id)
 			}
 
 			return nil
@@ -62,15 +88,47 @@ func DeleteExpiredUploads(conf *cfg.Config, db *Db) error {
 
 func BackgroundCleaner(conf *cfg.Config, db *Db) chan bool {
 	ticker := time.NewTicker(conf.CleanInterval)
-	fmt.Println(conf.CleanInterval)
+	Info("Starting background cleaner, interval: %s", conf.CleanInterval)
 	done := make(chan bool)
 
 	go func() {
 		for {
 			select {
 			case <-ticker.C:
+				metricCleanerRuns.Inc()
+
+				// the config may have been reloaded in the meantime
+				conf := db.Config()
+
 				if err := DeleteExpiredUploads(conf, db); err != nil {
-					Log("Failed to delete eypired uploads: %s", err.Error())
+					Error("Failed to delete eypired uploads: %s", err.Error())
+				}
+
+				if err := DeleteExpiredAudit(conf, db); err != nil {
+					Error("Failed to delete expired audit entries: %s", err.Error())
+				}
+
+				if err := DeleteExpiredNonces(db); err != nil {
+					Error("Failed to delete expired link nonces: %s", err.Error())
+				}
+
+				if err := DeleteExpiredTokens(db); err != nil {
+					Error("Failed to delete expired api tokens: %s", err.Error())
+				}
+
+				if err := DeleteStaleStaging(conf); err != nil {
+					Error("Failed to delete stale staging entries: %s", err.Error())
+				}
+
+				if err := DeleteExpiredPasswordFailures(db); err != nil {
+					Error("Failed to delete expired password failures: %s", err.Error())
+				}
+
+				// the prefork children serve the metrics
+				if conf.Prefork {
+					if err := db.PublishCleanerMetrics(); err != nil {
+						Error("Failed to publish cleaner metrics: %s", err.Error())
+					}
 				}
 			case <-done:
 				ticker.Stop()
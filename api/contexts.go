@@ -0,0 +1,448 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+// api contexts managed at runtime, key is the context name
+const ContextBucket string = "contexts"
+
+// where an api context has been defined
+const (
+	ContextSourceConfig  = "config"
+	ContextSourceRuntime = "runtime"
+)
+
+var ErrContextExists = errors.New("api context already exists")
+
+// incoming request to create an api context
+type ContextRequest struct {
+	Context string   `json:"context" form:"context"`
+	Role    string   `json:"role" form:"role"`
+	Parent  string   `json:"parent" form:"parent"`
+	Allow   []string `json:"allow" form:"allow"`
+	IdStyle string   `json:"idstyle" form:"idstyle"`
+}
+
+/*
+   The  version of the  runtime  contexts a process  uses. Every change
+   increments  the sequence of  the bucket, so  other processes (see
+   prefork) notice it with the next request.
+*/
+type contextsState struct {
+	sync.Mutex
+	version uint64
+	loaded  bool
+}
+
+/*
+   In prefork mode  opening the database just to  read the version is
+   expensive,  so  every  transaction  records  it  on  the  way.  The
+   recorded version is used for contextsMaxAge, see ContextsVersion().
+*/
+type contextsSeen struct {
+	version uint64
+	at      time.Time
+}
+
+const contextsMaxAge = time.Second
+
+// record the version of the runtime contexts, called by every shared transaction
+func (db *Db) sawContexts(tx *bolt.Tx) {
+	seen := contextsSeen{at: time.Now()}
+
+	if bucket := tx.Bucket([]byte(ContextBucket)); bucket != nil {
+		seen.version = bucket.Sequence()
+	}
+
+	db.seen.Store(seen)
+}
+
+// store an api context, fails if create is set and it already exists
+func (db *Db) ContextPut(apicontext *cfg.Apicontext, create bool) error {
+	return db.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(ContextBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+
+		if create && bucket.Get([]byte(apicontext.Context)) != nil {
+			return ErrContextExists
+		}
+
+		jsonentry, err := json.Marshal(apicontext)
+		if err != nil {
+			return fmt.Errorf("json marshalling failure: %s", err)
+		}
+
+		if err := bucket.Put([]byte(apicontext.Context), jsonentry); err != nil {
+			return err
+		}
+
+		_, err = bucket.NextSequence()
+		return err
+	})
+}
+
+func (db *Db) ContextDelete(name string) error {
+	return db.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(ContextBucket))
+		if bucket == nil || bucket.Get([]byte(name)) == nil {
+			return fmt.Errorf("api context %s not found", name)
+		}
+
+		if err := bucket.Delete([]byte(name)); err != nil {
+			return err
+		}
+
+		_, err := bucket.NextSequence()
+		return err
+	})
+}
+
+// all runtime contexts and their version
+func (db *Db) ContextsLoad() ([]cfg.Apicontext, uint64, error) {
+	contexts := []cfg.Apicontext{}
+	var version uint64
+
+	err := db.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(ContextBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		version = bucket.Sequence()
+
+		return bucket.ForEach(func(k, j []byte) error {
+			apicontext := cfg.Apicontext{}
+			if err := json.Unmarshal(j, &apicontext); err != nil {
+				return fmt.Errorf("unable to unmarshal json: %s", err)
+			}
+
+			contexts = append(contexts, apicontext)
+			return nil
+		})
+	})
+
+	return contexts, version, err
+}
+
+func (db *Db) ContextsVersion() (uint64, error) {
+	if seen, ok := db.seen.Load().(contextsSeen); ok && time.Since(seen.at) < contextsMaxAge {
+		return seen.version, nil
+	}
+
+	var version uint64
+
+	err := db.view(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(ContextBucket)); bucket != nil {
+			version = bucket.Sequence()
+		}
+		return nil
+	})
+
+	return version, err
+}
+
+/*
+   Merge the  runtime contexts  into the config  and the accepted  api
+   keys, if they changed since the last call. Called for every request
+   to be authenticated, so changes take effect immediately, in other
+   prefork processes within contextsMaxAge.
+*/
+func SyncContexts(conf *cfg.Config, db *Db) error {
+	version, err := db.ContextsVersion()
+	if err != nil {
+		return err
+	}
+
+	db.contexts.Lock()
+	defer db.contexts.Unlock()
+
+	if db.contexts.loaded && db.contexts.version == version {
+		return nil
+	}
+
+	contexts, version, err := db.ContextsLoad()
+	if err != nil {
+		return err
+	}
+
+	conf.SetRuntimeContexts(contexts)
+	AuthSetApikeys(conf.Contexts())
+
+	db.contexts.version = version
+	db.contexts.loaded = true
+
+	return nil
+}
+
+// create a random key, only its hash is stored
+func newContextKey(apicontext *cfg.Apicontext) (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	key := hex.EncodeToString(random)
+	hash := sha256.Sum256([]byte(key))
+
+	apicontext.Key = ""
+	apicontext.KeyHash = hex.EncodeToString(hash[:])
+
+	return key, nil
+}
+
+func contextInfo(apicontext *cfg.Apicontext, source string) *common.ApiContext {
+	return &common.ApiContext{
+		Context: apicontext.Context,
+		Role:    apicontext.Role,
+		Parent:  apicontext.Parent,
+		Allow:   apicontext.Allow,
+		IdStyle: apicontext.IdStyle,
+		Source:  source,
+	}
+}
+
+func contextsResponse(c *fiber.Ctx, contexts []*common.ApiContext) error {
+	res := &common.Response{Contexts: contexts}
+	res.Success = true
+	res.Code = fiber.StatusOK
+	return c.Status(fiber.StatusOK).JSON(res)
+}
+
+// the admin api is reserved to the super context
+func requireSuper(c *fiber.Ctx, cfg *cfg.Config) error {
+	if !IsSuper(cfg, GetPrincipal(c).Context) {
+		return fiber.NewError(fiber.StatusForbidden,
+			"Only the super context is allowed to manage api contexts!")
+	}
+
+	return nil
+}
+
+// the name of a runtime context from the url, config contexts are read-only
+func runtimeContextParam(c *fiber.Ctx, cfg *cfg.Config) (string, error) {
+	name, err := common.Untaint(c.Params("name"), cfg.RegKey)
+	if err != nil || name == "" {
+		return "", fiber.NewError(fiber.StatusForbidden,
+			"Invalid api context provided!")
+	}
+
+	if cfg.IsConfigContext(name) || IsSuper(cfg, name) {
+		return "", fiber.NewError(fiber.StatusForbidden,
+			"Api context "+name+" is defined in the config and can't be changed at runtime!")
+	}
+
+	return name, nil
+}
+
+// list all api contexts, without keys
+func ContextList(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
+	if err := requireSuper(c, cfg); err != nil {
+		return err
+	}
+
+	if err := SyncContexts(cfg, db); err != nil {
+		return JsonStatus(c, fiber.StatusInternalServerError,
+			"Unable to load api contexts: "+err.Error())
+	}
+
+	contexts := []*common.ApiContext{}
+	for _, apicontext := range cfg.Contexts() {
+		source := ContextSourceRuntime
+		if cfg.IsConfigContext(apicontext.Context) {
+			source = ContextSourceConfig
+		}
+
+		contexts = append(contexts, contextInfo(&apicontext, source))
+	}
+
+	return contextsResponse(c, contexts)
+}
+
+// create a new api context, the generated key is only returned once
+func ContextCreate(c *fiber.Ctx, conf *cfg.Config, db *Db) error {
+	if err := requireSuper(c, conf); err != nil {
+		return err
+	}
+
+	contextdata := new(ContextRequest)
+	if err := c.BodyParser(contextdata); err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Unable to parse body: "+err.Error())
+	}
+
+	name, err := common.Untaint(contextdata.Context, conf.RegKey)
+	if err != nil || name == "" {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Invalid api context provided!")
+	}
+
+	parent, err := common.Untaint(contextdata.Parent, conf.RegKey)
+	if err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Invalid parent provided!")
+	}
+
+	apicontext := &cfg.Apicontext{
+		Context: name,
+		Role:    contextdata.Role,
+		Parent:  parent,
+		Allow:   contextdata.Allow,
+		IdStyle: contextdata.IdStyle,
+	}
+
+	key, err := newContextKey(apicontext)
+	if err != nil {
+		return JsonStatus(c, fiber.StatusInternalServerError,
+			"Unable to create key: "+err.Error())
+	}
+
+	if err := apicontext.Normalize(); err != nil {
+		return JsonStatus(c, fiber.StatusForbidden, err.Error())
+	}
+
+	if err := SyncContexts(conf, db); err != nil {
+		return JsonStatus(c, fiber.StatusInternalServerError,
+			"Unable to load api contexts: "+err.Error())
+	}
+
+	if err := cfg.ValidateContexts(append(conf.Contexts(), *apicontext)); err != nil {
+		return JsonStatus(c, fiber.StatusForbidden, err.Error())
+	}
+
+	if err := db.ContextPut(apicontext, true); err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Unable to create api context: "+err.Error())
+	}
+
+	if err := SyncContexts(conf, db); err != nil {
+		LogFor(c).Warn("Unable to load api contexts: %s", err)
+	}
+
+	Audit(c, db, AuditCreate, AuditContext, name, GetPrincipal(c).Context,
+		fmt.Sprintf("role: %s, parent: %s", apicontext.Role, apicontext.Parent))
+
+	info := contextInfo(apicontext, ContextSourceRuntime)
+	info.Key = key
+
+	return contextsResponse(c, []*common.ApiContext{info})
+}
+
+// remove a runtime api context, its key stops working immediately
+func ContextRemove(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
+	if err := requireSuper(c, cfg); err != nil {
+		return err
+	}
+
+	name, err := runtimeContextParam(c, cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := SyncContexts(cfg, db); err != nil {
+		return JsonStatus(c, fiber.StatusInternalServerError,
+			"Unable to load api contexts: "+err.Error())
+	}
+
+	for _, apicontext := range cfg.Contexts() {
+		if apicontext.Parent == name {
+			return JsonStatus(c, fiber.StatusForbidden,
+				"Api context "+name+" is the parent of "+apicontext.Context+"!")
+		}
+	}
+
+	if err := db.ContextDelete(name); err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Unable to remove api context: "+err.Error())
+	}
+
+	if err := SyncContexts(cfg, db); err != nil {
+		LogFor(c).Warn("Unable to load api contexts: %s", err)
+	}
+
+	Audit(c, db, AuditDelete, AuditContext, name, GetPrincipal(c).Context, "")
+
+	return JsonStatus(c, fiber.StatusOK, "Api context "+name+" has been removed")
+}
+
+// replace the key of a runtime api context, the old key stops working immediately
+func ContextRotate(c *fiber.Ctx, conf *cfg.Config, db *Db) error {
+	if err := requireSuper(c, conf); err != nil {
+		return err
+	}
+
+	name, err := runtimeContextParam(c, conf)
+	if err != nil {
+		return err
+	}
+
+	contexts, _, err := db.ContextsLoad()
+	if err != nil {
+		return JsonStatus(c, fiber.StatusInternalServerError,
+			"Unable to load api contexts: "+err.Error())
+	}
+
+	var apicontext *cfg.Apicontext
+	for i := range contexts {
+		if contexts[i].Context == name {
+			apicontext = &contexts[i]
+		}
+	}
+
+	if apicontext == nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Unable to rotate key: api context "+name+" not found")
+	}
+
+	key, err := newContextKey(apicontext)
+	if err != nil {
+		return JsonStatus(c, fiber.StatusInternalServerError,
+			"Unable to create key: "+err.Error())
+	}
+
+	if err := db.ContextPut(apicontext, false); err != nil {
+		return JsonStatus(c, fiber.StatusInternalServerError,
+			"Unable to rotate key: "+err.Error())
+	}
+
+	if err := SyncContexts(conf, db); err != nil {
+		LogFor(c).Warn("Unable to load api contexts: %s", err)
+	}
+
+	Audit(c, db, AuditModify, AuditContext, name, GetPrincipal(c).Context, "key rotated")
+
+	info := contextInfo(apicontext, ContextSourceRuntime)
+	info.Key = key
+
+	return contextsResponse(c, []*common.ApiContext{info})
+}
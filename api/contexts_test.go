@@ -0,0 +1,248 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+)
+
+func TestAdminContexts(t *testing.T) {
+	c := &cfg.Config{
+		DbFile:     "contextstest.db",
+		StorageDir: ".",
+		Super:      "adm",
+		Apicontexts: []cfg.Apicontext{
+			{Context: "adm", Key: "admkey"},
+			{Context: "ro", Key: "rokey", Role: cfg.RoleReadOnly},
+			{Context: "team", Key: "teamkey"}, // admin, but not super
+		},
+	}
+
+	if err := c.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply config defaults: " + err.Error())
+	}
+
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	auth := SetupAuthStore(c, db)
+	defer AuthSetApikeys(nil)
+
+	app := fiber.New(fiber.Config{
+		ErrorHandler: func(ctx *fiber.Ctx, err error) error {
+			return SendResponse(ctx, "", err)
+		},
+	})
+	app.Get("/uploads", auth, RequireScope(db, ScopeList), func(ctx *fiber.Ctx) error {
+		return UploadsList(ctx, c, db)
+	})
+	app.Get("/contexts", auth, RequireScope(db, ScopeContexts), func(ctx *fiber.Ctx) error {
+		return ContextList(ctx, c, db)
+	})
+	app.Post("/contexts", auth, RequireScope(db, ScopeContexts), func(ctx *fiber.Ctx) error {
+		return ContextCreate(ctx, c, db)
+	})
+	app.Delete("/contexts/:name", auth, RequireScope(db, ScopeContexts), func(ctx *fiber.Ctx) error {
+		return ContextRemove(ctx, c, db)
+	})
+	app.Post("/contexts/:name/rotate", auth, RequireScope(db, ScopeContexts), func(ctx *fiber.Ctx) error {
+		return ContextRotate(ctx, c, db)
+	})
+
+	call := func(method, path, key, body string) (int, *common.Response) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Request failed: " + err.Error())
+		}
+
+		response := &common.Response{}
+		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+			t.Errorf("response is not json: %s", err)
+		}
+
+		return resp.StatusCode, response
+	}
+
+	// only the super context manages contexts
+	if status, _ := call("POST", "/contexts", "rokey", `{"context":"new"}`); status != fiber.StatusForbidden {
+		t.Errorf("read-only context created a context, status %d", status)
+	}
+
+	status, response := call("POST", "/contexts", "admkey", `{"context":"new","role":"read-only"}`)
+	if status != fiber.StatusOK || len(response.Contexts) != 1 || response.Contexts[0].Key == "" {
+		t.Fatalf("could not create context, status %d: %s", status, response.Message)
+	}
+
+	key := response.Contexts[0].Key
+
+	// effective immediately
+	if status, _ := call("GET", "/uploads", key, "{}"); status != fiber.StatusOK {
+		t.Errorf("new context key not accepted, status %d", status)
+	}
+
+	// not even other admin contexts
+	for _, tt := range []struct{ method, path, body string }{
+		{"GET", "/contexts", ""},
+		{"POST", "/contexts", `{"context":"evil"}`},
+		{"POST", "/contexts/new/rotate", ""},
+		{"DELETE", "/contexts/new", ""},
+	} {
+		if status, response := call(tt.method, tt.path, "teamkey", tt.body); status != fiber.StatusForbidden ||
+			len(response.Contexts) != 0 {
+			t.Errorf("non-super admin context used %s %s, status %d", tt.method, tt.path, status)
+		}
+	}
+
+	if status, _ := call("GET", "/uploads", key, "{}"); status != fiber.StatusOK {
+		t.Errorf("context key changed by non-super admin context, status %d", status)
+	}
+
+	if status, _ := call("POST", "/contexts", "admkey", `{"context":"new"}`); status != fiber.StatusForbidden {
+		t.Errorf("duplicate context created, status %d", status)
+	}
+
+	if status, _ := call("POST", "/contexts", "admkey", `{"context":"orphan","parent":"none"}`); status != fiber.StatusForbidden {
+		t.Errorf("context with unknown parent created, status %d", status)
+	}
+
+	status, response = call("GET", "/contexts", "admkey", "")
+	if status != fiber.StatusOK || len(response.Contexts) != 4 {
+		t.Fatalf("got status %d and %d contexts, want 4", status, len(response.Contexts))
+	}
+
+	for _, apicontext := range response.Contexts {
+		if apicontext.Context == "evil" {
+			t.Errorf("context created by non-super admin context")
+		}
+	}
+
+	for _, apicontext := range response.Contexts {
+		if apicontext.Key != "" {
+			t.Errorf("context list contains the key of %s", apicontext.Context)
+		}
+	}
+
+	// the old key stops working after rotation
+	status, response = call("POST", "/contexts/new/rotate", "admkey", "")
+	if status != fiber.StatusOK || len(response.Contexts) != 1 || response.Contexts[0].Key == key {
+		t.Fatalf("could not rotate key, status %d: %s", status, response.Message)
+	}
+
+	if status, _ := call("GET", "/uploads", key, "{}"); status != fiber.StatusForbidden {
+		t.Errorf("rotated key still accepted, status %d", status)
+	}
+
+	key = response.Contexts[0].Key
+	if status, _ := call("GET", "/uploads", key, "{}"); status != fiber.StatusOK {
+		t.Errorf("rotated key not accepted, status %d", status)
+	}
+
+	// config contexts are read-only
+	for _, path := range []string{"/contexts/ro/rotate", "/contexts/adm"} {
+		method := "POST"
+		if !strings.HasSuffix(path, "/rotate") {
+			method = "DELETE"
+		}
+
+		if status, _ := call(method, path, "admkey", ""); status != fiber.StatusForbidden {
+			t.Errorf("config context modified using %s %s, status %d", method, path, status)
+		}
+	}
+
+	// removed contexts lose access immediately
+	if status, _ := call("DELETE", "/contexts/new", "admkey", ""); status != fiber.StatusOK {
+		t.Errorf("could not remove context, status %d", status)
+	}
+
+	if status, _ := call("GET", "/uploads", key, "{}"); status != fiber.StatusForbidden {
+		t.Errorf("key of removed context still accepted, status %d", status)
+	}
+}
+
+func TestContextsVersionShared(t *testing.T) {
+	c := &cfg.Config{
+		DbFile:     "contextsshared.db",
+		StorageDir: ".",
+		Prefork:    true,
+	}
+
+	if err := c.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply config defaults: " + err.Error())
+	}
+
+	// two processes sharing the database file
+	parent, err := NewDb(c)
+	defer finalize(parent)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	child, err := NewDb(c)
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	version, err := child.ContextsVersion()
+	if err != nil {
+		t.Fatalf("Could not read contexts version: " + err.Error())
+	}
+
+	if err := parent.ContextPut(&cfg.Apicontext{Context: "new", KeyHash: "x"}, true); err != nil {
+		t.Fatalf("Could not add context: " + err.Error())
+	}
+
+	// recently seen, the database isn't opened again
+	if seen, _ := child.ContextsVersion(); seen != version {
+		t.Errorf("contexts version read again, got %d, want %d", seen, version)
+	}
+
+	// too old
+	child.seen.Store(contextsSeen{version: version, at: time.Now().Add(-contextsMaxAge)})
+	if seen, _ := child.ContextsVersion(); seen != version+1 {
+		t.Errorf("outdated contexts version used, got %d, want %d", seen, version+1)
+	}
+
+	// any other transaction records the version as well
+	if err := parent.ContextDelete("new"); err != nil {
+		t.Fatalf("Could not remove context: " + err.Error())
+	}
+
+	if _, _, err := child.ContextsLoad(); err != nil {
+		t.Fatalf("Could not load contexts: " + err.Error())
+	}
+
+	if seen, _ := child.ContextsVersion(); seen != version+2 {
+		t.Errorf("contexts version not recorded by transaction, got %d, want %d", seen, version+2)
+	}
+}
@@ -17,34 +17,136 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package api
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/tlinden/ephemerup/cfg"
 	"github.com/tlinden/ephemerup/common"
 	//"github.com/alecthomas/repr"
 	bolt "go.etcd.io/bbolt"
 	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const Bucket string = "data"
 
+// password hashes of protected uploads, never returned to clients
+const PasswordBucket string = "passwords"
+
+var ErrDownloadLimit = errors.New("download limit reached")
+
+// returned if an asap upload is already being or has been downloaded
+var ErrDownloadClaimed = errors.New("upload already downloaded")
+
+// suffix of list filters to include the descendants of an api context
+const ContextSubtree = "/..."
+
+// how long to wait for the database lock held by another process
+const dbLockTimeout = 10 * time.Second
+
 // wrapper for bolt db
 type Db struct {
-	bolt *bolt.DB
-	cfg  *cfg.Config
+	bolt     *bolt.DB     // nil if shared
+	config   atomic.Value // *cfg.Config, replaced on reload, see Config()
+	shared   bool
+	contexts contextsState // runtime api contexts in use, see SyncContexts()
+	seen     atomic.Value  // contextsSeen, by the last transaction if shared
+	entries  entryCount    // cached for the metrics, see countEntries()
 }
 
+/*
+   Open the database.  In prefork  mode all  server processes  use the
+   same database file. Bbolt locks the file while it is open, so in that
+   case we don't keep it open, but open it for every transaction, see
+   update() and view().  The file lock serializes writers across the
+   processes, readers share it.
+*/
 func NewDb(c *cfg.Config) (*Db, error) {
+	if c.Prefork {
+		db := &Db{shared: true}
+		db.SetConfig(c)
+
+		// create the file, if it doesn't exist yet
+		b, err := db.open(false)
+		if err != nil {
+			return db, err
+		}
+
+		return db, b.Close()
+	}
+
 	b, err := bolt.Open(c.DbFile, 0600, nil)
-	db := Db{bolt: b, cfg: c}
-	return &db, err
+	db := &Db{bolt: b}
+	db.SetConfig(c)
+	return db, err
+}
+
+/*
+   The active config.  Fetch it once per request  or operation, it may
+   be replaced by a reload at any time, see Reload().
+*/
+func (db *Db) Config() *cfg.Config {
+	return db.config.Load().(*cfg.Config)
+}
+
+func (db *Db) SetConfig(c *cfg.Config) {
+	db.config.Store(c)
 }
 
 func (db *Db) Close() {
-	db.bolt.Close()
+	if db.bolt != nil {
+		db.bolt.Close()
+	}
+}
+
+func (db *Db) open(readonly bool) (*bolt.DB, error) {
+	return bolt.Open(db.Config().DbFile, 0600, &bolt.Options{Timeout: dbLockTimeout, ReadOnly: readonly})
+}
+
+// run a read-write transaction
+func (db *Db) update(fn func(*bolt.Tx) error) error {
+	if !db.shared {
+		return db.bolt.Update(fn)
+	}
+
+	b, err := db.open(false)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	return b.Update(func(tx *bolt.Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		db.sawContexts(tx)
+		return nil
+	})
+}
+
+// run a read-only transaction
+func (db *Db) view(fn func(*bolt.Tx) error) error {
+	if !db.shared {
+		return db.bolt.View(fn)
+	}
+
+	b, err := db.open(true)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	return b.View(func(tx *bolt.Tx) error {
+		db.sawContexts(tx)
+		return fn(tx)
+	})
 }
 
 func (db *Db) Insert(id string, entry common.Dbentry) error {
-	err := db.bolt.Update(func(tx *bolt.Tx) error {
+	err := db.update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists([]byte(Bucket))
 		if err != nil {
 			return fmt.Errorf("create bucket: %s", err)
@@ -63,14 +165,93 @@ func (db *Db) Insert(id string, entry common.Dbentry) error {
 		return nil
 	})
 	if err != nil {
-		Log("DB error: %s", err.Error())
+		Error("DB error: %s", err.Error())
+	}
+
+	return err
+}
+
+/*
+   Store a new upload along with its password hash, if any, in a single
+   transaction, so an upload never exists without its password. The
+   journal entry of the upload is removed in the same transaction.
+*/
+func (db *Db) InsertUpload(entry *common.Upload, hash string) error {
+	err := db.update(func(tx *bolt.Tx) error {
+		if hash != "" {
+			passwords, err := tx.CreateBucketIfNotExists([]byte(PasswordBucket))
+			if err != nil {
+				return fmt.Errorf("create bucket: %s", err)
+			}
+
+			if err := passwords.Put([]byte(entry.Id), []byte(hash)); err != nil {
+				return fmt.Errorf("insert password: %s", err)
+			}
+		}
+
+		bucket, err := tx.CreateBucketIfNotExists([]byte(Bucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+
+		jsonentry, err := entry.Marshal()
+		if err != nil {
+			return fmt.Errorf("json marshalling failure: %s", err)
+		}
+
+		if err := bucket.Put([]byte(entry.Id), jsonentry); err != nil {
+			return fmt.Errorf("insert data: %s", err)
+		}
+
+		return journalDelete(tx, entry.Id)
+	})
+
+	if err != nil {
+		Error("DB error: %s", err.Error())
 	}
 
 	return err
 }
 
+/*
+   True if an entry of entryContext matches the api context filter of a
+   list request. An empty filter matches everything, a filter with the
+   suffix  ContextSubtree  matches the context and all its descendants.
+*/
+func matchContextFilter(conf *cfg.Config, entryContext, filter string) bool {
+	if filter == "" {
+		return true
+	}
+
+	if strings.HasSuffix(filter, ContextSubtree) {
+		return conf.ContextWithin(entryContext, strings.TrimSuffix(filter, ContextSubtree))
+	}
+
+	return entryContext == filter
+}
+
+// scopes required to list entries of a type
+func listScopes(t int) []string {
+	if t == common.TypeForm {
+		return []string{ScopeForms, ScopeList}
+	}
+
+	return []string{ScopeList}
+}
+
+// scope required to delete an entry
+func deleteScope(j []byte) string {
+	if entry, err := common.Unmarshal(j, common.TypeForm); err == nil && entry.IsType(common.TypeForm) {
+		return ScopeForms
+	}
+
+	return ScopeDelete
+}
+
 func (db *Db) Delete(apicontext string, id string) error {
-	err := db.bolt.Update(func(tx *bolt.Tx) error {
+	conf := db.Config()
+
+	err := db.update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(Bucket))
 
 		if bucket == nil {
@@ -88,25 +269,45 @@ func (db *Db) Delete(apicontext string, id string) error {
 			return fmt.Errorf("unable to unmarshal json: %s", err)
 		}
 
-		if (apicontext != "" && (db.cfg.Super == apicontext || entryContext == apicontext)) || apicontext == "" {
+		if !ContextAllowed(conf, apicontext, deleteScope(j)) {
+			return ErrForbidden
+		}
+
+		if (apicontext != "" && (conf.Super == apicontext || conf.ContextWithin(entryContext, apicontext))) || apicontext == "" {
+			if passwords := tx.Bucket([]byte(PasswordBucket)); passwords != nil {
+				if err := passwords.Delete([]byte(id)); err != nil {
+					return err
+				}
+			}
+
+			if err := deleteShortId(tx, j); err != nil {
+				return err
+			}
+
 			return bucket.Delete([]byte(id))
 		}
 
-		return nil
+		return fmt.Errorf("id %s not found", id)
 	})
 
 	if err != nil {
-		Log("DB error: %s", err.Error())
+		Error("DB error: %s", err.Error())
 	}
 
 	return err
 }
 
 func (db *Db) List(apicontext string, filter string, query string, t int) (*common.Response, error) {
+	conf := db.Config()
+
 	response := &common.Response{}
 	qr := regexp.MustCompile(query)
 
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	if !ContextAllowed(conf, apicontext, listScopes(t)...) {
+		return response, ErrForbidden
+	}
+
+	err := db.view(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(Bucket))
 		if bucket == nil {
 			return nil
@@ -131,21 +332,19 @@ func (db *Db) List(apicontext string, filter string, query string, t int) (*comm
 				entryContext = entry.(*common.Form).Context
 			}
 
+			db.setExpiresAt(entry)
+
 			// check if the user is allowed to list this entry
-			if apicontext != "" && db.cfg.Super != apicontext {
-				// authenticated user but not member of super
-				// only return the uploads matching her context
-				if apicontext == entryContext {
+			if apicontext != "" && !CanSeeAll(conf, apicontext) {
+				// authenticated user but neither super nor auditor
+				// only return the uploads of her context and its descendants
+				if conf.ContextWithin(entryContext, apicontext) {
 					// unless a filter OR no filter specified
-					if (filter != "" && entryContext == filter) || filter == "" {
-						allowed = true
-					}
+					allowed = matchContextFilter(conf, entryContext, filter)
 				}
 			} else {
-				// return all, because we operate a public service or current==super
-				if (filter != "" && entryContext == filter) || filter == "" {
-					allowed = true
-				}
+				// return all, because we operate a public service or current==super|auditor
+				allowed = matchContextFilter(conf, entryContext, filter)
 			}
 
 			if allowed {
@@ -179,9 +378,11 @@ func (db *Db) List(apicontext string, filter string, query string, t int) (*comm
 // we only return one obj here, but could return more later
 // FIXME: turn the id into a filter and call (Uploads|Forms)List(), same code!
 func (db *Db) Get(apicontext string, id string, t int) (*common.Response, error) {
+	conf := db.Config()
+
 	response := &common.Response{}
 
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.view(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(Bucket))
 		if bucket == nil {
 			return nil
@@ -204,9 +405,11 @@ func (db *Db) Get(apicontext string, id string, t int) (*common.Response, error)
 			entryContext = entry.(*common.Form).Context
 		}
 
-		if (apicontext != "" && (db.cfg.Super == apicontext || entryContext == apicontext)) || apicontext == "" {
+		db.setExpiresAt(entry)
+
+		if (apicontext != "" && (CanSeeAll(conf, apicontext) || conf.ContextWithin(entryContext, apicontext))) || apicontext == "" {
 			// allowed if no context (public or download)
-			// or if context matches or if context==super
+			// or if context or one of its parents matches or if context==super|auditor
 			response.Append(entry)
 		}
 
@@ -231,3 +434,206 @@ func (db *Db) Lookup(apicontext string, id string, t int) (*common.Response, err
 
 	return response, nil
 }
+
+/*
+   Count a download of  an upload. The counter is  maintained within a
+   single update  transaction, so concurrent downloads  can't exceed the
+   limit. Returns the modified upload or ErrDownloadLimit.
+
+   Asap uploads can only be claimed once: the first caller wins, all
+   others get ErrDownloadClaimed until the claim is released using
+   ReleaseDownload().
+*/
+func (db *Db) CountDownload(id string) (*common.Upload, error) {
+	upload := &common.Upload{}
+
+	err := db.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(Bucket))
+		if bucket == nil {
+			return fmt.Errorf("id %s not found", id)
+		}
+
+		j := bucket.Get([]byte(id))
+		if len(j) == 0 {
+			return fmt.Errorf("id %s not found", id)
+		}
+
+		if err := json.Unmarshal(j, upload); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %s", err)
+		}
+
+		if upload.Expire == "asap" && upload.Downloads > 0 {
+			return ErrDownloadClaimed
+		}
+
+		if upload.DownloadsExhausted() {
+			return ErrDownloadLimit
+		}
+
+		upload.Downloads++
+
+		jsonentry, err := upload.Marshal()
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(id), jsonentry)
+	})
+
+	return upload, err
+}
+
+/*
+   Change the settings of an upload  an api context is allowed to see.
+   The entry is read and written back in one transaction, so counters,
+   claims and link generations changed in the meantime by downloads or
+   revocations are kept. Only the  expire setting, description, download
+   limit and allowlist are taken from changes, empty values are left
+   alone:
+
+   - a negative MaxDownloads removes the limit
+   - an empty, but non-nil Allow removes the allowlist
+*/
+func (db *Db) ModifyUpload(apicontext string, id string, changes *common.Upload) (*common.Upload, error) {
+	conf := db.Config()
+	upload := &common.Upload{}
+
+	err := db.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(Bucket))
+		if bucket == nil {
+			return fmt.Errorf("id %s not found", id)
+		}
+
+		j := bucket.Get([]byte(id))
+		if len(j) == 0 {
+			return fmt.Errorf("id %s not found", id)
+		}
+
+		if err := json.Unmarshal(j, upload); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %s", err)
+		}
+
+		if apicontext != "" && !CanSeeAll(conf, apicontext) && !conf.ContextWithin(upload.Context, apicontext) {
+			return fmt.Errorf("id %s not found", id)
+		}
+
+		if changes.Expire != "" {
+			upload.Expire = changes.Expire
+		}
+
+		if changes.Description != "" {
+			upload.Description = changes.Description
+		}
+
+		switch {
+		case changes.MaxDownloads > 0:
+			upload.MaxDownloads = changes.MaxDownloads
+		case changes.MaxDownloads < 0:
+			upload.MaxDownloads = 0
+		}
+
+		switch {
+		case len(changes.Allow) > 0:
+			upload.Allow = changes.Allow
+		case changes.Allow != nil:
+			upload.Allow = nil
+		}
+
+		db.setExpiresAt(upload)
+
+		jsonentry, err := upload.Marshal()
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(id), jsonentry)
+	})
+
+	return upload, err
+}
+
+// undo CountDownload() after an aborted download, releases asap claims as well
+func (db *Db) ReleaseDownload(id string) (*common.Upload, error) {
+	upload := &common.Upload{}
+
+	err := db.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(Bucket))
+		if bucket == nil {
+			return fmt.Errorf("id %s not found", id)
+		}
+
+		j := bucket.Get([]byte(id))
+		if len(j) == 0 {
+			return fmt.Errorf("id %s not found", id)
+		}
+
+		if err := json.Unmarshal(j, upload); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %s", err)
+		}
+
+		if upload.Downloads > 0 {
+			upload.Downloads--
+		}
+
+		jsonentry, err := upload.Marshal()
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(id), jsonentry)
+	})
+
+	return upload, err
+}
+
+// (re-)calculate the absolute expire time, the default for asap might have changed
+func (db *Db) setExpiresAt(entry common.Dbentry) {
+	conf := db.Config()
+
+	switch e := entry.(type) {
+	case *common.Upload:
+		e.ExpiresAt = common.Timestamp{Time: ExpiresAt(conf, e.Created.Time, e.Expire)}
+	case *common.Form:
+		e.ExpiresAt = common.Timestamp{Time: ExpiresAt(conf, e.Created.Time, e.Expire)}
+	}
+}
+
+// store the password hash of a protected upload
+func (db *Db) SetPassword(id string, hash string) error {
+	err := db.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(PasswordBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+
+		return bucket.Put([]byte(id), []byte(hash))
+	})
+
+	if err != nil {
+		Error("DB error: %s", err.Error())
+	}
+
+	return err
+}
+
+// retrieve the password hash of a protected upload
+func (db *Db) GetPassword(id string) (string, error) {
+	var hash string
+
+	err := db.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(PasswordBucket))
+		if bucket == nil {
+			return fmt.Errorf("no password found for id %s", id)
+		}
+
+		j := bucket.Get([]byte(id))
+		if j == nil {
+			return fmt.Errorf("no password found for id %s", id)
+		}
+
+		hash = string(j)
+		return nil
+	})
+
+	return hash, err
+}
@@ -22,16 +22,15 @@ import (
 	"github.com/tlinden/ephemerup/cfg"
 	"github.com/tlinden/ephemerup/common"
 	"os"
+	"sync"
 	"testing"
 	"time"
 )
 
 func finalize(db *Db) {
-	if db.bolt != nil {
-		db.Close()
-	}
-	if _, err := os.Stat(db.cfg.DbFile); err == nil {
-		os.Remove(db.cfg.DbFile)
+	db.Close()
+	if _, err := os.Stat(db.Config().DbFile); err == nil {
+		os.Remove(db.Config().DbFile)
 	}
 }
 
@@ -141,9 +140,16 @@ func TestDboperation(t *testing.T) {
 						response.Uploads[0].Created, tt.upload.Created)
 				}
 
+				// asap with no default expire configured expires immediately
+				if !response.Uploads[0].ExpiresAt.Time.Equal(tt.upload.Created.Time) {
+					t.Errorf("Expire time doesn't match!\ngot: %s\nexp: %s\n",
+						response.Uploads[0].ExpiresAt, tt.upload.Created)
+				}
+
 				// equal them artificially,  because otherwise td will
 				// fail because of time.Time.wall+ext, or TZ is missing
 				response.Uploads[0].Created = tt.upload.Created
+				response.Uploads[0].ExpiresAt = tt.upload.ExpiresAt
 
 				// compare
 				td.Cmp(t, response.Uploads[0], &tt.upload, tt.name)
@@ -203,9 +209,16 @@ func TestDboperation(t *testing.T) {
 						response.Forms[0].Created, tt.form.Created)
 				}
 
+				// asap with no default expire configured expires immediately
+				if !response.Forms[0].ExpiresAt.Time.Equal(tt.form.Created.Time) {
+					t.Errorf("Expire time doesn't match!\ngot: %s\nexp: %s\n",
+						response.Forms[0].ExpiresAt, tt.form.Created)
+				}
+
 				// equal them artificially,  because otherwise td will
 				// fail because of time.Time.wall+ext, or TZ is missing
 				response.Forms[0].Created = tt.form.Created
+				response.Forms[0].ExpiresAt = tt.form.ExpiresAt
 
 				// compare
 				td.Cmp(t, response.Forms[0], &tt.form, tt.name)
@@ -236,3 +249,251 @@ func TestDboperation(t *testing.T) {
 		})
 	}
 }
+
+func TestCountDownload(t *testing.T) {
+	c := &cfg.Config{DbFile: "test.db"}
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	upload := common.Upload{Id: "1", Expire: "7d", Context: "foo", MaxDownloads: 2, Type: common.TypeUpload}
+	if err := db.Insert(upload.Id, upload); err != nil {
+		t.Fatalf("Could not insert new upload object: " + err.Error())
+	}
+
+	for i := 1; i <= 2; i++ {
+		counted, err := db.CountDownload(upload.Id)
+		if err != nil {
+			t.Errorf("Could not count download %d: %s", i, err)
+		}
+
+		if counted.Downloads != i {
+			t.Errorf("got %d downloads, want %d", counted.Downloads, i)
+		}
+	}
+
+	if _, err := db.CountDownload(upload.Id); err != ErrDownloadLimit {
+		t.Errorf("expected ErrDownloadLimit after 2 downloads, got: %v", err)
+	}
+}
+
+func TestClaimAsapDownload(t *testing.T) {
+	c := &cfg.Config{DbFile: "test.db"}
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	upload := common.Upload{Id: "1", Expire: "asap", Context: "foo", Type: common.TypeUpload}
+	if err := db.Insert(upload.Id, upload); err != nil {
+		t.Fatalf("Could not insert new upload object: " + err.Error())
+	}
+
+	// concurrent requests, only one of them may win
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claimed := 0
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := db.CountDownload(upload.Id)
+			switch err {
+			case nil:
+				mu.Lock()
+				claimed++
+				mu.Unlock()
+			case ErrDownloadClaimed:
+			default:
+				t.Errorf("Unexpected error claiming download: %s", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if claimed != 1 {
+		t.Errorf("got %d successful claims, want 1", claimed)
+	}
+
+	// an aborted download releases the claim
+	if _, err := db.ReleaseDownload(upload.Id); err != nil {
+		t.Errorf("Could not release download: " + err.Error())
+	}
+
+	if _, err := db.CountDownload(upload.Id); err != nil {
+		t.Errorf("Could not claim released download: " + err.Error())
+	}
+}
+
+func TestModifyUpload(t *testing.T) {
+	c := &cfg.Config{DbFile: "test.db"}
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	upload := common.Upload{Id: "1", Expire: "7d", Context: "foo", Type: common.TypeUpload}
+	if err := db.Insert(upload.Id, upload); err != nil {
+		t.Fatalf("Could not insert new upload object: " + err.Error())
+	}
+
+	// downloads running while the upload is being modified are all counted
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+
+			if _, err := db.CountDownload(upload.Id); err != nil {
+				t.Errorf("Could not count download: " + err.Error())
+			}
+		}()
+		go func() {
+			defer wg.Done()
+
+			if _, err := db.ModifyUpload("foo", upload.Id, &common.Upload{Description: "changed", MaxDownloads: -1}); err != nil {
+				t.Errorf("Could not modify upload: " + err.Error())
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	modified, err := db.ModifyUpload("foo", upload.Id, &common.Upload{Expire: "1d", Allow: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatalf("Could not modify upload: " + err.Error())
+	}
+
+	td.Cmp(t, modified.Downloads, 20, "downloads counted during modify")
+	td.Cmp(t, modified.Description, "changed", "description")
+	td.Cmp(t, modified.Expire, "1d", "expire")
+	td.Cmp(t, modified.Allow, []string{"10.0.0.0/8"}, "allow")
+
+	// an empty allowlist removes it
+	modified, _ = db.ModifyUpload("foo", upload.Id, &common.Upload{Allow: []string{}})
+	td.CmpNil(t, modified.Allow, "allow removed")
+
+	// other contexts don't see the upload
+	if _, err := db.ModifyUpload("bar", upload.Id, &common.Upload{Description: "evil"}); err == nil {
+		t.Errorf("Upload modified by another context")
+	}
+
+	// modifying an asap upload doesn't release a running download
+	asap := common.Upload{Id: "2", Expire: "asap", Context: "foo", Type: common.TypeUpload}
+	if err := db.Insert(asap.Id, asap); err != nil {
+		t.Fatalf("Could not insert new upload object: " + err.Error())
+	}
+
+	if _, err := db.CountDownload(asap.Id); err != nil {
+		t.Fatalf("Could not claim download: " + err.Error())
+	}
+
+	if _, err := db.ModifyUpload("foo", asap.Id, &common.Upload{Description: "changed"}); err != nil {
+		t.Errorf("Could not modify upload: " + err.Error())
+	}
+
+	if _, err := db.CountDownload(asap.Id); err != ErrDownloadClaimed {
+		t.Errorf("asap claim released by modify, got: %v", err)
+	}
+}
+
+func TestContextHierarchy(t *testing.T) {
+	c := &cfg.Config{
+		DbFile: "hierarchytest.db",
+		Apicontexts: []cfg.Apicontext{
+			{Context: "dept", Key: "deptkey"},
+			{Context: "team-a", Key: "akey", Parent: "dept"},
+			{Context: "team-b", Key: "bkey", Parent: "dept"},
+			{Context: "sub-a", Key: "subkey", Parent: "team-a"},
+			{Context: "other", Key: "otherkey"},
+		},
+	}
+
+	if err := c.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply config defaults: " + err.Error())
+	}
+
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	for _, ctx := range []string{"dept", "team-a", "team-b", "sub-a", "other"} {
+		upload := common.Upload{Id: ctx, Expire: "1d", Context: ctx, Type: common.TypeUpload}
+		if err := db.Insert(upload.Id, upload); err != nil {
+			t.Fatalf("Could not insert new upload object: " + err.Error())
+		}
+	}
+
+	var tests = []struct {
+		name       string
+		apicontext string
+		filter     string
+		expect     int
+	}{
+		{"parent", "dept", "", 4},
+		{"child", "team-a", "", 2},
+		{"leaf", "sub-a", "", 1},
+		{"unrelated", "other", "", 1},
+		{"parent-filter", "dept", "team-a", 1},
+		{"parent-subtree", "dept", "team-a" + ContextSubtree, 2},
+		{"child-filter-parent", "team-a", "dept", 0},
+		{"child-subtree-parent", "team-a", "dept" + ContextSubtree, 2},
+		{"subtree-foreign", "other", "dept" + ContextSubtree, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := db.List(tt.apicontext, tt.filter, "", common.TypeUpload)
+			if err != nil {
+				t.Fatalf("Could not list uploads: " + err.Error())
+			}
+
+			if len(response.Uploads) != tt.expect {
+				t.Errorf("got %d uploads, want %d", len(response.Uploads), tt.expect)
+			}
+		})
+	}
+
+	if response, _ := db.Get("dept", "sub-a", common.TypeUpload); len(response.Uploads) != 1 {
+		t.Errorf("parent can't see the upload of a descendant")
+	}
+
+	if response, _ := db.Get("team-a", "dept", common.TypeUpload); len(response.Uploads) != 0 {
+		t.Errorf("child can see the upload of its parent")
+	}
+
+	if err := db.Delete("team-b", "team-a"); err == nil {
+		t.Errorf("sibling deleted an upload")
+	}
+
+	if err := db.Delete("dept", "team-a"); err != nil {
+		t.Errorf("parent could not delete the upload of a child: %s", err)
+	}
+
+	invalid := [][]cfg.Apicontext{
+		{{Context: "a", Key: "a", Parent: "nope"}},
+		{{Context: "a", Key: "a", Parent: "a"}},
+		{{Context: "a", Key: "a", Parent: "b"}, {Context: "b", Key: "b", Parent: "a"}},
+	}
+
+	for _, contexts := range invalid {
+		conf := &cfg.Config{Apicontexts: contexts}
+		if err := conf.ApplyDefaults(); err == nil {
+			t.Errorf("invalid hierarchy accepted: %v", contexts)
+		}
+	}
+}
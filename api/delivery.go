@@ -0,0 +1,151 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+)
+
+/*
+   User agents of link unfurlers (chat apps, social networks, mail link
+   scanners). They fetch links automatically to render a preview, so
+   they get  the landing page instead  of the file and  never consume
+   an upload. Search engine crawlers  are not in here, they don't get
+   links to  uploads. Matched case insensitive as substrings, more can
+   be added using the config option previewagents.
+*/
+var previewAgents = []string{
+	"slackbot", "slack-imgproxy", "twitterbot", "facebookexternalhit",
+	"facebot", "discordbot", "telegrambot", "whatsapp", "skypeuripreview",
+	"microsoftpreview", "teamsbot", "linkedinbot", "mattermost-bot", "redditbot",
+	"iframely", "embedly", "vkshare", "snap url preview", "zoombot",
+	"microsoft office existence discovery", "bitlybot", "google-safety",
+}
+
+// returns the matching agent if the client is a link preview crawler
+func PreviewAgent(c *fiber.Ctx, conf *cfg.Config) string {
+	agent := strings.ToLower(c.Get(fiber.HeaderUserAgent))
+	if agent == "" {
+		return ""
+	}
+
+	for _, list := range [][]string{previewAgents, conf.PreviewAgents} {
+		for _, preview := range list {
+			if preview != "" && strings.Contains(agent, strings.ToLower(preview)) {
+				return preview
+			}
+		}
+	}
+
+	return ""
+}
+
+// size of the chunks a download is written to the client in
+const deliveryChunkSize = 32 * 1024
+
+/*
+   Reader for  the response  body of a  download. Fasthttp copies the
+   body into the buffered  connection writer using WriteTo(), which
+   flushes every chunk, so  we know how  many bytes have actually been
+   written  to the  client  connection. Fasthttp  closes the  body
+   stream once it  is done  writing the response, successful or  not,
+   then done() is called exactly once.
+*/
+type deliveryReader struct {
+	file *os.File
+	size int64
+	sent int64
+	done func(sent, size int64)
+	once sync.Once
+}
+
+// only used if the body is not written using WriteTo()
+func (r *deliveryReader) Read(p []byte) (int, error) {
+	n, err := r.file.Read(p)
+	r.sent += int64(n)
+	return n, err
+}
+
+func (r *deliveryReader) WriteTo(w io.Writer) (int64, error) {
+	flusher, _ := w.(interface{ Flush() error })
+	buf := make([]byte, deliveryChunkSize)
+	var written int64
+
+	for {
+		n, err := r.file.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+
+			if flusher != nil {
+				if werr := flusher.Flush(); werr != nil {
+					return written, werr
+				}
+			}
+
+			written += int64(n)
+			r.sent += int64(n)
+		}
+
+		if err == io.EOF {
+			return written, nil
+		}
+
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+func (r *deliveryReader) Close() error {
+	err := r.file.Close()
+	r.once.Do(func() {
+		r.done(r.sent, r.size)
+	})
+	return err
+}
+
+/*
+   Send a file as  attachment to the client.  done() will be called
+   after the response has been written (or the client went away) with
+   the number of bytes delivered. Don't access the fiber context from
+   within done(), it is being reused by then.
+*/
+func sendDownload(c *fiber.Ctx, filename, file string, done func(sent, size int64)) error {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+
+	stat, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+
+	c.Attachment(file)
+	c.Context().SetBodyStream(&deliveryReader{file: fd, size: stat.Size(), done: done}, int(stat.Size()))
+
+	return nil
+}
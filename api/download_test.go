@@ -0,0 +1,362 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+)
+
+const (
+	asapId      = "cc2c965a-64b5-4b09-9f8b-61e4f1b1c7a1"
+	unlimitedId = "ab3f1c22-64b5-4b09-9f8b-61e4f1b1c7a1"
+)
+
+// create an upload including its file in the storage dir
+func createUpload(t *testing.T, c *cfg.Config, db *Db, upload *common.Upload) {
+	if err := db.Insert(upload.Id, upload); err != nil {
+		t.Fatalf("Could not insert upload: " + err.Error())
+	}
+
+	if err := os.MkdirAll(filepath.Join(c.StorageDir, upload.Id), os.ModePerm); err != nil {
+		t.Fatalf("Could not create storage dir: " + err.Error())
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(c.StorageDir, upload.Id, upload.File), []byte("content"), 0644); err != nil {
+		t.Fatalf("Could not create file: " + err.Error())
+	}
+}
+
+func TestDownloadPage(t *testing.T) {
+	c := &cfg.Config{
+		DbFile:       "downloadtest.db",
+		StorageDir:   t.TempDir(),
+		Downloadpage: `{{ .File }} {{ .Size }} {{ .Expire }}`,
+	}
+
+	if err := c.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply config defaults: " + err.Error())
+	}
+
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	now := common.Timestamp{Time: time.Now()}
+	createUpload(t, c, db, &common.Upload{Id: asapId, File: "t1", Type: common.TypeUpload, Expire: "asap", Created: now})
+	createUpload(t, c, db, &common.Upload{Id: unlimitedId, File: "t1", Type: common.TypeUpload, Expire: "1d", Created: now})
+
+	app := fiber.New()
+	app.Get("/download/:id", func(ctx *fiber.Ctx) error {
+		return UploadFetch(ctx, c, db, shallExpire)
+	})
+	app.Post("/download/:id", func(ctx *fiber.Ctx) error {
+		return UploadFetch(ctx, c, db, shallExpire)
+	})
+
+	var tests = []struct {
+		name   string
+		method string
+		agent  string
+		id     string
+		accept string
+		expect string
+	}{
+		{"head", "HEAD", "curl/7.88", asapId, "*/*", ""},
+		{"preview-bot", "GET", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", asapId, "*/*", "t1 7 B after the first download"},
+		{"browser-landing-page", "GET", "Mozilla/5.0", asapId, "text/html,application/xhtml+xml", "t1 7 B after the first download"},
+		{"browser-landing-page-again", "GET", "Mozilla/5.0", asapId, "text/html", "t1 7 B after the first download"},
+		{"browser-confirm", "POST", "Mozilla/5.0", asapId, "text/html", "content"},
+		{"api-client", "GET", "upctl", unlimitedId, "*/*", "content"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/download/"+tt.id, strings.NewReader("confirm=1"))
+			req.Header.Set("Accept", tt.accept)
+			req.Header.Set("User-Agent", tt.agent)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Request failed: " + err.Error())
+			}
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != fiber.StatusOK || string(body) != tt.expect {
+				t.Errorf("got %d %q, want 200 %q", resp.StatusCode, body, tt.expect)
+			}
+		})
+	}
+}
+
+// load a template shipped with the server
+func loadTemplate(t *testing.T, name string) string {
+	content, err := ioutil.ReadFile(filepath.Join("..", "templates", name))
+	if err != nil {
+		t.Fatalf("Could not read template: " + err.Error())
+	}
+
+	return string(content)
+}
+
+func TestProtectedDownloadPage(t *testing.T) {
+	c := &cfg.Config{
+		DbFile:       "protectedtest.db",
+		StorageDir:   t.TempDir(),
+		Downloadpage: loadTemplate(t, "downloadtemplate.html"),
+		Passwordpage: loadTemplate(t, "passwordtemplate.html"),
+	}
+
+	if err := c.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply config defaults: " + err.Error())
+	}
+
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatalf("Could not hash password: " + err.Error())
+	}
+
+	createUpload(t, c, db, &common.Upload{Id: asapId, File: "quarterly-report.pdf", Type: common.TypeUpload,
+		Expire: "asap", Description: "numbers", Protected: true, Created: common.Timestamp{Time: time.Now()}})
+	if err := db.SetPassword(asapId, hash); err != nil {
+		t.Fatalf("Could not set password: " + err.Error())
+	}
+
+	app := fiber.New()
+	app.Get("/download/:id", func(ctx *fiber.Ctx) error {
+		return UploadFetch(ctx, c, db, shallExpire)
+	})
+	app.Post("/download/:id", func(ctx *fiber.Ctx) error {
+		return UploadFetch(ctx, c, db, shallExpire)
+	})
+
+	var tests = []struct {
+		name     string
+		method   string
+		agent    string
+		accept   string
+		password string
+		status   int
+	}{
+		{"head", "HEAD", "curl/7.88", "*/*", "", fiber.StatusUnauthorized},
+		{"preview-bot", "GET", "Slackbot-LinkExpanding 1.0", "*/*", "", fiber.StatusUnauthorized},
+		{"preview-bot-html", "GET", "Slackbot-LinkExpanding 1.0", "text/html", "", fiber.StatusUnauthorized},
+		{"browser-landing-page", "GET", "Mozilla/5.0", "text/html", "", fiber.StatusUnauthorized},
+		{"browser-wrong-password", "POST", "Mozilla/5.0", "text/html", "wrong", fiber.StatusUnauthorized},
+		{"browser-password", "POST", "Mozilla/5.0", "text/html", "secret", fiber.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/download/"+asapId, strings.NewReader("password="+tt.password))
+			req.Header.Set("Accept", tt.accept)
+			req.Header.Set("User-Agent", tt.agent)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Request failed: " + err.Error())
+			}
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+
+			if tt.password == "secret" {
+				if string(body) != "content" {
+					t.Errorf("got %q, want the file", body)
+				}
+				return
+			}
+
+			for _, secret := range []string{"quarterly-report", "numbers"} {
+				if strings.Contains(string(body), secret) {
+					t.Errorf("response reveals %q:\n%s", secret, body)
+				}
+
+				for header, values := range resp.Header {
+					if strings.Contains(strings.Join(values, " "), secret) {
+						t.Errorf("header %s reveals %q", header, secret)
+					}
+				}
+			}
+
+			if resp.Header.Get("Content-Disposition") != "" {
+				t.Errorf("Content-Disposition sent without password")
+			}
+		})
+	}
+}
+
+func TestDeniedDownloadPage(t *testing.T) {
+	c := &cfg.Config{
+		DbFile:       "deniedtest.db",
+		StorageDir:   t.TempDir(),
+		Downloadpage: loadTemplate(t, "downloadtemplate.html"),
+		Passwordpage: loadTemplate(t, "passwordtemplate.html"),
+	}
+
+	if err := c.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply config defaults: " + err.Error())
+	}
+
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	// test requests come from 0.0.0.0
+	now := common.Timestamp{Time: time.Now()}
+	createUpload(t, c, db, &common.Upload{Id: asapId, File: "quarterly-report.pdf", Type: common.TypeUpload,
+		Expire: "asap", Allow: []string{"10.0.0.0/8"}, Created: now})
+	createUpload(t, c, db, &common.Upload{Id: unlimitedId, File: "quarterly-report.pdf", Type: common.TypeUpload,
+		Expire: "asap", Allow: []string{"10.0.0.0/8"}, Protected: true, Created: now})
+
+	app := fiber.New()
+	app.Get("/download/:id", func(ctx *fiber.Ctx) error {
+		return UploadFetch(ctx, c, db, shallExpire)
+	})
+	app.Post("/download/:id", func(ctx *fiber.Ctx) error {
+		return UploadFetch(ctx, c, db, shallExpire)
+	})
+
+	var tests = []struct {
+		name   string
+		method string
+		agent  string
+		accept string
+	}{
+		{"head", "HEAD", "curl/7.88", "*/*"},
+		{"preview-bot", "GET", "Slackbot-LinkExpanding 1.0", "*/*"},
+		{"browser-landing-page", "GET", "Mozilla/5.0", "text/html"},
+		{"browser-confirm", "POST", "Mozilla/5.0", "text/html"},
+		{"api-client", "GET", "upctl", "*/*"},
+	}
+
+	for _, id := range []string{asapId, unlimitedId} {
+		for _, tt := range tests {
+			t.Run(id+"-"+tt.name, func(t *testing.T) {
+				req := httptest.NewRequest(tt.method, "/download/"+id, strings.NewReader("confirm=1&password=secret"))
+				req.Header.Set("Accept", tt.accept)
+				req.Header.Set("User-Agent", tt.agent)
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+				resp, err := app.Test(req)
+				if err != nil {
+					t.Fatalf("Request failed: " + err.Error())
+				}
+
+				body, _ := ioutil.ReadAll(resp.Body)
+				if resp.StatusCode != fiber.StatusForbidden {
+					t.Errorf("%s: got status %d, want 403", id, resp.StatusCode)
+				}
+
+				if strings.Contains(string(body), "quarterly-report") || resp.Header.Get("Content-Disposition") != "" {
+					t.Errorf("%s: denied client gets details of the upload:\n%s", id, body)
+				}
+			})
+		}
+	}
+}
+
+// client connection which goes away after accepting some bytes
+type brokenConn struct {
+	accept int
+}
+
+func (c *brokenConn) Write(p []byte) (int, error) {
+	if len(p) > c.accept {
+		return 0, io.ErrClosedPipe
+	}
+
+	c.accept -= len(p)
+	return len(p), nil
+}
+
+func TestDeliveryReader(t *testing.T) {
+	size := 2*deliveryChunkSize + 3
+	filename := filepath.Join(t.TempDir(), "t1")
+	if err := ioutil.WriteFile(filename, bytes.Repeat([]byte("x"), size), 0644); err != nil {
+		t.Fatalf("Could not create file: " + err.Error())
+	}
+
+	var tests = []struct {
+		name   string
+		accept int
+		expect int64
+	}{
+		{"complete", size, int64(size)},
+		{"aborted", deliveryChunkSize, deliveryChunkSize},
+		{"gone", 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd, err := os.Open(filename)
+			if err != nil {
+				t.Fatalf("Could not open file: " + err.Error())
+			}
+
+			calls := 0
+			var delivered int64
+			reader := &deliveryReader{file: fd, size: int64(size), done: func(sent, size int64) {
+				calls++
+				delivered = sent
+			}}
+
+			// the way fasthttp writes the body to the connection
+			w := bufio.NewWriterSize(&brokenConn{accept: tt.accept}, 4096)
+			_, err = io.Copy(w, reader)
+			if (err != nil) != (tt.expect < int64(size)) {
+				t.Errorf("got error: %v", err)
+			}
+
+			reader.Close()
+			reader.Close()
+
+			if calls != 1 || delivered != tt.expect {
+				t.Errorf("done called %d times with %d bytes, want once with %d", calls, delivered, tt.expect)
+			}
+		})
+	}
+}
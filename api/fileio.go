@@ -28,14 +28,30 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
+/*
+   Uploads are  received into a  staging directory below  the storage
+   dir. Only after all files have been written and synced, the upload
+   directory is  renamed into place,  so the storage dir never contains
+   incomplete uploads.
+*/
+const StagingDir string = ".staging"
+
+// leftovers of crashed uploads are removed after this time
+const stagingRetention = 24 * time.Hour
+
+func stagingDir(conf *cfg.Config, id string) string {
+	return filepath.Join(conf.StorageDir, StagingDir, id)
+}
+
 // cleanup an upload directory, either because  we got an error in the
 // middle of an upload or something else  went wrong.
 func cleanup(dir string) {
 	err := os.RemoveAll(dir)
 	if err != nil {
-		Log("Failed to remove dir %s: %s", dir, err.Error())
+		Error("Failed to remove dir %s: %s", dir, err.Error())
 	}
 }
 
@@ -44,12 +60,12 @@ func SaveFormFiles(c *fiber.Ctx, cfg *cfg.Config, files []*multipart.FileHeader,
 	members := []string{}
 	for _, file := range files {
 		filename, _ := common.Untaint(filepath.Base(file.Filename), cfg.RegNormalizedFilename)
-		path := filepath.Join(cfg.StorageDir, id, filename)
+		path := filepath.Join(stagingDir(cfg, id), filename)
 		members = append(members, filename)
-		Log("Received: %s => %s/%s", file.Filename, id, filename)
+		LogFor(c).Debug("Received: %s => %s/%s", file.Filename, id, filename)
 
 		if err := c.SaveFile(file, path); err != nil {
-			cleanup(filepath.Join(cfg.StorageDir, id))
+			cleanup(stagingDir(cfg, id))
 			return nil, err
 		}
 	}
@@ -67,13 +83,13 @@ func ProcessFormFiles(cfg *cfg.Config, members []string, id string) (string, str
 		Filename = members[0]
 	} else {
 		zipfile := Ts() + "data.zip"
-		tmpzip := filepath.Join(cfg.StorageDir, zipfile)
-		finalzip := filepath.Join(cfg.StorageDir, id, zipfile)
-		iddir := filepath.Join(cfg.StorageDir, id)
+		tmpzip := filepath.Join(cfg.StorageDir, StagingDir, id+"-"+zipfile)
+		iddir := stagingDir(cfg, id)
+		finalzip := filepath.Join(iddir, zipfile)
 
 		if err := ZipDir(iddir, tmpzip); err != nil {
 			cleanup(iddir)
-			Log("zip error")
+			Error("Unable to zip %s: %s", iddir, err)
 			return "", "", err
 		}
 
@@ -85,19 +101,83 @@ func ProcessFormFiles(cfg *cfg.Config, members []string, id string) (string, str
 		returnUrl = strings.Join([]string{cfg.Url, "download", id, zipfile}, "/")
 		Filename = zipfile
 
-		// clean up after us
-		go func() {
-			for _, file := range members {
-				if err := os.Remove(filepath.Join(cfg.StorageDir, id, file)); err != nil {
-					Log("ERROR: unable to delete %s: %s", file, err)
-				}
+		// clean up after us, before the directory is committed
+		for _, file := range members {
+			if err := os.Remove(filepath.Join(iddir, file)); err != nil {
+				Error("Unable to delete %s: %s", file, err)
 			}
-		}()
+		}
 	}
 
 	return returnUrl, Filename, nil
 }
 
+// flush a file or directory to disk
+func syncPath(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	return fd.Sync()
+}
+
+/*
+   Move  a  staged  upload  into   the  storage  dir.   The  files  are
+   synced  before the rename  and  the storage  dir  after it, so the
+   upload survives a crash once this function returned.
+*/
+func CommitFiles(cfg *cfg.Config, id string) error {
+	staged := stagingDir(cfg, id)
+
+	entries, err := os.ReadDir(staged)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := syncPath(filepath.Join(staged, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	if err := syncPath(staged); err != nil {
+		return err
+	}
+
+	if err := os.Rename(staged, filepath.Join(cfg.StorageDir, id)); err != nil {
+		return err
+	}
+
+	return syncPath(cfg.StorageDir)
+}
+
+// remove leftovers of uploads which have never been committed
+func DeleteStaleStaging(conf *cfg.Config) error {
+	entries, err := os.ReadDir(filepath.Join(conf.StorageDir, StagingDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue // removed in the meantime
+		}
+
+		if time.Since(info.ModTime()) > stagingRetention {
+			Info("Removing stale staging entry %s", entry.Name())
+			cleanup(filepath.Join(conf.StorageDir, StagingDir, entry.Name()))
+		}
+	}
+
+	return nil
+}
+
 // Create a zip archive from a directory
 // FIXME: -e option, if any, goes here
 func ZipDir(directory, zipfilename string) error {
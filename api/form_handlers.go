@@ -32,12 +32,15 @@ import (
 
 /*
    Validate a fied by untainting it, modifies field value inplace.
+
+   Returns a fiber error which is turned into a JSON response by the
+   error handler, so handlers just return it.
 */
 func untaintField(c *fiber.Ctx, orig *string, r *regexp.Regexp, caption string) error {
 	if len(*orig) != 0 {
 		nt, err := common.Untaint(*orig, r)
 		if err != nil {
-			return JsonStatus(c, fiber.StatusForbidden,
+			return fiber.NewError(fiber.StatusForbidden,
 				"Invalid "+caption+": "+err.Error())
 		}
 		*orig = nt
@@ -46,20 +49,36 @@ func untaintField(c *fiber.Ctx, orig *string, r *regexp.Regexp, caption string)
 	return nil
 }
 
+/*
+   Validate an expire setting: asap, a duration or an RFC3339 date in
+   the future, see common.ValidateExpire().
+*/
+func untaintExpire(c *fiber.Ctx, cfg *cfg.Config, orig *string) error {
+	if err := untaintField(c, orig, cfg.RegDuration, "expire data"); err != nil {
+		return err
+	}
+
+	if len(*orig) != 0 {
+		if err := common.ValidateExpire(*orig); err != nil {
+			return fiber.NewError(fiber.StatusForbidden,
+				"Invalid expire data: "+err.Error())
+		}
+	}
+
+	return nil
+}
+
 func FormCreate(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 	id := uuid.NewString()
 
 	var formdata common.Form
+	var err error
 
 	// init form obj
 	entry := &common.Form{Id: id, Created: common.Timestamp{Time: time.Now()}, Type: common.TypeForm}
 
-	// retrieve the API Context name from the session
-	apicontext, err := SessionGetApicontext(c)
-	if err != nil {
-		return JsonStatus(c, fiber.StatusInternalServerError,
-			"Unable to initialize session store from context: "+err.Error())
-	}
+	// the API Context the request has been authenticated for
+	apicontext := GetPrincipal(c).Context
 	entry.Context = apicontext
 
 	// extract auxiliary form data (expire field et al)
@@ -72,36 +91,60 @@ func FormCreate(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 	if len(formdata.Expire) == 0 {
 		entry.Expire = "asap"
 	} else {
-		if err := untaintField(c, &formdata.Expire, cfg.RegDuration, "expire data"); err != nil {
+		if err := untaintExpire(c, cfg, &formdata.Expire); err != nil {
 			return err
 		}
 		entry.Expire = formdata.Expire
 	}
+	entry.ExpiresAt = common.Timestamp{Time: ExpiresAt(cfg, entry.Created.Time, entry.Expire)}
 
-	if err := untaintField(c, &formdata.Notify, cfg.RegDuration, "email address"); err != nil {
+	if err := untaintField(c, &formdata.Notify, cfg.RegEmail, "email address"); err != nil {
 		return err
 	}
 	entry.Notify = formdata.Notify
 
-	if err := untaintField(c, &formdata.Description, cfg.RegDuration, "description"); err != nil {
+	if err := untaintField(c, &formdata.Description, cfg.RegText, "description"); err != nil {
 		return err
 	}
 	entry.Description = formdata.Description
 
+	entry.Allow, err = untaintAllow(cfg, formdata.Allow, apicontext)
+	if err != nil {
+		return err
+	}
+
+	// human friendly id, if configured for the api context
+	entry.ShortId, err = db.AllocateShortId(cfg.ContextIdStyle(apicontext), id)
+	if err != nil {
+		return JsonStatus(c, fiber.StatusInternalServerError,
+			"Unable to allocate short id: "+err.Error())
+	}
+
 	// get url [and zip if there are multiple files]
-	returnUrl := strings.Join([]string{cfg.Url, "form", id}, "/")
+	urlid := id
+	if entry.ShortId != "" {
+		urlid = entry.ShortId
+	}
+
+	returnUrl := strings.Join([]string{cfg.Url, "form", urlid}, "/")
 	entry.Url = returnUrl
 
-	Log("Now serving %s", returnUrl)
-	Log("Expire set to: %s", entry.Expire)
-	Log("Form created with API-Context %s", entry.Context)
+	log := LogFor(c)
+	log.Debug("Now serving %s", returnUrl)
+	log.Debug("Expire set to: %s", entry.Expire)
+	log.Debug("Form created with API-Context %s", entry.Context)
 
-	// we do this in the background to not thwart the server
-	go func() {
-		if err := db.Insert(id, entry); err != nil {
-			Log("Failed to insert: " + err.Error())
-		}
-	}()
+	// store the form before we respond, the url must work right away
+	if err := db.Insert(id, entry); err != nil {
+		db.ReleaseShortId(entry.ShortId)
+		return JsonStatus(c, fiber.StatusInternalServerError,
+			"Unable to store form: "+err.Error())
+	}
+
+	Audit(c, db, AuditCreate, AuditForm, id, apicontext, "expire: "+entry.Expire)
+
+	// the secret to upload using the form, returned, but never stored
+	entry.Token = FormToken(cfg, id)
 
 	// everything went well so far
 	res := &common.Response{Forms: []*common.Form{entry}}
@@ -112,7 +155,7 @@ func FormCreate(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 
 // delete form
 func FormDelete(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
-	id, err := common.Untaint(c.Params("id"), cfg.RegKey)
+	id, err := ParamId(c, cfg, db)
 	if err != nil {
 		return JsonStatus(c, fiber.StatusForbidden,
 			"Invalid id provided!")
@@ -123,20 +166,22 @@ func FormDelete(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 			"No id specified!")
 	}
 
-	// retrieve the API Context name from the session
-	apicontext, err := SessionGetApicontext(c)
-	if err != nil {
-		return JsonStatus(c, fiber.StatusInternalServerError,
-			"Unable to initialize session store from context: "+err.Error())
-	}
+	// the API Context the request has been authenticated for
+	apicontext := GetPrincipal(c).Context
 
 	err = db.Delete(apicontext, id)
+	if err == ErrForbidden {
+		return scopeDenied(c, db, GetPrincipal(c))
+	}
+
 	if err != nil {
 		// non existent db entry with that id, or other db error, see logs
 		return JsonStatus(c, fiber.StatusForbidden,
 			"No form with that id could be found!")
 	}
 
+	Audit(c, db, AuditDelete, AuditForm, id, apicontext, "")
+
 	return nil
 }
 
@@ -149,7 +194,7 @@ func FormsList(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 			"Unable to parse body: "+err.Error())
 	}
 
-	filter, err := common.Untaint(setcontext.Apicontext, cfg.RegKey)
+	filter, err := untaintContextFilter(cfg, setcontext.Apicontext)
 	if err != nil {
 		return JsonStatus(c, fiber.StatusForbidden,
 			"Invalid api context filter provided!")
@@ -161,15 +206,15 @@ func FormsList(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 			"Invalid query provided!")
 	}
 
-	// retrieve the API Context name from the session
-	apicontext, err := SessionGetApicontext(c)
-	if err != nil {
-		return JsonStatus(c, fiber.StatusInternalServerError,
-			"Unable to initialize session store from context: "+err.Error())
-	}
+	// the API Context the request has been authenticated for
+	apicontext := GetPrincipal(c).Context
 
 	// get list
 	response, err := db.List(apicontext, filter, query, common.TypeForm)
+	if err == ErrForbidden {
+		return scopeDenied(c, db, GetPrincipal(c))
+	}
+
 	if err != nil {
 		return JsonStatus(c, fiber.StatusForbidden,
 			"Unable to list forms: "+err.Error())
@@ -184,18 +229,14 @@ func FormsList(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 
 // returns just one form obj + error code
 func FormDescribe(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
-	id, err := common.Untaint(c.Params("id"), cfg.RegKey)
+	id, err := ParamId(c, cfg, db)
 	if err != nil {
 		return JsonStatus(c, fiber.StatusForbidden,
 			"Invalid id provided!")
 	}
 
-	// retrieve the API Context name from the session
-	apicontext, err := SessionGetApicontext(c)
-	if err != nil {
-		return JsonStatus(c, fiber.StatusInternalServerError,
-			"Unable to initialize session store from context: "+err.Error())
-	}
+	// the API Context the request has been authenticated for
+	apicontext := GetPrincipal(c).Context
 
 	response, err := db.Get(apicontext, id, common.TypeForm)
 	if err != nil || len(response.Forms) == 0 {
@@ -221,16 +262,13 @@ func FormDescribe(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
    given id.
 */
 func FormPage(c *fiber.Ctx, cfg *cfg.Config, db *Db, shallexpire bool) error {
-	id, err := common.Untaint(c.Params("id"), cfg.RegKey)
+	id, err := ParamId(c, cfg, db)
 	if err != nil {
 		return c.Status(fiber.StatusForbidden).SendString("Invalid id provided!")
 	}
 
-	apicontext, err := SessionGetApicontext(c)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).
-			SendString("Unable to initialize session store from context:" + err.Error())
-	}
+	// the API Context the request has been authenticated for
+	apicontext := GetPrincipal(c).Context
 
 	response, err := db.Get(apicontext, id, common.TypeForm)
 	if err != nil || len(response.Forms) == 0 {
@@ -238,6 +276,10 @@ func FormPage(c *fiber.Ctx, cfg *cfg.Config, db *Db, shallexpire bool) error {
 			SendString("No form with that id could be found!")
 	}
 
+	if !ClientAllowed(c, cfg, response.Forms[0].Allow) {
+		return denyClient(c, db, AuditForm, id, response.Forms[0].Context)
+	}
+
 	t := template.New("form")
 	if t, err = t.Parse(cfg.Formpage); err != nil {
 		return c.Status(fiber.StatusInternalServerError).
@@ -248,6 +290,9 @@ func FormPage(c *fiber.Ctx, cfg *cfg.Config, db *Db, shallexpire bool) error {
 	uploadurl := strings.Join([]string{cfg.ApiPrefix + ApiVersion, "uploads"}, "/")
 	response.Forms[0].Url = uploadurl
 
+	// the page uploads using the form token, not the public id
+	response.Forms[0].Token = FormToken(cfg, response.Forms[0].Id)
+
 	var out bytes.Buffer
 	if err := t.Execute(&out, response.Forms[0]); err != nil {
 		return c.Status(fiber.StatusInternalServerError).
@@ -261,14 +306,10 @@ func FormPage(c *fiber.Ctx, cfg *cfg.Config, db *Db, shallexpire bool) error {
 func FormModify(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 	var formdata common.Form
 
-	// retrieve the API Context name from the session
-	apicontext, err := SessionGetApicontext(c)
-	if err != nil {
-		return JsonStatus(c, fiber.StatusInternalServerError,
-			"Unable to initialize session store from context: "+err.Error())
-	}
+	// the API Context the request has been authenticated for
+	apicontext := GetPrincipal(c).Context
 
-	id, err := common.Untaint(c.Params("id"), cfg.RegKey)
+	id, err := ParamId(c, cfg, db)
 	if err != nil {
 		return JsonStatus(c, fiber.StatusForbidden,
 			"Invalid id provided!")
@@ -281,18 +322,24 @@ func FormModify(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 	}
 
 	// post process input data
-	if err := untaintField(c, &formdata.Expire, cfg.RegDuration, "expire data"); err != nil {
+	if err := untaintExpire(c, cfg, &formdata.Expire); err != nil {
 		return err
 	}
 
-	if err := untaintField(c, &formdata.Notify, cfg.RegDuration, "email address"); err != nil {
+	if err := untaintField(c, &formdata.Notify, cfg.RegEmail, "email address"); err != nil {
 		return err
 	}
 
-	if err := untaintField(c, &formdata.Description, cfg.RegDuration, "description"); err != nil {
+	if err := untaintField(c, &formdata.Description, cfg.RegText, "description"); err != nil {
 		return err
 	}
 
+	allow, err := common.NormalizeAllowlist(formdata.Allow)
+	if err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Invalid allow list: "+err.Error())
+	}
+
 	// lookup orig entry
 	response, err := db.Get(apicontext, id, common.TypeForm)
 	if err != nil || len(response.Forms) == 0 {
@@ -315,12 +362,24 @@ func FormModify(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 		form.Description = formdata.Description
 	}
 
+	// an allowlist of "any" removes the restriction
+	switch {
+	case len(allow) > 0:
+		form.Allow = allow
+	case len(formdata.Allow) > 0:
+		form.Allow = nil
+	}
+
+	form.ExpiresAt = common.Timestamp{Time: ExpiresAt(cfg, form.Created.Time, form.Expire)}
+
 	// run in foreground because we need the feedback here
 	if err := db.Insert(id, form); err != nil {
 		return JsonStatus(c, fiber.StatusForbidden,
 			"Failed to insert: "+err.Error())
 	}
 
+	Audit(c, db, AuditModify, AuditForm, id, apicontext, "")
+
 	res := &common.Response{Forms: []*common.Form{form}}
 	res.Success = true
 	res.Code = fiber.StatusOK
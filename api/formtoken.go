@@ -0,0 +1,57 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/tlinden/ephemerup/cfg"
+)
+
+var ErrFormToken = errors.New("not a valid form token")
+
+/*
+   The  secret used by  upload forms to  authenticate. It is  derived
+   from the  form  id using  the link  signing key,  so  it is  never
+   stored, but knowing the (public) form id is not sufficient to upload.
+
+   Token format: <form id>.<signature>
+*/
+func FormToken(conf *cfg.Config, id string) string {
+	return id + "." + base64.RawURLEncoding.EncodeToString(linkSignature(conf, "form:"+id))
+}
+
+// verify a form token, returns the form id
+func ParseFormToken(conf *cfg.Config, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !regUUID.MatchString(parts[0]) {
+		return "", ErrFormToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrFormToken
+	}
+
+	if !validSignature(conf, "form:"+parts[0], signature) {
+		return "", ErrFormToken
+	}
+
+	return parts[0], nil
+}
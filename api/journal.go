@@ -0,0 +1,245 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+// uploads in progress, removed once the upload has been stored
+const JournalBucket string = "journal"
+
+// journal states
+const (
+	JournalStaging = "staging" // receiving files, rolled back on recovery
+	JournalCommit  = "commit"  // files complete, replayed on recovery
+)
+
+/*
+   A journal entry  of an upload  in progress. In the  commit state it
+   contains everything needed to finish the upload, including the
+   password hash.
+*/
+type JournalEntry struct {
+	Id      string           `json:"id"`
+	State   string           `json:"state"`
+	Started common.Timestamp `json:"started"`
+	Upload  *common.Upload   `json:"upload,omitempty"`
+	Hash    string           `json:"hash,omitempty"`
+}
+
+func (db *Db) journalPut(entry *JournalEntry) error {
+	err := db.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(JournalBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+
+		jsonentry, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("json marshalling failure: %s", err)
+		}
+
+		return bucket.Put([]byte(entry.Id), jsonentry)
+	})
+
+	if err != nil {
+		Error("DB error: %s", err.Error())
+	}
+
+	return err
+}
+
+// record the start of an upload, before anything is written to disk
+func (db *Db) JournalBegin(id string) error {
+	return db.journalPut(&JournalEntry{
+		Id:      id,
+		State:   JournalStaging,
+		Started: common.Timestamp{Time: time.Now()},
+	})
+}
+
+// record a complete upload, right before its files are moved into place
+func (db *Db) JournalCommit(upload *common.Upload, hash string) error {
+	return db.journalPut(&JournalEntry{
+		Id:      upload.Id,
+		State:   JournalCommit,
+		Started: upload.Created,
+		Upload:  upload,
+		Hash:    hash,
+	})
+}
+
+// remove a journal entry within an already running transaction
+func journalDelete(tx *bolt.Tx, id string) error {
+	bucket := tx.Bucket([]byte(JournalBucket))
+	if bucket == nil {
+		return nil
+	}
+
+	return bucket.Delete([]byte(id))
+}
+
+// forget an upload which has been rolled back
+func (db *Db) JournalDone(id string) {
+	err := db.update(func(tx *bolt.Tx) error {
+		return journalDelete(tx, id)
+	})
+
+	if err != nil {
+		Error("Failed to remove journal entry of %s: %s", id, err.Error())
+	}
+}
+
+func (db *Db) journalList() ([]*JournalEntry, error) {
+	entries := []*JournalEntry{}
+
+	err := db.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(JournalBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(id, j []byte) error {
+			entry := &JournalEntry{}
+			if err := json.Unmarshal(j, entry); err != nil {
+				return fmt.Errorf("unable to unmarshal json: %s", err)
+			}
+
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+// remove all short ids pointing to an upload which has never been stored
+func (db *Db) releaseShortIdsOf(id string) error {
+	return db.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(ShortIdBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		keys := [][]byte{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			if string(v) == id {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// remove everything an interrupted upload left behind
+func rollbackUpload(conf *cfg.Config, db *Db, id string) error {
+	cleanup(stagingDir(conf, id))
+	cleanup(filepath.Join(conf.StorageDir, id))
+
+	// temporary zip files of ProcessFormFiles()
+	zips, _ := filepath.Glob(filepath.Join(conf.StorageDir, StagingDir, id+"-*"))
+	for _, zip := range zips {
+		cleanup(zip)
+	}
+
+	if err := db.releaseShortIdsOf(id); err != nil {
+		return err
+	}
+
+	db.JournalDone(id)
+
+	return nil
+}
+
+/*
+   Finish an upload  which crashed during commit.  The files are either
+   still in the staging dir or already in place, the metadata is part
+   of the journal entry.
+*/
+func replayUpload(conf *cfg.Config, db *Db, entry *JournalEntry) error {
+	if _, err := os.Stat(stagingDir(conf, entry.Id)); err == nil {
+		if err := CommitFiles(conf, entry.Id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(conf.StorageDir, entry.Id, entry.Upload.File)); err != nil {
+		return fmt.Errorf("file of upload %s is gone: %s", entry.Id, err)
+	}
+
+	return db.InsertUpload(entry.Upload, entry.Hash)
+}
+
+/*
+   Called at startup, before  we accept traffic: uploads which have been
+   interrupted while receiving files are rolled back, uploads which have
+   been interrupted during commit are finished.
+*/
+func RecoverUploads(conf *cfg.Config, db *Db) error {
+	entries, err := db.journalList()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.State == JournalCommit && entry.Upload != nil {
+			err := replayUpload(conf, db, entry)
+			if err == nil {
+				Info("Recovered interrupted upload %s", entry.Id)
+				auditInsert(db, &common.AuditEntry{
+					Action:  AuditCreate,
+					Object:  AuditUpload,
+					Target:  entry.Id,
+					Context: entry.Upload.Context,
+					Message: "recovered after restart",
+				})
+				continue
+			}
+
+			Warn("Unable to recover upload %s, rolling back: %s", entry.Id, err.Error())
+		}
+
+		if err := rollbackUpload(conf, db, entry.Id); err != nil {
+			return err
+		}
+
+		Warn("Rolled back interrupted upload %s started at %s",
+			entry.Id, entry.Started.Format(time.RFC3339))
+	}
+
+	return nil
+}
@@ -0,0 +1,465 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+)
+
+// clock skew tolerated when checking exp and nbf
+const jwtLeeway = 60 * time.Second
+
+// how often the JWKS is fetched again at most, and at least
+const (
+	jwksMinRefresh = time.Minute
+	jwksMaxAge     = time.Hour
+)
+
+var (
+	ErrJwtInvalid   = errors.New("invalid jwt")
+	ErrJwtSignature = errors.New("invalid jwt signature")
+	ErrJwtExpired   = errors.New("jwt expired")
+	ErrJwtClaims    = errors.New("jwt claims rejected")
+)
+
+// the signing keys of the identity provider, by key id
+var jwks = struct {
+	sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}{keys: map[string]crypto.PublicKey{}}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// a json web key, RFC 7517, only the public key fields we support
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// true if the bearer token looks like a jwt: three base64url parts, json header
+func looksLikeJwt(token string) bool {
+	return strings.Count(token, ".") == 2 && strings.HasPrefix(token, "eyJ")
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(raw) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// turn a json web key into a public key, other key types are ignored
+func (key *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := decodeBigInt(key.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBigInt(key.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid rsa exponent")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve " + key.Crv)
+		}
+
+		x, err := decodeBigInt(key.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeBigInt(key.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid ec point")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, errors.New("unsupported key type " + key.Kty)
+}
+
+// read the JWKS from a file or url
+func fetchJwks(source string) (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var err error
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := &http.Client{Timeout: 10 * time.Second}
+
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: %s", source, resp.Status)
+		}
+
+		if data, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else if data, err = ioutil.ReadFile(source); err != nil {
+		return nil, err
+	}
+
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid jwks: %s", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		pub, err := key.publicKey()
+		if err != nil {
+			Warn("Ignoring jwks key %s: %s", key.Kid, err)
+			continue
+		}
+
+		keys[key.Kid] = pub
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("jwks doesn't contain any usable keys")
+	}
+
+	return keys, nil
+}
+
+/*
+   (Re-)load the JWKS.  Called at startup  and whenever a  jwt uses an
+   unknown key id, but not more often than jwksMinRefresh.
+*/
+func LoadJwks(conf *cfg.Config) error {
+	keys, err := fetchJwks(conf.Jwks)
+
+	jwks.Lock()
+	defer jwks.Unlock()
+
+	jwks.fetched = time.Now()
+	if err != nil {
+		return err
+	}
+
+	jwks.keys = keys
+
+	return nil
+}
+
+// the key a jwt has been signed with
+func jwtKey(conf *cfg.Config, kid string) (crypto.PublicKey, error) {
+	lookup := func() (crypto.PublicKey, bool, time.Time) {
+		jwks.Lock()
+		defer jwks.Unlock()
+
+		if key, ok := jwks.keys[kid]; ok {
+			return key, true, jwks.fetched
+		}
+
+		// tokens without a key id are fine if there's only one key
+		if kid == "" && len(jwks.keys) == 1 {
+			for _, key := range jwks.keys {
+				return key, true, jwks.fetched
+			}
+		}
+
+		return nil, false, jwks.fetched
+	}
+
+	key, found, fetched := lookup()
+	if (!found && time.Since(fetched) > jwksMinRefresh) || time.Since(fetched) > jwksMaxAge {
+		if err := LoadJwks(conf); err != nil {
+			Warn("Unable to load jwks from %s: %s", conf.Jwks, err)
+		}
+		key, found, _ = lookup()
+	}
+
+	if !found {
+		return nil, fmt.Errorf("%w: unknown key id %q", ErrJwtSignature, kid)
+	}
+
+	return key, nil
+}
+
+// check the signature of a jwt, RS*, PS* and ES* algorithms are supported
+func verifyJwtSignature(alg string, key crypto.PublicKey, input, signature []byte) error {
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return ErrJwtSignature
+	}
+
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		sum := sha256.Sum256(input)
+		digest = sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384(input)
+		digest = sum[:]
+	default:
+		sum := sha512.Sum512(input)
+		digest = sum[:]
+	}
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			if rsa.VerifyPKCS1v15(pub, hash, digest, signature) == nil {
+				return nil
+			}
+		case "PS":
+			if rsa.VerifyPSS(pub, hash, digest, signature, nil) == nil {
+				return nil
+			}
+		}
+	case *ecdsa.PublicKey:
+		// the curve has to match the algorithm, signatures are r || s
+		bits := map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}[alg]
+		size := (bits + 7) / 8
+		if bits != 0 && pub.Curve.Params().BitSize == bits && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(pub, digest, r, s) {
+				return nil
+			}
+		}
+	}
+
+	return ErrJwtSignature
+}
+
+// verify a jwt and return its claims
+func ParseJwt(conf *cfg.Config, token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrJwtInvalid
+	}
+
+	rawheader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrJwtInvalid
+	}
+
+	header := jwtHeader{}
+	if err := json.Unmarshal(rawheader, &header); err != nil || len(header.Alg) != 5 {
+		// catches "none" and friends as well
+		return nil, ErrJwtInvalid
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrJwtInvalid
+	}
+
+	key, err := jwtKey(conf, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyJwtSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	rawclaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrJwtInvalid
+	}
+
+	claims := map[string]any{}
+	if err := json.Unmarshal(rawclaims, &claims); err != nil {
+		return nil, ErrJwtInvalid
+	}
+
+	now := time.Now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("%w: exp missing", ErrJwtClaims)
+	}
+
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, ErrJwtExpired
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("%w: not valid yet", ErrJwtClaims)
+	}
+
+	if conf.JwtIssuer != "" && claims["iss"] != conf.JwtIssuer {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrJwtClaims)
+	}
+
+	if conf.JwtAudience != "" && !containsClaim(claims["aud"], conf.JwtAudience) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrJwtClaims)
+	}
+
+	return claims, nil
+}
+
+// string values of a claim, which may be a string or an array of strings
+func claimValues(claim any) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		values := []string{}
+		for _, entry := range value {
+			if str, ok := entry.(string); ok {
+				values = append(values, str)
+			}
+		}
+		return values
+	}
+
+	return nil
+}
+
+func containsClaim(claim any, wanted string) bool {
+	for _, value := range claimValues(claim) {
+		if value == wanted {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+   Validator hook for jwt bearer tokens. The api context is taken from
+   the claim  JwtContextClaim, the  first configured  context in there
+   wins. The optional  role claim  can only  restrict the permissions
+   of the context, never extend them.
+*/
+func AuthValidateJwt(c *fiber.Ctx, conf *cfg.Config, token string) (bool, error) {
+	claims, err := ParseJwt(conf, token)
+	if err != nil {
+		return false, err
+	}
+
+	apicontext := ""
+	for _, value := range claimValues(claims[conf.JwtContextClaim]) {
+		if len(conf.Contexts()) > 0 && conf.ContextRole(value) != "" {
+			apicontext = value
+			break
+		}
+	}
+
+	if apicontext == "" {
+		return false, fmt.Errorf("%w: no known api context in claim %s", ErrJwtClaims, conf.JwtContextClaim)
+	}
+
+	if !ClientAllowed(c, conf, conf.ContextAllow(apicontext)) {
+		return false, errDenied
+	}
+
+	scopes := RoleScopes(conf, apicontext)
+
+	if roles, ok := claims[conf.JwtRoleClaim]; ok && conf.JwtRoleClaim != "" {
+		granted := []string{}
+		for _, scope := range scopes {
+			for _, role := range claimValues(roles) {
+				if containsScope(scopesOf(role, IsSuper(conf, apicontext)), scope) {
+					granted = append(granted, scope)
+					break
+				}
+			}
+		}
+
+		if len(granted) == 0 {
+			return false, fmt.Errorf("%w: no usable role in claim %s", ErrJwtClaims, conf.JwtRoleClaim)
+		}
+
+		scopes = granted
+	}
+
+	SetPrincipal(c, &Principal{Context: apicontext, Scopes: scopes})
+
+	return true, nil
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, entry := range scopes {
+		if entry == scope {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,238 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/keyauth/v2"
+	"github.com/tlinden/ephemerup/cfg"
+)
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// create a signed jwt using a locally generated key
+func signJwt(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	var err error
+
+	switch priv := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, priv, digest[:])
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	if err != nil {
+		t.Fatalf("Could not sign jwt: " + err.Error())
+	}
+
+	return input + "." + b64(signature)
+}
+
+func TestJwt(t *testing.T) {
+	rsakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate rsa key: " + err.Error())
+	}
+
+	eckey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate ec key: " + err.Error())
+	}
+
+	otherkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate rsa key: " + err.Error())
+	}
+
+	set, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsakey.N.Bytes()),
+			"e": b64(big.NewInt(int64(rsakey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256",
+			"x": b64(eckey.X.FillBytes(make([]byte, 32))), "y": b64(eckey.Y.FillBytes(make([]byte, 32)))},
+	}})
+
+	jwksfile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(jwksfile, set, 0644); err != nil {
+		t.Fatalf("Could not write jwks: " + err.Error())
+	}
+
+	c := &cfg.Config{
+		DbFile:       "jwttest.db",
+		Jwks:         jwksfile,
+		JwtIssuer:    "https://idp.example.com",
+		JwtAudience:  "ephemerup",
+		JwtRoleClaim: "roles",
+		Apicontexts: []cfg.Apicontext{
+			{Context: "staff", Key: "staffkey"},
+			{Context: "guests", Key: "guestkey", Role: cfg.RoleReadOnly},
+		},
+	}
+
+	if err := c.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply config defaults: " + err.Error())
+	}
+
+	if err := LoadJwks(c); err != nil {
+		t.Fatalf("Could not load jwks: " + err.Error())
+	}
+
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	app := fiber.New()
+	auth := keyauth.New(keyauth.Config{
+		Validator: func(ctx *fiber.Ctx, key string) (bool, error) {
+			return AuthValidateJwt(ctx, c, key)
+		},
+		ErrorHandler: AuthErrHandler,
+	})
+
+	app.Get("/uploads", auth, RequireScope(db, ScopeList), func(ctx *fiber.Ctx) error {
+		return ctx.SendString(GetPrincipal(ctx).Context)
+	})
+	app.Post("/uploads", auth, RequireScope(db, ScopeUpload), func(ctx *fiber.Ctx) error {
+		return ctx.SendString(GetPrincipal(ctx).Context)
+	})
+
+	claims := func(changes map[string]any) map[string]any {
+		claims := map[string]any{
+			"iss":        "https://idp.example.com",
+			"aud":        []string{"ephemerup", "other"},
+			"sub":        "alice",
+			"exp":        time.Now().Add(time.Hour).Unix(),
+			"apicontext": "staff",
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+
+	tampered := signJwt(t, "RS256", "rsa", rsakey, claims(nil))
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+
+	var tests = []struct {
+		name   string
+		method string
+		token  string
+		status int
+		expect string
+	}{
+		{"rs256", "GET", signJwt(t, "RS256", "rsa", rsakey, claims(nil)), fiber.StatusOK, "staff"},
+		{"es256", "GET", signJwt(t, "ES256", "ec", eckey, claims(nil)), fiber.StatusOK, "staff"},
+		{"context-list", "GET", signJwt(t, "RS256", "rsa", rsakey,
+			claims(map[string]any{"apicontext": []string{"unknown", "guests"}})), fiber.StatusOK, "guests"},
+		{"context-role", "POST", signJwt(t, "RS256", "rsa", rsakey,
+			claims(map[string]any{"apicontext": "guests"})), fiber.StatusForbidden, ""},
+		{"role-restricts", "POST", signJwt(t, "RS256", "rsa", rsakey,
+			claims(map[string]any{"roles": []string{"read-only"}})), fiber.StatusForbidden, ""},
+		{"role-allows", "POST", signJwt(t, "RS256", "rsa", rsakey,
+			claims(map[string]any{"roles": "upload-only"})), fiber.StatusOK, "staff"},
+		{"role-unknown", "GET", signJwt(t, "RS256", "rsa", rsakey,
+			claims(map[string]any{"roles": "superuser"})), fiber.StatusForbidden, ""},
+		{"expired", "GET", signJwt(t, "RS256", "rsa", rsakey,
+			claims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()})), fiber.StatusForbidden, ""},
+		{"no-exp", "GET", signJwt(t, "RS256", "rsa", rsakey,
+			claims(map[string]any{"exp": nil})), fiber.StatusForbidden, ""},
+		{"not-yet-valid", "GET", signJwt(t, "RS256", "rsa", rsakey,
+			claims(map[string]any{"nbf": time.Now().Add(time.Hour).Unix()})), fiber.StatusForbidden, ""},
+		{"wrong-issuer", "GET", signJwt(t, "RS256", "rsa", rsakey,
+			claims(map[string]any{"iss": "https://evil.example.com"})), fiber.StatusForbidden, ""},
+		{"wrong-audience", "GET", signJwt(t, "RS256", "rsa", rsakey,
+			claims(map[string]any{"aud": "other"})), fiber.StatusForbidden, ""},
+		{"unknown-context", "GET", signJwt(t, "RS256", "rsa", rsakey,
+			claims(map[string]any{"apicontext": "nope"})), fiber.StatusForbidden, ""},
+		{"unknown-key", "GET", signJwt(t, "RS256", "rsa", otherkey, claims(nil)), fiber.StatusForbidden, ""},
+		{"unknown-kid", "GET", signJwt(t, "RS256", "other", rsakey, claims(nil)), fiber.StatusForbidden, ""},
+		{"alg-mismatch", "GET", signJwt(t, "ES256", "rsa", rsakey, claims(nil)), fiber.StatusForbidden, ""},
+		{"tampered", "GET", tampered, fiber.StatusForbidden, ""},
+		{"alg-none", "GET", b64([]byte(`{"alg":"none","kid":"rsa"}`)) + "." +
+			b64([]byte(`{"apicontext":"staff"}`)) + ".", fiber.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/uploads", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Request failed: " + err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			if tt.status == fiber.StatusOK && string(body) != tt.expect {
+				t.Errorf("got %q, want %q", body, tt.expect)
+			}
+		})
+	}
+
+	// the jwks can be fetched from an url as well
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(set)
+	}))
+	defer server.Close()
+
+	c.Jwks = server.URL
+	if err := LoadJwks(c); err != nil {
+		t.Fatalf("Could not load jwks from url: " + err.Error())
+	}
+
+	if _, err := ParseJwt(c, signJwt(t, "ES256", "ec", eckey, claims(nil))); err != nil {
+		t.Errorf("Could not verify jwt with jwks from url: " + err.Error())
+	}
+}
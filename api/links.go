@@ -0,0 +1,423 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+// server side settings, e.g. the generated signing key
+const SettingsBucket string = "settings"
+
+// nonces of used single use links, value is the expire time of the link
+const NonceBucket string = "linknonces"
+
+const signingKeyName string = "signingkey"
+
+var (
+	ErrLinkInvalid = errors.New("invalid download link")
+	ErrLinkExpired = errors.New("download link expired")
+	ErrLinkUsed    = errors.New("download link already used")
+)
+
+// incoming link request, all fields are optional
+type LinkRequest struct {
+	Validity  string `json:"validity" form:"validity"` // duration, default: cfg.LinkValidity
+	SingleUse bool   `json:"singleuse" form:"singleuse"`
+}
+
+/*
+   The signed part of a download link. It references the upload, the
+   link generation of the upload at the time of signing (incremented
+   to revoke all links) and, for single use links, a random nonce.
+*/
+type LinkClaims struct {
+	Id         string
+	Expires    time.Time
+	Generation int
+	Nonce      string
+}
+
+/*
+   Load the key used to sign download links. If none is configured, a
+   random key is generated once and stored in the database, so links
+   survive restarts.  The previous  key, if configured, is only  used
+   to verify links and form tokens signed before a key rotation.
+*/
+func SetupSigningKey(conf *cfg.Config, db *Db) error {
+	conf.PreviousSecret = nil
+	if conf.PreviousSigningKey != "" {
+		conf.PreviousSecret = []byte(conf.PreviousSigningKey)
+	}
+
+	if conf.SigningKey != "" {
+		conf.SigningSecret = []byte(conf.SigningKey)
+		return nil
+	}
+
+	return db.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(SettingsBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+
+		if key := bucket.Get([]byte(signingKeyName)); key != nil {
+			conf.SigningSecret = append([]byte{}, key...)
+			return nil
+		}
+
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+
+		conf.SigningSecret = key
+
+		return bucket.Put([]byte(signingKeyName), key)
+	})
+}
+
+func linkSignature(conf *cfg.Config, payload string) []byte {
+	mac := hmac.New(sha256.New, conf.SigningSecret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// check a signature against the current and the previous signing key
+func validSignature(conf *cfg.Config, payload string, signature []byte) bool {
+	if hmac.Equal(signature, linkSignature(conf, payload)) {
+		return true
+	}
+
+	if conf.PreviousSecret == nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, conf.PreviousSecret)
+	mac.Write([]byte(payload))
+
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+/*
+   Create a signed download link of an upload. The link expires after
+   validity, but never after the upload itself.
+
+   Link format: <cfg.Url>/link/<payload>.<signature>/<file>
+
+   The  payload  contains  id,  expire  time,  link  generation  and
+   nonce, separated by dots, base64 encoded.
+*/
+func SignLink(conf *cfg.Config, upload *common.Upload, validity time.Duration, singleuse bool) (*common.Link, error) {
+	expires := time.Now().Add(validity)
+
+	if !upload.ExpiresAt.IsZero() && upload.ExpiresAt.Before(expires) {
+		expires = upload.ExpiresAt.Time
+	}
+
+	nonce := ""
+	if singleuse {
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		nonce = hex.EncodeToString(random)
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(strings.Join([]string{
+		upload.Id,
+		strconv.FormatInt(expires.Unix(), 10),
+		strconv.Itoa(upload.LinkGeneration),
+		nonce,
+	}, ".")))
+
+	token := payload + "." + base64.RawURLEncoding.EncodeToString(linkSignature(conf, payload))
+
+	return &common.Link{
+		Id:        upload.Id,
+		Url:       strings.Join([]string{conf.Url, "link", token, upload.File}, "/"),
+		ExpiresAt: common.Timestamp{Time: expires},
+		SingleUse: singleuse,
+	}, nil
+}
+
+/*
+   Verify the signature and expire time of a download link token. The
+   link generation and the  nonce have to be checked by the caller,
+   since they depend on database state.
+*/
+func ParseLink(conf *cfg.Config, token string) (*LinkClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrLinkInvalid
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrLinkInvalid
+	}
+
+	if !validSignature(conf, parts[0], signature) {
+		return nil, ErrLinkInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrLinkInvalid
+	}
+
+	fields := strings.Split(string(payload), ".")
+	if len(fields) != 4 {
+		return nil, ErrLinkInvalid
+	}
+
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, ErrLinkInvalid
+	}
+
+	generation, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, ErrLinkInvalid
+	}
+
+	claims := &LinkClaims{
+		Id:         fields[0],
+		Expires:    time.Unix(expires, 0),
+		Generation: generation,
+		Nonce:      fields[3],
+	}
+
+	if !time.Now().Before(claims.Expires) {
+		return nil, ErrLinkExpired
+	}
+
+	return claims, nil
+}
+
+/*
+   Mark the nonce  of a single use  link as used. Returns  ErrLinkUsed if
+   it has been used before. Done in one transaction, so only one of
+   multiple concurrent requests succeeds.
+*/
+func (db *Db) ClaimNonce(nonce string, expires time.Time) error {
+	return db.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(NonceBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+
+		if bucket.Get([]byte(nonce)) != nil {
+			return ErrLinkUsed
+		}
+
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(expires.Unix()))
+
+		return bucket.Put([]byte(nonce), value)
+	})
+}
+
+// make a single use link usable again after an aborted download
+func (db *Db) ReleaseNonce(nonce string) error {
+	return db.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(NonceBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.Delete([]byte(nonce))
+	})
+}
+
+// remove nonces of links which are expired anyway
+func DeleteExpiredNonces(db *Db) error {
+	now := uint64(time.Now().Unix())
+
+	return db.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(NonceBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		expired := [][]byte{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			if len(v) != 8 || binary.BigEndian.Uint64(v) <= now {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// invalidate all outstanding links of an upload
+func (db *Db) RevokeLinks(id string) (*common.Upload, error) {
+	upload := &common.Upload{}
+
+	err := db.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(Bucket))
+		if bucket == nil {
+			return fmt.Errorf("id %s not found", id)
+		}
+
+		j := bucket.Get([]byte(id))
+		if len(j) == 0 {
+			return fmt.Errorf("id %s not found", id)
+		}
+
+		if err := json.Unmarshal(j, upload); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %s", err)
+		}
+
+		upload.LinkGeneration++
+
+		jsonentry, err := upload.Marshal()
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(id), jsonentry)
+	})
+
+	if err != nil {
+		Error("DB error: %s", err.Error())
+	}
+
+	return upload, err
+}
+
+// the download url of an upload, signed if plain links are disabled
+func DownloadUrl(conf *cfg.Config, upload *common.Upload) string {
+	if conf.SignedOnly {
+		link, err := SignLink(conf, upload, time.Duration(conf.LinkExpire)*time.Second, false)
+		if err != nil {
+			Error("Unable to sign download link of %s: %s", upload.Id, err.Error())
+			return ""
+		}
+
+		return link.Url
+	}
+
+	id := upload.Id
+	if upload.ShortId != "" {
+		id = upload.ShortId
+	}
+
+	return strings.Join([]string{conf.Url, "download", id, upload.File}, "/")
+}
+
+// create a signed download link of an upload
+func LinkCreate(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
+	id, err := ParamId(c, cfg, db)
+	if err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Invalid id provided!")
+	}
+
+	// the API Context the request has been authenticated for
+	apicontext := GetPrincipal(c).Context
+
+	linkdata := new(LinkRequest)
+	if err := c.BodyParser(linkdata); err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Unable to parse body: "+err.Error())
+	}
+
+	validity := cfg.LinkExpire
+	if linkdata.Validity != "" {
+		validity, err = common.Duration2int(linkdata.Validity)
+		if err != nil {
+			return JsonStatus(c, fiber.StatusForbidden,
+				"Invalid validity provided: "+err.Error())
+		}
+	}
+
+	response, err := db.Get(apicontext, id, common.TypeUpload)
+	if err != nil || len(response.Uploads) == 0 {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"No upload with that id could be found!")
+	}
+
+	link, err := SignLink(cfg, response.Uploads[0], time.Duration(validity)*time.Second, linkdata.SingleUse)
+	if err != nil {
+		return JsonStatus(c, fiber.StatusInternalServerError,
+			"Unable to sign link: "+err.Error())
+	}
+
+	Audit(c, db, AuditCreate, AuditLink, id, apicontext,
+		fmt.Sprintf("expires: %s, single use: %t", link.ExpiresAt.Format(time.RFC3339), link.SingleUse))
+
+	res := &common.Response{Links: []*common.Link{link}}
+	res.Success = true
+	res.Code = fiber.StatusOK
+	return c.Status(fiber.StatusOK).JSON(res)
+}
+
+// revoke all signed download links of an upload
+func LinkRevoke(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
+	id, err := ParamId(c, cfg, db)
+	if err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Invalid id provided!")
+	}
+
+	// the API Context the request has been authenticated for
+	apicontext := GetPrincipal(c).Context
+
+	// make sure the upload belongs to the context
+	response, err := db.Get(apicontext, id, common.TypeUpload)
+	if err != nil || len(response.Uploads) == 0 {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"No upload with that id could be found!")
+	}
+
+	if _, err := db.RevokeLinks(id); err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Unable to revoke links: "+err.Error())
+	}
+
+	Audit(c, db, AuditDelete, AuditLink, id, apicontext, "all links revoked")
+
+	return JsonStatus(c, fiber.StatusOK, "All download links of "+id+" have been revoked")
+}
@@ -0,0 +1,177 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+)
+
+// extract the token from a signed link
+func linkToken(link *common.Link) string {
+	return path.Base(path.Dir(link.Url))
+}
+
+func TestSignedLinks(t *testing.T) {
+	c := &cfg.Config{DbFile: "linktest.db", Url: "http://localhost:8080"}
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	if err := SetupSigningKey(c, db); err != nil {
+		t.Fatalf("Could not setup signing key: " + err.Error())
+	}
+
+	// the generated key must be persistent
+	key := c.SigningSecret
+	if err := SetupSigningKey(c, db); err != nil || !bytes.Equal(key, c.SigningSecret) {
+		t.Errorf("Signing key changed after reload")
+	}
+
+	upload := &common.Upload{Id: "1", File: "t1", Type: common.TypeUpload, Context: "foo",
+		Created: common.Timestamp{Time: time.Now()}, Expire: "1d"}
+	if err := db.Insert(upload.Id, upload); err != nil {
+		t.Fatalf("Could not insert upload: " + err.Error())
+	}
+
+	valid, _ := SignLink(c, upload, time.Hour, false)
+	expired, _ := SignLink(c, upload, -time.Hour, false)
+
+	token := linkToken(valid)
+	tampered := strings.Replace(token, token[:4], "AAAA", 1)
+
+	var tests = []struct {
+		name   string
+		token  string
+		expect error
+	}{
+		{"valid", token, nil},
+		{"expired", linkToken(expired), ErrLinkExpired},
+		{"tampered", tampered, ErrLinkInvalid},
+		{"garbage", "foo.bar", ErrLinkInvalid},
+		{"plain-id", "1", ErrLinkInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := ParseLink(c, tt.token)
+			if err != tt.expect {
+				t.Errorf("got error: %v, want %v", err, tt.expect)
+			}
+
+			if err == nil && claims.Id != upload.Id {
+				t.Errorf("got id %s, want %s", claims.Id, upload.Id)
+			}
+		})
+	}
+
+	// single use links can be claimed once
+	single, _ := SignLink(c, upload, time.Hour, true)
+	claims, err := ParseLink(c, linkToken(single))
+	if err != nil || claims.Nonce == "" {
+		t.Fatalf("Single use link has no nonce: %v", err)
+	}
+
+	if err := db.ClaimNonce(claims.Nonce, claims.Expires); err != nil {
+		t.Errorf("Could not claim nonce: " + err.Error())
+	}
+
+	if err := db.ClaimNonce(claims.Nonce, claims.Expires); err != ErrLinkUsed {
+		t.Errorf("Claimed nonce twice, got: %v", err)
+	}
+
+	// revocation bumps the link generation, old links no longer match
+	revoked, err := db.RevokeLinks(upload.Id)
+	if err != nil {
+		t.Fatalf("Could not revoke links: " + err.Error())
+	}
+
+	claims, _ = ParseLink(c, token)
+	if claims.Generation == revoked.LinkGeneration {
+		t.Errorf("Link generation unchanged after revocation")
+	}
+
+	// modifying the upload afterwards doesn't bring revoked links back
+	modified, err := db.ModifyUpload("foo", upload.Id, &common.Upload{Description: "modified"})
+	if err != nil {
+		t.Fatalf("Could not modify upload: " + err.Error())
+	}
+
+	if modified.LinkGeneration != revoked.LinkGeneration || claims.Generation == modified.LinkGeneration {
+		t.Errorf("Revoked link valid again after modify, generation %d", modified.LinkGeneration)
+	}
+
+	app := fiber.New()
+	app.Get("/link/:token", func(ctx *fiber.Ctx) error {
+		return UploadFetch(ctx, c, db, true)
+	})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/link/"+token, nil))
+	if err != nil {
+		t.Fatalf("Request failed: " + err.Error())
+	}
+
+	if resp.StatusCode != fiber.StatusGone {
+		t.Errorf("Revoked link got status %d after modify, want 410", resp.StatusCode)
+	}
+
+	// after a key rotation links and form tokens signed with the
+	// previous key stay valid as long as it is configured
+	formtoken := FormToken(c, "8b6b4c4a-3b4f-4c55-9e38-1b2b4a9d1f00")
+	c.SigningKey = "rotated"
+	c.PreviousSigningKey = string(key)
+	if err := SetupSigningKey(c, db); err != nil {
+		t.Fatalf("Could not setup rotated signing key: " + err.Error())
+	}
+
+	if _, err := ParseLink(c, token); err != nil {
+		t.Errorf("Link signed with the previous key rejected: %v", err)
+	}
+
+	if _, err := ParseFormToken(c, formtoken); err != nil {
+		t.Errorf("Form token signed with the previous key rejected: %v", err)
+	}
+
+	rotated, _ := SignLink(c, upload, time.Hour, false)
+	if _, err := ParseLink(c, linkToken(rotated)); err != nil {
+		t.Errorf("Link signed with the rotated key rejected: %v", err)
+	}
+
+	c.PreviousSigningKey = ""
+	if err := SetupSigningKey(c, db); err != nil {
+		t.Fatalf("Could not setup rotated signing key: " + err.Error())
+	}
+
+	if _, err := ParseLink(c, token); err != ErrLinkInvalid {
+		t.Errorf("Link signed with a dropped key accepted, got: %v", err)
+	}
+
+	if _, err := ParseFormToken(c, formtoken); err != ErrFormToken {
+		t.Errorf("Form token signed with a dropped key accepted, got: %v", err)
+	}
+}
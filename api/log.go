@@ -0,0 +1,235 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+)
+
+/*
+   Leveled logging, as text or json lines.  Lines logged while handling
+   a request carry its request id, use LogFor(c) there.  Emails and
+   anything looking like a key, token or hash are redacted, so handlers
+   don't have to care.
+*/
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[int]string{
+	levelDebug: cfg.LogDebug,
+	levelInfo:  cfg.LogInfo,
+	levelWarn:  cfg.LogWarn,
+	levelError: cfg.LogError,
+}
+
+var logging = struct {
+	sync.Mutex
+	out   io.Writer
+	level int
+	json  bool
+}{out: os.Stdout, level: levelInfo}
+
+// what to hide, in this order
+var redactions = []struct {
+	pattern *regexp.Regexp
+	replace string
+}{
+	{regexp.MustCompile(`(?i)(bearer\s+)\S+`), "${1}[redacted]"},
+	{regexp.MustCompile(`eyJ[\w-]*\.[\w-]*\.[\w-]*`), "[redacted]"},
+	{regexp.MustCompile(`\$argon2id\$\S+`), "[redacted]"},
+	{regexp.MustCompile(`\b[0-9a-fA-F]{32,}\b`), "[redacted]"},
+	// the id of a public download or form grants access to it
+	{regexp.MustCompile(`(/(?:link|download|form)/)[^/\s"?]+`), "${1}[redacted]"},
+	{regexp.MustCompile(`[\w.%+\-]+@([\w\-]+\.[\w.\-]+)`), "[redacted]@$1"},
+}
+
+func redact(msg string) string {
+	for _, r := range redactions {
+		msg = r.pattern.ReplaceAllString(msg, r.replace)
+	}
+
+	return msg
+}
+
+// apply the log settings of the config, may be called again on reload
+func SetupLogging(conf *cfg.Config) {
+	logging.Lock()
+	defer logging.Unlock()
+
+	for level, name := range levelNames {
+		if name == conf.LogLevel {
+			logging.level = level
+		}
+	}
+
+	logging.json = conf.LogFormat == cfg.LogJson
+}
+
+type logField struct {
+	key   string
+	value any
+}
+
+// a logger with fields added to every line
+type Logger struct {
+	fields []logField
+}
+
+// logger for the request, lines carry its id
+func LogFor(c *fiber.Ctx) Logger {
+	if id, ok := c.Locals("requestid").(string); ok && id != "" {
+		return Logger{}.With("requestid", id)
+	}
+
+	return Logger{}
+}
+
+func (l Logger) With(key string, value any) Logger {
+	fields := make([]logField, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+
+	return Logger{fields: append(fields, logField{key, value})}
+}
+
+func (l Logger) Debug(format string, values ...any) { l.log(levelDebug, format, values...) }
+func (l Logger) Info(format string, values ...any)  { l.log(levelInfo, format, values...) }
+func (l Logger) Warn(format string, values ...any)  { l.log(levelWarn, format, values...) }
+func (l Logger) Error(format string, values ...any) { l.log(levelError, format, values...) }
+
+func (l Logger) log(level int, format string, values ...any) {
+	logging.Lock()
+	defer logging.Unlock()
+
+	if level < logging.level {
+		return
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	msg := redact(fmt.Sprintf(format, values...))
+
+	var line bytes.Buffer
+
+	if logging.json {
+		entry := []logField{
+			{"time", now}, {"level", levelNames[level]}, {"pid", os.Getpid()}, {"msg", msg},
+		}
+
+		line.WriteString("{")
+		for i, field := range append(entry, l.fields...) {
+			if i > 0 {
+				line.WriteString(",")
+			}
+
+			key, _ := json.Marshal(field.key)
+			value, err := json.Marshal(redactValue(field.value))
+			if err != nil {
+				value, _ = json.Marshal(fmt.Sprint(field.value))
+			}
+
+			line.Write(key)
+			line.WriteString(":")
+			line.Write(value)
+		}
+		line.WriteString("}")
+	} else {
+		fmt.Fprintf(&line, "%s [%s] %d %s", now, strings.ToUpper(levelNames[level]), os.Getpid(), msg)
+		for _, field := range l.fields {
+			fmt.Fprintf(&line, " %s=%v", field.key, redactValue(field.value))
+		}
+	}
+
+	line.WriteString("\n")
+	_, _ = logging.out.Write(line.Bytes())
+}
+
+func redactValue(value any) any {
+	if s, ok := value.(string); ok {
+		return redact(s)
+	}
+
+	return value
+}
+
+// various helpers, without a request
+func Debug(format string, values ...any) { Logger{}.log(levelDebug, format, values...) }
+func Info(format string, values ...any)  { Logger{}.log(levelInfo, format, values...) }
+func Warn(format string, values ...any)  { Logger{}.log(levelWarn, format, values...) }
+func Error(format string, values ...any) { Logger{}.log(levelError, format, values...) }
+
+// the config without secrets, to be logged
+func redactedConfig(conf *cfg.Config) cfg.Config {
+	hide := func(secret string) string {
+		if secret == "" {
+			return ""
+		}
+		return "[redacted]"
+	}
+
+	redacted := *conf
+	redacted.Mail.Password = hide(conf.Mail.Password)
+	redacted.SigningKey = hide(conf.SigningKey)
+	redacted.SigningSecret = nil
+	redacted.PreviousSigningKey = hide(conf.PreviousSigningKey)
+	redacted.PreviousSecret = nil
+	redacted.MetricsToken = hide(conf.MetricsToken)
+
+	redacted.Apicontexts = make([]cfg.Apicontext, len(conf.Apicontexts))
+	for i, apicontext := range conf.Apicontexts {
+		apicontext.Key = hide(apicontext.Key)
+		apicontext.KeyHash = hide(apicontext.KeyHash)
+		redacted.Apicontexts[i] = apicontext
+	}
+
+	return redacted
+}
+
+// log every request, replaces the fiber logger
+func RequestLogger() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
+		// let the error handler set the status now, like the fiber logger does
+		if err := c.Next(); err != nil {
+			if err := c.App().ErrorHandler(c, err); err != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		LogFor(c).
+			With("status", c.Response().StatusCode()).
+			With("latency", time.Since(start).Round(time.Microsecond).String()).
+			Info("%s %s", c.Method(), c.Path())
+
+		return nil
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+	"github.com/tlinden/ephemerup/cfg"
+)
+
+// capture the log output of fn
+func captureLog(conf *cfg.Config, fn func()) string {
+	var out bytes.Buffer
+
+	logging.Lock()
+	logging.out = &out
+	logging.Unlock()
+
+	SetupLogging(conf)
+
+	defer func() {
+		logging.Lock()
+		logging.out = os.Stdout
+		logging.Unlock()
+		SetupLogging(&cfg.Config{LogLevel: cfg.LogInfo, LogFormat: cfg.LogText})
+	}()
+
+	fn()
+
+	return out.String()
+}
+
+func TestRedact(t *testing.T) {
+	var tests = []struct {
+		msg  string
+		want string
+	}{
+		{"mail to joe@example.com sent", "mail to [redacted]@example.com sent"},
+		{"Authorization: Bearer s3cr3t", "Authorization: Bearer [redacted]"},
+		{"key 0fddbff5d8010f81cd28a7d77f3e38981b13d6164c2fd6e1c3f60a4287630c37", "key [redacted]"},
+		{"jwt eyJhbGciOiJSUzI1NiJ9.eyJzdWIiOiJ4In0.c2ln", "jwt [redacted]"},
+		{"GET /link/abc.def/file.txt", "GET /link/[redacted]/file.txt"},
+		{"GET /download/8b6b4c4a-3b4f-4c55-9e38-1b2b4a9d1f00", "GET /download/[redacted]"},
+		{"POST /download/tiger-apple-ocean-river-lamp-stone/file.txt", "POST /download/[redacted]/file.txt"},
+		{"GET /download/ab3d-ef4h-jk5m?inline=1", "GET /download/[redacted]?inline=1"},
+		{"GET /form/8b6b4c4a-3b4f-4c55-9e38-1b2b4a9d1f00", "GET /form/[redacted]"},
+		{"hash $argon2id$v=19$m=65536,t=1,p=4$c2FsdA$aGFzaA", "hash [redacted]"},
+		{"upload 8b6b4c4a-3b4f-4c55-9e38-1b2b4a9d1f00 expired", "upload 8b6b4c4a-3b4f-4c55-9e38-1b2b4a9d1f00 expired"},
+	}
+
+	for _, tt := range tests {
+		if got := redact(tt.msg); got != tt.want {
+			t.Errorf("redact(%q): got %q, want %q", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	out := captureLog(&cfg.Config{LogLevel: cfg.LogWarn, LogFormat: cfg.LogText}, func() {
+		Debug("debug line")
+		Info("info line")
+		Warn("warn line")
+		Error("error line")
+	})
+
+	for _, unwanted := range []string{"debug line", "info line"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("log contains %q below level warn:\n%s", unwanted, out)
+		}
+	}
+
+	for _, wanted := range []string{"[WARN]", "warn line", "[ERROR]", "error line"} {
+		if !strings.Contains(out, wanted) {
+			t.Errorf("log does not contain %q:\n%s", wanted, out)
+		}
+	}
+}
+
+func TestLogJson(t *testing.T) {
+	app := fiber.New()
+	app.Use(requestid.New())
+	app.Use(RequestLogger())
+	app.Get("/", func(c *fiber.Ctx) error {
+		LogFor(c).Warn("Failed to send mail to %s", "joe@example.com")
+		return JsonStatus(c, fiber.StatusOK, "ok")
+	})
+
+	out := captureLog(&cfg.Config{LogLevel: cfg.LogInfo, LogFormat: cfg.LogJson}, func() {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-ID", "req-1")
+
+		if _, err := app.Test(req); err != nil {
+			t.Fatalf("Request failed: " + err.Error())
+		}
+	})
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2:\n%s", len(lines), out)
+	}
+
+	var tests = []map[string]any{
+		{"level": "warn", "msg": "Failed to send mail to [redacted]@example.com", "requestid": "req-1"},
+		{"level": "info", "msg": "GET /", "requestid": "req-1", "status": float64(200)},
+	}
+
+	for i, want := range tests {
+		entry := map[string]any{}
+		if err := json.Unmarshal([]byte(lines[i]), &entry); err != nil {
+			t.Fatalf("Invalid json log line %q: %s", lines[i], err)
+		}
+
+		for key, value := range want {
+			if entry[key] != value {
+				t.Errorf("line %d: got %s=%v, want %v", i, key, entry[key], value)
+			}
+		}
+	}
+}
+
+func TestLogRequestPaths(t *testing.T) {
+	app := fiber.New()
+	app.Use(RequestLogger())
+	for _, path := range []string{"/download/:id", "/download/:id/:file", "/form/:id"} {
+		app.Get(path, func(c *fiber.Ctx) error {
+			return JsonStatus(c, fiber.StatusOK, "ok")
+		})
+	}
+
+	var tests = []struct {
+		path string
+		want string
+	}{
+		{"/download/8b6b4c4a-3b4f-4c55-9e38-1b2b4a9d1f00", "GET /download/[redacted]"},
+		{"/download/tiger-apple-ocean-river-lamp-stone/t1", "GET /download/[redacted]/t1"},
+		{"/download/ab3d-ef4h-jk5m", "GET /download/[redacted]"},
+		{"/form/8b6b4c4a-3b4f-4c55-9e38-1b2b4a9d1f00", "GET /form/[redacted]"},
+	}
+
+	for _, tt := range tests {
+		out := captureLog(&cfg.Config{LogLevel: cfg.LogInfo, LogFormat: cfg.LogText}, func() {
+			if _, err := app.Test(httptest.NewRequest("GET", tt.path, nil)); err != nil {
+				t.Fatalf("Request failed: " + err.Error())
+			}
+		})
+
+		if !strings.Contains(out, tt.want) {
+			t.Errorf("request log of %s does not contain %q:\n%s", tt.path, tt.want, out)
+		}
+
+		id := strings.Split(tt.path, "/")[2]
+		if strings.Contains(out, id) {
+			t.Errorf("request log contains id %s:\n%s", id, out)
+		}
+	}
+}
@@ -42,10 +42,11 @@ func Sendmail(c *cfg.Config, recipient string, body string, subject string) erro
 	auth := smtp.PlainAuth("", c.Mail.From, c.Mail.Password, c.Mail.Server)
 
 	// Sending email.
-	Log("Trying to send mail to %s via %s:%s with subject %s",
+	Debug("Trying to send mail to %s via %s:%s with subject %s",
 		recipient, c.Mail.Server, c.Mail.Port, subject)
 	err := smtp.SendMail(c.Mail.Server+":"+c.Mail.Port, auth, c.Mail.From, []string{recipient}, []byte(message))
 	if err != nil {
+		metricMailFailures.Inc()
 		return err
 	}
 
@@ -0,0 +1,460 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+   Metrics in  the  prometheus text format,  served on /metrics.  In
+   prefork mode every process has its own, each scrape hits one of them.
+*/
+
+// the counters of the cleaner, published for the prefork children
+const MetricsBucket string = "metrics"
+
+// upper bounds of the request duration buckets, in seconds
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+var (
+	metricRequests = newCounterVec("ephemerup_http_requests_total",
+		"Number of http requests.", "route", "method", "status")
+	metricDuration = newHistogramVec("ephemerup_http_request_duration_seconds",
+		"Duration of http requests.", durationBuckets, "route", "method", "status")
+	metricUploaded = newCounterVec("ephemerup_uploaded_bytes_total",
+		"Bytes uploaded.", "context")
+	metricDownloaded = newCounterVec("ephemerup_downloaded_bytes_total",
+		"Bytes downloaded.", "context")
+	metricCleanerRuns = newCounterVec("ephemerup_cleaner_runs_total",
+		"Number of background cleaner runs.")
+	metricDeletions = newCounterVec("ephemerup_cleaner_deletions_total",
+		"Number of entries deleted because they expired.", "object")
+	metricMailFailures = newCounterVec("ephemerup_mail_failures_total",
+		"Number of notification mails which could not be sent.")
+	metricAuthFailures = newCounterVec("ephemerup_auth_failures_total",
+		"Number of rejected authentications.", "reason")
+
+	// uploads currently being processed
+	metricActiveUploads int64
+
+	// maintained by the cleaner, which runs in the prefork parent only
+	cleanerMetrics = []*counterVec{metricCleanerRuns, metricDeletions}
+)
+
+// label values, joined to be used as map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func writeLabels(w io.Writer, names []string, key string, extra ...string) {
+	pairs := []string{}
+
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, names[i]+"="+strconv.Quote(value))
+		}
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+
+	if len(pairs) > 0 {
+		fmt.Fprint(w, "{"+strings.Join(pairs, ",")+"}")
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type counterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (v *counterVec) Add(value float64, labels ...string) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.values[labelKey(labels)] += value
+}
+
+func (v *counterVec) Inc(labels ...string) {
+	v.Add(1, labels...)
+}
+
+// a counter as stored in the db, see PublishCleanerMetrics()
+type storedCounter struct {
+	Labels []string `json:"labels"`
+	Value  float64  `json:"value"`
+}
+
+func (v *counterVec) snapshot() []storedCounter {
+	v.Lock()
+	defer v.Unlock()
+
+	counters := []storedCounter{}
+	for key, value := range v.values {
+		counters = append(counters, storedCounter{Labels: strings.Split(key, "\xff"), Value: value})
+	}
+
+	return counters
+}
+
+// a copy of the counter with the given values
+func (v *counterVec) with(counters []storedCounter) *counterVec {
+	copied := newCounterVec(v.name, v.help, v.labels...)
+	for _, counter := range counters {
+		copied.values[labelKey(counter.Labels)] = counter.Value
+	}
+
+	return copied
+}
+
+func (v *counterVec) write(w io.Writer) {
+	v.Lock()
+	defer v.Unlock()
+
+	writeHeader(w, v.name, v.help, "counter")
+
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// counters without labels are always present
+	if len(v.labels) == 0 && len(keys) == 0 {
+		keys = append(keys, "")
+	}
+
+	for _, key := range keys {
+		fmt.Fprint(w, v.name)
+		writeLabels(w, v.labels, key)
+		fmt.Fprintln(w, " "+formatFloat(v.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (v *histogramVec) Observe(value float64, labels ...string) {
+	v.Lock()
+	defer v.Unlock()
+
+	key := labelKey(labels)
+	h, ok := v.series[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(v.buckets))}
+		v.series[key] = h
+	}
+
+	for i, bound := range v.buckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+
+	h.sum += value
+	h.count++
+}
+
+func (v *histogramVec) write(w io.Writer) {
+	v.Lock()
+	defer v.Unlock()
+
+	writeHeader(w, v.name, v.help, "histogram")
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h := v.series[key]
+
+		var cumulative uint64
+		for i, bound := range v.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprint(w, v.name+"_bucket")
+			writeLabels(w, v.labels, key, "le", formatFloat(bound))
+			fmt.Fprintf(w, " %d\n", cumulative)
+		}
+
+		fmt.Fprint(w, v.name+"_bucket")
+		writeLabels(w, v.labels, key, "le", "+Inf")
+		fmt.Fprintf(w, " %d\n", h.count)
+
+		fmt.Fprint(w, v.name+"_sum")
+		writeLabels(w, v.labels, key)
+		fmt.Fprintln(w, " "+formatFloat(h.sum))
+
+		fmt.Fprint(w, v.name+"_count")
+		writeLabels(w, v.labels, key)
+		fmt.Fprintf(w, " %d\n", h.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	writeHeader(w, name, help, "gauge")
+	fmt.Fprintln(w, name+" "+formatFloat(value))
+}
+
+/*
+   Count requests  per route  and status.  The route is the pattern,
+   not the path, so ids don't end up as labels.
+*/
+func MetricsMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
+		// let the error handler set the status now, like the logger does
+		if err := c.Next(); err != nil {
+			if err := c.App().ErrorHandler(c, err); err != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		route := c.Route().Path
+		if c.Response().StatusCode() == fiber.StatusNotFound && route == "/" {
+			// no route matched, only the middleware
+			route = "unmatched"
+		}
+
+		status := strconv.Itoa(c.Response().StatusCode())
+
+		metricRequests.Inc(route, c.Method(), status)
+		metricDuration.Observe(time.Since(start).Seconds(), route, c.Method(), status)
+
+		return nil
+	}
+}
+
+// number of uploads and forms in the db, as of the last count
+type entryCount struct {
+	sync.Mutex
+	uploads int
+	forms   int
+	counted time.Time
+}
+
+/*
+   Number of uploads and forms in  the db. Counting walks the whole
+   bucket, so the result is cached for the cleaner interval, which is
+   the time it takes for expired entries to be removed anyway.
+*/
+func (db *Db) countEntries() (int, int, error) {
+	db.entries.Lock()
+	defer db.entries.Unlock()
+
+	if time.Since(db.entries.counted) < db.Config().CleanInterval {
+		return db.entries.uploads, db.entries.forms, nil
+	}
+
+	uploads, forms := 0, 0
+
+	err := db.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(Bucket))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(id, j []byte) error {
+			entry := struct {
+				Type int `json:"type"`
+			}{}
+
+			if err := json.Unmarshal(j, &entry); err != nil {
+				return fmt.Errorf("unable to unmarshal json: %s", err)
+			}
+
+			if entry.Type == common.TypeForm {
+				forms++
+			} else {
+				uploads++
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	db.entries.uploads, db.entries.forms = uploads, forms
+	db.entries.counted = time.Now()
+
+	return uploads, forms, nil
+}
+
+/*
+   Store the counters of the cleaner, so that the prefork children, which
+   serve /metrics, can report them. Called after every cleaner run.
+*/
+func (db *Db) PublishCleanerMetrics() error {
+	return db.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(MetricsBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+
+		for _, metric := range cleanerMetrics {
+			jsonentry, err := json.Marshal(metric.snapshot())
+			if err != nil {
+				return fmt.Errorf("json marshalling failure: %s", err)
+			}
+
+			if err := bucket.Put([]byte(metric.name), jsonentry); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// the counters of the cleaner, as published by the parent if shared
+func (db *Db) loadCleanerMetrics() ([]*counterVec, error) {
+	if !db.shared {
+		return cleanerMetrics, nil
+	}
+
+	metrics := []*counterVec{}
+
+	err := db.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(MetricsBucket))
+
+		for _, metric := range cleanerMetrics {
+			counters := []storedCounter{}
+
+			if bucket != nil {
+				if j := bucket.Get([]byte(metric.name)); j != nil {
+					if err := json.Unmarshal(j, &counters); err != nil {
+						return fmt.Errorf("unable to unmarshal json: %s", err)
+					}
+				}
+			}
+
+			metrics = append(metrics, metric.with(counters))
+		}
+
+		return nil
+	})
+
+	return metrics, err
+}
+
+// serve the metrics, protected by the metrics token, if configured
+func MetricsHandler(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
+	if cfg.MetricsToken != "" {
+		token := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.MetricsToken)) != 1 {
+			return JsonStatus(c, fiber.StatusForbidden, "Invalid metrics token provided!")
+		}
+	}
+
+	var w bytes.Buffer
+
+	for _, metric := range []interface{ write(io.Writer) }{
+		metricRequests, metricDuration, metricUploaded, metricDownloaded,
+	} {
+		metric.write(&w)
+	}
+
+	cleaner, err := db.loadCleanerMetrics()
+	if err != nil {
+		LogFor(c).Error("Unable to load cleaner metrics: %s", err)
+	} else {
+		for _, metric := range cleaner {
+			metric.write(&w)
+		}
+	}
+
+	for _, metric := range []interface{ write(io.Writer) }{
+		metricMailFailures, metricAuthFailures,
+	} {
+		metric.write(&w)
+	}
+
+	writeGauge(&w, "ephemerup_active_uploads", "Number of uploads currently being processed.",
+		float64(atomic.LoadInt64(&metricActiveUploads)))
+
+	if stat, err := os.Stat(cfg.DbFile); err == nil {
+		writeGauge(&w, "ephemerup_db_size_bytes", "Size of the database file.", float64(stat.Size()))
+	}
+
+	uploads, forms, err := db.countEntries()
+	if err != nil {
+		LogFor(c).Error("Unable to count db entries: %s", err)
+	} else {
+		writeHeader(&w, "ephemerup_db_entries", "Number of entries in the database.", "gauge")
+		fmt.Fprintf(&w, "ephemerup_db_entries{type=\"upload\"} %d\n", uploads)
+		fmt.Fprintf(&w, "ephemerup_db_entries{type=\"form\"} %d\n", forms)
+	}
+
+	c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+
+	return c.Status(fiber.StatusOK).Send(w.Bytes())
+}
@@ -0,0 +1,221 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+)
+
+func TestMetrics(t *testing.T) {
+	c := &cfg.Config{
+		DbFile:       "metricstest.db",
+		StorageDir:   ".",
+		Apicontexts:  []cfg.Apicontext{{Context: "foo", Key: "fookey"}},
+		MetricsToken: "scrapeme",
+	}
+
+	if err := c.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply config defaults: " + err.Error())
+	}
+
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	auth := SetupAuthStore(c, db)
+	defer AuthSetApikeys(nil)
+
+	app := fiber.New()
+	app.Use(MetricsMiddleware())
+	app.Get("/metricstest/:id", auth, func(ctx *fiber.Ctx) error {
+		return JsonStatus(ctx, fiber.StatusOK, "ok")
+	})
+	app.Get("/metrics", func(ctx *fiber.Ctx) error {
+		return MetricsHandler(ctx, c, db)
+	})
+
+	for _, key := range []string{"fookey", "fookey", "wrong"} {
+		req := httptest.NewRequest("GET", "/metricstest/"+key, nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+
+		if _, err := app.Test(req); err != nil {
+			t.Fatalf("Request failed: " + err.Error())
+		}
+	}
+
+	var tests = []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"no-token", "", fiber.StatusForbidden},
+		{"wrong-token", "scrapeyou", fiber.StatusForbidden},
+		{"token", "scrapeme", fiber.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Request failed: " + err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scrapeme")
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Request failed: " + err.Error())
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Could not read response: " + err.Error())
+	}
+
+	for _, want := range []string{
+		`ephemerup_http_requests_total{route="/metricstest/:id",method="GET",status="200"} 2`,
+		`ephemerup_http_requests_total{route="/metricstest/:id",method="GET",status="403"} 1`,
+		`ephemerup_http_request_duration_seconds_count{route="/metricstest/:id",method="GET",status="200"} 2`,
+		`ephemerup_http_requests_total{route="/metrics",method="GET",status="403"} 2`,
+		`ephemerup_auth_failures_total{reason="invalid"}`,
+		`ephemerup_db_entries{type="upload"} 0`,
+		`ephemerup_active_uploads 0`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsEntryCount(t *testing.T) {
+	c := &cfg.Config{DbFile: "metricscount.db", StorageDir: "."}
+	if err := c.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply config defaults: " + err.Error())
+	}
+
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	if uploads, forms, err := db.countEntries(); err != nil || uploads != 0 || forms != 0 {
+		t.Fatalf("got %d uploads, %d forms (%v), want none", uploads, forms, err)
+	}
+
+	now := common.Timestamp{Time: time.Now()}
+	if err := db.Insert("1", &common.Upload{Id: "1", Type: common.TypeUpload, Expire: "1d", Created: now}); err != nil {
+		t.Fatalf("Could not insert upload: " + err.Error())
+	}
+
+	// cached for the cleaner interval
+	if uploads, _, _ := db.countEntries(); uploads != 0 {
+		t.Errorf("got %d uploads, want the cached count 0", uploads)
+	}
+
+	db.entries.counted = time.Time{}
+
+	if uploads, _, _ := db.countEntries(); uploads != 1 {
+		t.Errorf("got %d uploads after the cleaner interval, want 1", uploads)
+	}
+}
+
+func TestMetricsCleanerShared(t *testing.T) {
+	c := &cfg.Config{DbFile: "metricsshared.db", StorageDir: ".", Prefork: true}
+	if err := c.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply config defaults: " + err.Error())
+	}
+
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	app := fiber.New()
+	app.Get("/metrics", func(ctx *fiber.Ctx) error {
+		return MetricsHandler(ctx, c, db)
+	})
+
+	scrape := func() string {
+		resp, err := app.Test(httptest.NewRequest("GET", "/metrics", nil))
+		if err != nil {
+			t.Fatalf("Request failed: " + err.Error())
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	metricCleanerRuns.Inc()
+	metricDeletions.Inc(AuditUpload)
+
+	// nothing published by the parent yet
+	if body := scrape(); !strings.Contains(body, "ephemerup_cleaner_runs_total 0\n") {
+		t.Errorf("cleaner runs of this process reported:\n%s", body)
+	}
+
+	if err := db.PublishCleanerMetrics(); err != nil {
+		t.Fatalf("Could not publish cleaner metrics: " + err.Error())
+	}
+
+	runs := metricCleanerRuns.snapshot()[0].Value
+	deletions := 0.0
+	for _, counter := range metricDeletions.snapshot() {
+		if counter.Labels[0] == AuditUpload {
+			deletions = counter.Value
+		}
+	}
+
+	// changed after publishing, not reported
+	metricCleanerRuns.Inc()
+
+	body := scrape()
+	for _, want := range []string{
+		"ephemerup_cleaner_runs_total " + formatFloat(runs) + "\n",
+		`ephemerup_cleaner_deletions_total{object="` + AuditUpload + `"} ` + formatFloat(deletions) + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2id parameters, see RFC 9106, section 4
+const (
+	argonTime    uint32 = 1
+	argonMemory  uint32 = 64 * 1024
+	argonThreads uint8  = 4
+	argonKeyLen  uint32 = 32
+	argonSaltLen        = 16
+)
+
+// header used by API clients to send the password of an upload
+const PasswordHeader = "X-Download-Password"
+
+// failed password attempts per upload and client before lockout
+const (
+	MaxPasswordFailures = 5
+	PasswordLockout     = 15 * time.Minute
+)
+
+/*
+   Hash a  password using argon2id.  Returns the hash  in the  common
+   PHC string format, which contains the parameters and the salt:
+
+   $argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+*/
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	hash := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// check a password against a hash created by HashPassword()
+func VerifyPassword(password, encoded string) (bool, error) {
+	parts := strings.Split(strings.TrimPrefix(encoded, "$"), "$")
+	if len(parts) != 5 || parts[0] != "argon2id" {
+		return false, errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[1], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errors.New("unsupported argon2 version")
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, errors.New("invalid argon2 parameters: " + err.Error())
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false, errors.New("invalid argon2 salt: " + err.Error())
+	}
+
+	hash, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errors.New("invalid argon2 hash: " + err.Error())
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(hash)))
+
+	return subtle.ConstantTimeCompare(hash, computed) == 1, nil
+}
+
+// failed password attempts, key is upload id + client ip, value the
+// unix time of the first failure followed by the number of failures
+const PasswordFailureBucket string = "pwfailures"
+
+func failureKey(id, ip string) []byte {
+	return []byte(id + "|" + ip)
+}
+
+func decodeFailure(v []byte) (time.Time, uint64, bool) {
+	if len(v) != 16 {
+		return time.Time{}, 0, false
+	}
+
+	return time.Unix(int64(binary.BigEndian.Uint64(v[:8])), 0),
+		binary.BigEndian.Uint64(v[8:]), true
+}
+
+/*
+   Check if a client has been  locked out for an upload because of too
+   many failed attempts. Returns the time left until it may try again.
+
+   The counters  are kept in the  database so that they  are shared by
+   all processes in prefork mode.
+*/
+func PasswordLocked(db *Db, id, ip string) (bool, time.Duration) {
+	var first time.Time
+	var count uint64
+
+	err := db.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(PasswordFailureBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		first, count, _ = decodeFailure(bucket.Get(failureKey(id, ip)))
+		return nil
+	})
+
+	if err != nil {
+		Error("Unable to look up password failures of %s: %s", id, err.Error())
+		return false, 0
+	}
+
+	left := PasswordLockout - time.Since(first)
+	if count == 0 || left <= 0 {
+		return false, 0
+	}
+
+	return count >= MaxPasswordFailures, left
+}
+
+// register a failed attempt
+func PasswordFailed(db *Db, id, ip string) {
+	err := db.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(PasswordFailureBucket))
+		if err != nil {
+			return err
+		}
+
+		key := failureKey(id, ip)
+		first, count, ok := decodeFailure(bucket.Get(key))
+		if !ok || time.Since(first) > PasswordLockout {
+			first, count = time.Now(), 0
+		}
+
+		v := make([]byte, 16)
+		binary.BigEndian.PutUint64(v[:8], uint64(first.Unix()))
+		binary.BigEndian.PutUint64(v[8:], count+1)
+
+		return bucket.Put(key, v)
+	})
+
+	if err != nil {
+		Error("Unable to record password failure of %s: %s", id, err.Error())
+	}
+}
+
+// forget failed attempts after a successful one
+func PasswordSucceeded(db *Db, id, ip string) {
+	err := db.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(PasswordFailureBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.Delete(failureKey(id, ip))
+	})
+
+	if err != nil {
+		Error("Unable to reset password failures of %s: %s", id, err.Error())
+	}
+}
+
+// remove stale entries, called by the background cleaner
+func DeleteExpiredPasswordFailures(db *Db) error {
+	return db.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(PasswordFailureBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		expired := [][]byte{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			first, _, ok := decodeFailure(v)
+			if !ok || time.Since(first) > PasswordLockout {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
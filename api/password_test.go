@@ -0,0 +1,111 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"testing"
+
+	"github.com/tlinden/ephemerup/cfg"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatalf("Could not hash password: " + err.Error())
+	}
+
+	var tests = []struct {
+		name     string
+		password string
+		hash     string
+		expect   bool
+		wanterr  bool
+	}{
+		{"match", "secret", hash, true, false},
+		{"mismatch", "wrong", hash, false, false},
+		{"no-leading-dollar", "secret", hash[1:], true, false},
+		{"invalid-hash", "secret", "sha256$abcdef", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := VerifyPassword(tt.password, tt.hash)
+			if ok != tt.expect {
+				t.Errorf("got %t, want %t", ok, tt.expect)
+			}
+
+			if (err != nil) != tt.wanterr {
+				t.Errorf("got error: %v, wanterr: %t", err, tt.wanterr)
+			}
+		})
+	}
+}
+
+func TestPasswordLockout(t *testing.T) {
+	db, err := NewDb(&cfg.Config{DbFile: "pwtest.db"})
+	if err != nil {
+		t.Fatalf("Could not open db: " + err.Error())
+	}
+	defer finalize(db)
+
+	for i := 0; i < MaxPasswordFailures; i++ {
+		if locked, _ := PasswordLocked(db, "1", "127.0.0.1"); locked {
+			t.Errorf("locked out after %d failures", i)
+		}
+		PasswordFailed(db, "1", "127.0.0.1")
+	}
+
+	if locked, left := PasswordLocked(db, "1", "127.0.0.1"); !locked || left <= 0 {
+		t.Errorf("not locked out after %d failures", MaxPasswordFailures)
+	}
+
+	// other clients are not affected
+	if locked, _ := PasswordLocked(db, "1", "127.0.0.2"); locked {
+		t.Errorf("other client locked out as well")
+	}
+
+	PasswordSucceeded(db, "1", "127.0.0.1")
+
+	if locked, _ := PasswordLocked(db, "1", "127.0.0.1"); locked {
+		t.Errorf("still locked out after success")
+	}
+
+	// stale entries are removed by the cleaner
+	PasswordFailed(db, "1", "127.0.0.1")
+	err = db.update(func(tx *bolt.Tx) error {
+		v := make([]byte, 16)
+		return tx.Bucket([]byte(PasswordFailureBucket)).Put(failureKey("1", "127.0.0.1"), v)
+	})
+	if err != nil {
+		t.Fatalf("Could not age failure: " + err.Error())
+	}
+
+	if err := DeleteExpiredPasswordFailures(db); err != nil {
+		t.Errorf("Could not delete expired failures: " + err.Error())
+	}
+
+	err = db.view(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(PasswordFailureBucket)).Get(failureKey("1", "127.0.0.1")) != nil {
+			t.Errorf("expired failure has not been deleted")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Could not read failures: " + err.Error())
+	}
+}
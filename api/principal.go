@@ -0,0 +1,168 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+)
+
+// key of the principal in the request locals
+const principalKey = "principal"
+
+// permissions of a principal, checked per route by RequireScope()
+const (
+	ScopeUpload     = "upload"
+	ScopeModify     = "modify" // change expire, download limit etc of uploads
+	ScopeList       = "list"
+	ScopeDownload   = "download"
+	ScopeDelete     = "delete"
+	ScopeForms      = "forms"
+	ScopeFormUpload = "formupload" // form tokens: upload using the form only
+	ScopeTokens     = "tokens"     // manage api tokens, never granted to tokens
+	ScopeAudit      = "audit"      // read the audit log, see CanSeeAll()
+	ScopeContexts   = "contexts"   // manage api contexts, super context only
+)
+
+// scopes granted by the role of an api context
+var roleScopes = map[string][]string{
+	cfg.RoleAdmin: {ScopeUpload, ScopeModify, ScopeList, ScopeDownload, ScopeDelete,
+		ScopeForms, ScopeTokens},
+	cfg.RoleReadOnly:    {ScopeList, ScopeDownload},
+	cfg.RoleUploadOnly:  {ScopeUpload},
+	cfg.RoleFormManager: {ScopeForms},
+	cfg.RoleAuditor:     {ScopeList, ScopeAudit},
+}
+
+// granted additionally to the super context, if its role is admin
+var superScopes = []string{ScopeAudit, ScopeContexts}
+
+// returned by the db if the role of an api context doesn't permit an operation
+var ErrForbidden = errors.New("insufficient permissions")
+
+var errScope = &fiber.Error{
+	Code:    403003,
+	Message: "Not allowed to access this endpoint",
+}
+
+/*
+   The authenticated  client of a  request, set by the  auth validator
+   and only valid for the  lifetime of the request. Nothing is stored
+   server side and no cookies are issued.
+*/
+type Principal struct {
+	Context string   // the api context the request is authenticated for
+	FormId  string   // set if authenticated using a form id (onetime key)
+	Scopes  []string // permissions of the key, empty means none
+}
+
+// register the authenticated client for the handlers
+func SetPrincipal(c *fiber.Ctx, principal *Principal) {
+	c.Locals(principalKey, principal)
+}
+
+/*
+   Retrieve the  authenticated  client of  the request. Unauthenticated
+   requests get an  empty principal, its  Context is "", which means
+   no api context restriction applies, e.g. for public downloads.
+*/
+func GetPrincipal(c *fiber.Ctx) *Principal {
+	if principal, ok := c.Locals(principalKey).(*Principal); ok {
+		return principal
+	}
+
+	return &Principal{}
+}
+
+// true if the principal has the given scope, no scopes means none of them
+func (p *Principal) Allowed(scope string) bool {
+	for _, allowed := range p.Scopes {
+		if allowed == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+   The scopes of an  api context according to its role, nil if it has
+   none, e.g. because the context isn't configured (anymore).
+*/
+func RoleScopes(conf *cfg.Config, apicontext string) []string {
+	return scopesOf(conf.ContextRole(apicontext), IsSuper(conf, apicontext))
+}
+
+// the scopes of a role, for the super context or any other
+func scopesOf(role string, super bool) []string {
+	scopes := roleScopes[role]
+
+	if super && role == cfg.RoleAdmin {
+		scopes = append(append([]string{}, scopes...), superScopes...)
+	}
+
+	return scopes
+}
+
+/*
+   True if the role of the api context grants one of the scopes. Used
+   by the db as a  second line of  defense, internal callers use an
+   empty context and are always allowed.
+*/
+func ContextAllowed(conf *cfg.Config, apicontext string, scopes ...string) bool {
+	if apicontext == "" {
+		return true
+	}
+
+	principal := &Principal{Context: apicontext, Scopes: RoleScopes(conf, apicontext)}
+
+	for _, scope := range scopes {
+		if principal.Allowed(scope) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// respond to a request the principal lacks the permissions for
+func scopeDenied(c *fiber.Ctx, db *Db, principal *Principal) error {
+	Audit(c, db, AuditDenied, "", "", principal.Context,
+		"missing scope for "+c.Method()+" "+c.Path())
+
+	return JsonStatus(c, fiber.StatusForbidden, errScope.Message+"!")
+}
+
+/*
+   Middleware to  be put after the  auth handler: the principal needs
+   at least one of the given scopes to access the route.
+*/
+func RequireScope(db *Db, scopes ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		principal := GetPrincipal(c)
+
+		for _, scope := range scopes {
+			if principal.Allowed(scope) {
+				return c.Next()
+			}
+		}
+
+		return scopeDenied(c, db, principal)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+)
+
+var errRateLimited = &fiber.Error{
+	Code:    fiber.StatusTooManyRequests,
+	Message: "Rate limit exceeded",
+}
+
+// one token bucket per key, e.g. a client ip or an api context
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+/*
+   Token bucket rate limiter. Each key may do up to Requests requests in
+   a burst, the  bucket refills with Requests per Period.  In prefork
+   mode every process has its own buckets.
+*/
+type RateLimiter struct {
+	sync.Mutex
+	rate    cfg.Rate
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+// the state of a bucket, used for the RateLimit-* headers
+type rateStatus struct {
+	allowed   bool
+	remaining int
+	reset     time.Duration // until the bucket is full again
+	retry     time.Duration // until the next request is allowed
+}
+
+// returns nil if the limit is not configured, which is allowed to use
+func NewRateLimiter(conf *cfg.Config, name string) *RateLimiter {
+	rate, ok := conf.Rates[name]
+	if !ok {
+		return nil
+	}
+
+	return &RateLimiter{rate: rate, buckets: map[string]*bucket{}, pruned: time.Now()}
+}
+
+// refill the bucket of key, it is created if it doesn't exist
+func (l *RateLimiter) refill(key string, now time.Time) *bucket {
+	// forget idle keys, their buckets are full anyway
+	if now.Sub(l.pruned) > l.rate.Period {
+		for k, b := range l.buckets {
+			if now.Sub(b.updated) > l.rate.Period {
+				delete(l.buckets, k)
+			}
+		}
+		l.pruned = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.rate.Requests), updated: now}
+		l.buckets[key] = b
+	}
+
+	perSecond := float64(l.rate.Requests) / l.rate.Period.Seconds()
+	b.tokens = math.Min(float64(l.rate.Requests), b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+	b.updated = now
+
+	return b
+}
+
+func (l *RateLimiter) status(b *bucket, allowed bool) rateStatus {
+	perSecond := float64(l.rate.Requests) / l.rate.Period.Seconds()
+
+	status := rateStatus{
+		allowed:   allowed,
+		remaining: int(b.tokens),
+		reset:     time.Duration((float64(l.rate.Requests) - b.tokens) / perSecond * float64(time.Second)),
+	}
+
+	if b.tokens < 1 {
+		status.retry = time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+
+	return status
+}
+
+// consume a token of key, if there is one
+func (l *RateLimiter) Take(key string) rateStatus {
+	l.Lock()
+	defer l.Unlock()
+
+	b := l.refill(key, time.Now())
+	if b.tokens < 1 {
+		return l.status(b, false)
+	}
+
+	b.tokens--
+
+	return l.status(b, true)
+}
+
+// check if key has a token left, without consuming it
+func (l *RateLimiter) Peek(key string) rateStatus {
+	l.Lock()
+	defer l.Unlock()
+
+	b := l.refill(key, time.Now())
+
+	return l.status(b, b.tokens >= 1)
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+/*
+   Add the  RateLimit-*  headers,  if  multiple limits apply  to a
+   request, the one with the fewest remaining requests wins.
+*/
+func setRateHeaders(c *fiber.Ctx, l *RateLimiter, status rateStatus) {
+	if current := c.GetRespHeader("RateLimit-Remaining"); current != "" {
+		if remaining, err := strconv.Atoi(current); err == nil && remaining < status.remaining {
+			return
+		}
+	}
+
+	c.Set("RateLimit-Limit", strconv.Itoa(l.rate.Requests))
+	c.Set("RateLimit-Remaining", strconv.Itoa(status.remaining))
+	c.Set("RateLimit-Reset", seconds(status.reset))
+
+	if !status.allowed {
+		c.Set(fiber.HeaderRetryAfter, seconds(status.retry))
+	}
+}
+
+func rateLimited(c *fiber.Ctx) error {
+	return JsonStatus(c, fiber.StatusTooManyRequests,
+		errRateLimited.Message+", retry in "+c.GetRespHeader(fiber.HeaderRetryAfter)+" seconds!")
+}
+
+// check the limit of key, sets the headers, false if exceeded
+func (l *RateLimiter) Allow(c *fiber.Ctx, key string) bool {
+	if l == nil {
+		return true
+	}
+
+	status := l.Take(key)
+	setRateHeaders(c, l, status)
+
+	if !status.allowed {
+		LogFor(c).Info("Rate limit exceeded by %s", key)
+	}
+
+	return status.allowed
+}
+
+// middleware limiting the requests per client ip
+func RateLimitIp(db *Db, l *RateLimiter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !l.Allow(c, ClientIP(c, db.Config())) {
+			return rateLimited(c)
+		}
+
+		return c.Next()
+	}
+}
+
+// middleware limiting the requests per api context, use after auth
+func RateLimitContext(l *RateLimiter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !l.Allow(c, GetPrincipal(c).Context) {
+			return rateLimited(c)
+		}
+
+		return c.Next()
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+)
+
+func TestParseRate(t *testing.T) {
+	var tests = []struct {
+		limit    string
+		requests int
+		seconds  int
+		wantfail bool
+	}{
+		{"", 0, 0, false},
+		{"0", 0, 0, false},
+		{"60/1m", 60, 60, false},
+		{" 10 / 1h30m ", 10, 5400, false},
+		{"60", 0, 0, true},
+		{"x/1m", 0, 0, true},
+		{"-1/1m", 0, 0, true},
+		{"10/0s", 0, 0, true},
+		{"10/forever", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		rate, err := cfg.ParseRate(tt.limit)
+
+		if (err != nil) != tt.wantfail {
+			t.Errorf("%q: wantfail: %t, error: %v", tt.limit, tt.wantfail, err)
+			continue
+		}
+
+		if rate.Requests != tt.requests || int(rate.Period.Seconds()) != tt.seconds {
+			t.Errorf("%q: got %d/%s, want %d/%ds", tt.limit, rate.Requests, rate.Period, tt.requests, tt.seconds)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	c := &cfg.Config{
+		DbFile:      "ratelimittest.db",
+		StorageDir:  ".",
+		Apicontexts: []cfg.Apicontext{{Context: "foo", Key: "fookey"}, {Context: "bar", Key: "barkey"}},
+		Ratelimit:   cfg.Ratelimits{Context: "2/1m", AuthFail: "2/1m", Ip: "4/1m"},
+
+		// app.Test() always uses 0.0.0.0 as client ip
+		TrustedProxies: []string{"0.0.0.0"},
+		ProxyHeader:    "X-Forwarded-For",
+	}
+
+	if err := c.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply config defaults: " + err.Error())
+	}
+
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	auth := SetupAuthStore(c, db)
+	defer AuthSetApikeys(nil)
+
+	app := fiber.New()
+	app.Use(RateLimitIp(db, NewRateLimiter(c, cfg.RateIp)))
+	app.Get("/", auth, func(ctx *fiber.Ctx) error {
+		return JsonStatus(ctx, fiber.StatusOK, "ok")
+	})
+
+	var tests = []struct {
+		name      string
+		key       string
+		ip        string
+		status    int
+		remaining string
+	}{
+		{"context-1", "fookey", "10.0.0.1", fiber.StatusOK, "1"},
+		{"context-2", "fookey", "10.0.0.1", fiber.StatusOK, "0"},
+		{"context-exceeded", "fookey", "10.0.0.1", fiber.StatusTooManyRequests, "0"},
+		{"other-context", "barkey", "10.0.0.1", fiber.StatusOK, "0"},
+		{"ip-exceeded", "barkey", "10.0.0.1", fiber.StatusTooManyRequests, "0"},
+		{"authfail-1", "wrong", "10.0.0.2", fiber.StatusForbidden, ""},
+		{"authfail-2", "wrong", "10.0.0.2", fiber.StatusForbidden, ""},
+		{"authfail-blocked", "barkey", "10.0.0.2", fiber.StatusTooManyRequests, ""},
+		{"authfail-other-ip", "barkey", "10.0.0.3", fiber.StatusOK, "0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+			req.Header.Set("X-Forwarded-For", tt.ip)
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("Request failed: " + err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+
+			if tt.remaining != "" && resp.Header.Get("RateLimit-Remaining") != tt.remaining {
+				t.Errorf("got RateLimit-Remaining %q, want %q",
+					resp.Header.Get("RateLimit-Remaining"), tt.remaining)
+			}
+
+			if tt.status == fiber.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+				t.Errorf("Retry-After header missing")
+			}
+		})
+	}
+}
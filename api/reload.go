@@ -0,0 +1,207 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+)
+
+// creates a new config from the config sources, see cmd.Execute()
+type ConfigLoader func() (*cfg.Config, error)
+
+/*
+   Settings  which are only used  at startup.  Changes are ignored  on
+   reload, the running values are kept and a restart is required.
+*/
+func keepStartupSettings(old, conf *cfg.Config) {
+	for _, setting := range []struct {
+		name     string
+		running  any
+		reloaded any
+	}{
+		{"listen", old.Listen, conf.Listen},
+		{"ipv4/ipv6", old.Network, conf.Network},
+		{"prefork", old.Prefork, conf.Prefork},
+		{"appname", old.AppName, conf.AppName},
+		{"bodylimit", old.BodyLimit, conf.BodyLimit},
+		{"apiprefix", old.ApiPrefix, conf.ApiPrefix},
+		{"dbfile", old.DbFile, conf.DbFile},
+		{"storagedir", old.StorageDir, conf.StorageDir},
+		{"ratelimit", old.Ratelimit, conf.Ratelimit},
+	} {
+		if setting.running != setting.reloaded {
+			Warn("Setting %s can't be reloaded, keeping %+v instead of %+v until restart",
+				setting.name, setting.running, setting.reloaded)
+		}
+	}
+
+	conf.Listen = old.Listen
+	conf.Network = old.Network
+	conf.V4only = old.V4only
+	conf.V6only = old.V6only
+	conf.Prefork = old.Prefork
+	conf.AppName = old.AppName
+	conf.BodyLimit = old.BodyLimit
+	conf.ApiPrefix = old.ApiPrefix
+	conf.DbFile = old.DbFile
+	conf.StorageDir = old.StorageDir
+	conf.Ratelimit = old.Ratelimit
+	conf.Rates = old.Rates
+}
+
+// templates are parsed for every request, catch errors early
+func validateTemplates(conf *cfg.Config) error {
+	for name, page := range map[string]string{
+		"formpage":     conf.Formpage,
+		"passwordpage": conf.Passwordpage,
+		"downloadpage": conf.Downloadpage,
+	} {
+		if _, err := template.New(name).Parse(page); err != nil {
+			return fmt.Errorf("invalid %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+/*
+   Load and validate  the config  again and swap it in.  Requests  in
+   flight finish with the config they started with. If anything fails,
+   the running config stays active.
+*/
+func Reload(db *Db, load ConfigLoader) error {
+	old := db.Config()
+
+	conf, err := load()
+	if err != nil {
+		return err
+	}
+
+	keepStartupSettings(old, conf)
+
+	if err := validateTemplates(conf); err != nil {
+		return err
+	}
+
+	// the api contexts managed at runtime have to fit in
+	runtime, version, err := db.ContextsLoad()
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.ValidateContexts(append(append([]cfg.Apicontext{}, conf.Apicontexts...), runtime...)); err != nil {
+		return err
+	}
+
+	if err := SetupSigningKey(conf, db); err != nil {
+		return err
+	}
+
+	if conf.Jwks != "" {
+		if err := LoadJwks(conf); err != nil {
+			Warn("Unable to load jwks from %s: %s", conf.Jwks, err)
+		}
+	}
+
+	// all checks passed, from now on the new config is active
+	db.contexts.Lock()
+	conf.SetRuntimeContexts(runtime)
+	AuthSetApikeys(conf.Contexts())
+	db.SetConfig(conf)
+	db.contexts.version = version
+	db.contexts.loaded = true
+	db.contexts.Unlock()
+
+	SetupLogging(conf)
+
+	if !fiber.IsChild() {
+		WarnPlaintextKeys(conf)
+	}
+
+	return nil
+}
+
+// pids of the prefork child processes, see forwardReload()
+var preforkChildren = struct {
+	sync.Mutex
+	pids []int
+}{}
+
+// remember a prefork child, called by the parent after it started one
+func addPreforkChild(pid int) error {
+	preforkChildren.Lock()
+	defer preforkChildren.Unlock()
+
+	preforkChildren.pids = append(preforkChildren.pids, pid)
+
+	return nil
+}
+
+// let the prefork children reload as well, they have their own config
+func forwardReload() {
+	preforkChildren.Lock()
+	defer preforkChildren.Unlock()
+
+	for _, pid := range preforkChildren.pids {
+		proc, err := os.FindProcess(pid)
+		if err == nil {
+			err = proc.Signal(syscall.SIGHUP)
+		}
+
+		if err != nil {
+			Error("Unable to forward reload to process %d: %s", pid, err)
+		}
+	}
+}
+
+/*
+   Reload the config on SIGHUP until quit is closed. In prefork mode the
+   parent forwards the signal to the children after a successful reload.
+*/
+func ReloadOnSignal(db *Db, load ConfigLoader) chan bool {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	quit := make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case <-hup:
+				Info("Reloading config")
+				if err := Reload(db, load); err != nil {
+					Error("Unable to reload config, keeping the running one: %s", err)
+				} else {
+					Info("Config reloaded")
+					forwardReload()
+				}
+			case <-quit:
+				signal.Stop(hup)
+				return
+			}
+		}
+	}()
+
+	return quit
+}
@@ -0,0 +1,182 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+)
+
+func TestReload(t *testing.T) {
+	newConfig := func(formpage string, contexts ...cfg.Apicontext) *cfg.Config {
+		return &cfg.Config{
+			DbFile:      "reloadtest.db",
+			StorageDir:  ".",
+			Listen:      ":8080",
+			Formpage:    formpage,
+			Apicontexts: contexts,
+		}
+	}
+
+	c := newConfig("old", cfg.Apicontext{Context: "foo", Key: "fookey"})
+	if err := c.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply config defaults: " + err.Error())
+	}
+
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	auth := SetupAuthStore(c, db)
+	defer AuthSetApikeys(nil)
+
+	app := fiber.New()
+	app.Get("/", auth, func(ctx *fiber.Ctx) error {
+		return JsonStatus(ctx, fiber.StatusOK, "ok")
+	})
+
+	status := func(key string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Request failed: " + err.Error())
+		}
+
+		return resp.StatusCode
+	}
+
+	loader := func(conf *cfg.Config, err error) ConfigLoader {
+		return func() (*cfg.Config, error) {
+			if err != nil {
+				return nil, err
+			}
+			return conf, conf.ApplyDefaults()
+		}
+	}
+
+	// a runtime context, which must survive reloads
+	runtime := &cfg.Apicontext{Context: "rt", KeyHash: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"}
+	if err := db.ContextPut(runtime, true); err != nil {
+		t.Fatalf("Could not store runtime context: " + err.Error())
+	}
+
+	// settings requiring a restart are kept
+	reloaded := newConfig("new", cfg.Apicontext{Context: "bar", Key: "barkey"})
+	reloaded.Listen = ":9090"
+
+	var tests = []struct {
+		name     string
+		load     ConfigLoader
+		wantfail bool
+		formpage string
+	}{
+		{"load-error", loader(nil, errors.New("broken config file")), true, "old"},
+		{"invalid-template", loader(newConfig("{{ .Broken", cfg.Apicontext{Context: "bar", Key: "barkey"}), nil), true, "old"},
+		{"runtime-conflict", loader(newConfig("new", cfg.Apicontext{Context: "rt", Key: "rtkey"}), nil), true, "old"},
+		{"invalid-context", loader(newConfig("new", cfg.Apicontext{Context: "bar"}), nil), true, "old"},
+		{"reload", loader(reloaded, nil), false, "new"},
+	}
+
+	for _, tt := range tests {
+		err := Reload(db, tt.load)
+		if (err != nil) != tt.wantfail {
+			t.Errorf("%s: wantfail: %t, error: %v", tt.name, tt.wantfail, err)
+		}
+
+		if db.Config().Formpage != tt.formpage {
+			t.Errorf("%s: got formpage %q, want %q", tt.name, db.Config().Formpage, tt.formpage)
+		}
+	}
+
+	if db.Config().Listen != ":8080" {
+		t.Errorf("listen changed on reload: %s", db.Config().Listen)
+	}
+
+	// effective immediately
+	if status("fookey") != fiber.StatusForbidden {
+		t.Errorf("key of removed context still accepted")
+	}
+
+	if status("barkey") != fiber.StatusOK {
+		t.Errorf("key of new context not accepted")
+	}
+
+	if !db.Config().IsConfigContext("bar") || db.Config().ContextRole("rt") != cfg.RoleAdmin {
+		t.Errorf("config and runtime contexts not merged after reload")
+	}
+
+	// every setting which can't be reloaded is logged
+	limited := newConfig("new", cfg.Apicontext{Context: "bar", Key: "barkey"})
+	limited.Ratelimit.Uploads = "1/1m"
+
+	out := captureLog(&cfg.Config{LogLevel: cfg.LogInfo, LogFormat: cfg.LogText}, func() {
+		if err := Reload(db, loader(limited, nil)); err != nil {
+			t.Errorf("Could not reload: " + err.Error())
+		}
+	})
+
+	if !strings.Contains(out, "Setting ratelimit can't be reloaded") {
+		t.Errorf("no warning about the changed rate limit:\n%s", out)
+	}
+
+	if _, ok := db.Config().Rates[cfg.RateUploads]; ok {
+		t.Errorf("rate limit changed on reload")
+	}
+}
+
+func TestForwardReload(t *testing.T) {
+	child := exec.Command("sleep", "10")
+	if err := child.Start(); err != nil {
+		t.Skipf("Could not start child process: %s", err)
+	}
+
+	addPreforkChild(child.Process.Pid)
+	defer func() {
+		preforkChildren.pids = nil
+	}()
+
+	forwardReload()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- child.Wait()
+	}()
+
+	select {
+	case <-done:
+		status := child.ProcessState.Sys().(syscall.WaitStatus)
+		if !status.Signaled() || status.Signal() != syscall.SIGHUP {
+			t.Errorf("child exited with %s, want SIGHUP", child.ProcessState)
+		}
+	case <-time.After(5 * time.Second):
+		child.Process.Kill()
+		t.Errorf("child did not get the forwarded SIGHUP")
+	}
+}
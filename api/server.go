@@ -18,26 +18,28 @@ package api
 
 import (
 	"errors"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/compress"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/requestid"
-	"github.com/gofiber/fiber/v2/middleware/session"
 	"github.com/gofiber/keyauth/v2"
 	"github.com/tlinden/ephemerup/cfg"
 	"github.com/tlinden/ephemerup/common"
 )
 
-// sessions are context specific and can be global savely
-var Sessionstore *session.Store
-
 const shallExpire = true
 
-func Runserver(conf *cfg.Config, args []string) error {
-	// required for authenticated routes, used to store the api context
-	Sessionstore = session.New()
+func Runserver(conf *cfg.Config, args []string, load ConfigLoader) error {
+	SetupLogging(conf)
+
+	if !fiber.IsChild() {
+		if len(conf.ConfigFiles) > 0 {
+			Info("Loaded config from %s", strings.Join(conf.ConfigFiles, ", "))
+		}
+		Debug("Config: %+v", redactedConfig(conf))
+	}
 
 	// bbolt db setup
 	db, err := NewDb(conf)
@@ -46,126 +48,318 @@ func Runserver(conf *cfg.Config, args []string) error {
 	}
 	defer db.Close()
 
+	// key to sign download links with
+	if err := SetupSigningKey(conf, db); err != nil {
+		return err
+	}
+
+	// finish or roll back uploads interrupted by a crash
+	if !fiber.IsChild() {
+		if err := RecoverUploads(conf, db); err != nil {
+			return err
+		}
+	}
+
+	if !fiber.IsChild() {
+		WarnPlaintextKeys(conf)
+	}
+
+	// signing keys of jwt bearer tokens, retried on demand if unavailable
+	if conf.Jwks != "" {
+		if err := LoadJwks(conf); err != nil {
+			Warn("Unable to load jwks from %s: %s", conf.Jwks, err)
+		}
+	}
+
 	// setup authenticated endpoints
 	auth := SetupAuthStore(conf, db)
 
 	// setup api server
 	router := SetupServer(conf)
 
+	// count requests before anything may reject them
+	router.Use(MetricsMiddleware())
+
+	// rate limits, unlimited if not configured
+	router.Use(RateLimitIp(db, NewRateLimiter(conf, cfg.RateIp)))
+	limitUploads := RateLimitContext(NewRateLimiter(conf, cfg.RateUploads))
+	limitDownloads := RateLimitIp(db, NewRateLimiter(conf, cfg.RateDownloads))
+
 	// authenticated routes
 	api := router.Group(conf.ApiPrefix + ApiVersion)
 	{
 		// upload
-		api.Post("/uploads", auth, func(c *fiber.Ctx) error {
-			return UploadPost(c, conf, db)
+		api.Post("/uploads", auth, RequireScope(db, ScopeUpload, ScopeFormUpload), limitUploads, func(c *fiber.Ctx) error {
+			return UploadPost(c, db.Config(), db)
 		})
 
 		// remove
-		api.Delete("/uploads/:id", auth, func(c *fiber.Ctx) error {
-			err := UploadDelete(c, conf, db)
+		api.Delete("/uploads/:id", auth, RequireScope(db, ScopeDelete), func(c *fiber.Ctx) error {
+			err := UploadDelete(c, db.Config(), db)
 			return SendResponse(c, "", err)
 		})
 
 		// listing
-		api.Get("/uploads", auth, func(c *fiber.Ctx) error {
-			return UploadsList(c, conf, db)
+		api.Get("/uploads", auth, RequireScope(db, ScopeList), func(c *fiber.Ctx) error {
+			return UploadsList(c, db.Config(), db)
 		})
 
 		// info/describe
-		api.Get("/uploads/:id", auth, func(c *fiber.Ctx) error {
-			return UploadDescribe(c, conf, db)
+		api.Get("/uploads/:id", auth, RequireScope(db, ScopeList), func(c *fiber.Ctx) error {
+			return UploadDescribe(c, db.Config(), db)
 		})
 
 		// modify
-		api.Put("/uploads/:id", auth, func(c *fiber.Ctx) error {
-			return UploadModify(c, conf, db)
+		api.Put("/uploads/:id", auth, RequireScope(db, ScopeModify), func(c *fiber.Ctx) error {
+			return UploadModify(c, db.Config(), db)
 		})
 
 		// download w/o expire
-		api.Get("/uploads/:id/file", auth, func(c *fiber.Ctx) error {
-			return UploadFetch(c, conf, db)
+		api.Get("/uploads/:id/file", auth, RequireScope(db, ScopeDownload), func(c *fiber.Ctx) error {
+			return UploadFetch(c, db.Config(), db)
 		})
 
 		// same for forms ************
-		api.Post("/forms", auth, func(c *fiber.Ctx) error {
-			return FormCreate(c, conf, db)
+		api.Post("/forms", auth, RequireScope(db, ScopeForms), func(c *fiber.Ctx) error {
+			return FormCreate(c, db.Config(), db)
 		})
 
 		// remove
-		api.Delete("/forms/:id", auth, func(c *fiber.Ctx) error {
-			err := FormDelete(c, conf, db)
+		api.Delete("/forms/:id", auth, RequireScope(db, ScopeForms), func(c *fiber.Ctx) error {
+			err := FormDelete(c, db.Config(), db)
 			return SendResponse(c, "", err)
 		})
 
 		// listing
-		api.Get("/forms", auth, func(c *fiber.Ctx) error {
-			return FormsList(c, conf, db)
+		api.Get("/forms", auth, RequireScope(db, ScopeForms, ScopeList), func(c *fiber.Ctx) error {
+			return FormsList(c, db.Config(), db)
 		})
 
 		// info/describe
-		api.Get("/forms/:id", auth, func(c *fiber.Ctx) error {
-			return FormDescribe(c, conf, db)
+		api.Get("/forms/:id", auth, RequireScope(db, ScopeForms, ScopeList), func(c *fiber.Ctx) error {
+			return FormDescribe(c, db.Config(), db)
 		})
 
 		// modify
-		api.Put("/forms/:id", auth, func(c *fiber.Ctx) error {
-			return FormModify(c, conf, db)
+		api.Put("/forms/:id", auth, RequireScope(db, ScopeForms), func(c *fiber.Ctx) error {
+			return FormModify(c, db.Config(), db)
+		})
+
+		// signed download links
+		api.Post("/uploads/:id/links", auth, RequireScope(db, ScopeDownload), func(c *fiber.Ctx) error {
+			return LinkCreate(c, db.Config(), db)
+		})
+
+		api.Delete("/uploads/:id/links", auth, RequireScope(db, ScopeDownload), func(c *fiber.Ctx) error {
+			return LinkRevoke(c, db.Config(), db)
+		})
+
+		// api tokens
+		api.Post("/tokens", auth, RequireScope(db, ScopeTokens), func(c *fiber.Ctx) error {
+			return TokenCreate(c, db.Config(), db)
+		})
+
+		api.Get("/tokens", auth, RequireScope(db, ScopeTokens), func(c *fiber.Ctx) error {
+			return TokenList(c, db.Config(), db)
+		})
+
+		api.Delete("/tokens/:id", auth, RequireScope(db, ScopeTokens), func(c *fiber.Ctx) error {
+			return TokenRevoke(c, db.Config(), db)
+		})
+
+		// api contexts managed at runtime, super context only
+		api.Get("/contexts", auth, RequireScope(db, ScopeContexts), func(c *fiber.Ctx) error {
+			return ContextList(c, db.Config(), db)
+		})
+
+		api.Post("/contexts", auth, RequireScope(db, ScopeContexts), func(c *fiber.Ctx) error {
+			return ContextCreate(c, db.Config(), db)
+		})
+
+		api.Delete("/contexts/:name", auth, RequireScope(db, ScopeContexts), func(c *fiber.Ctx) error {
+			return ContextRemove(c, db.Config(), db)
+		})
+
+		api.Post("/contexts/:name/rotate", auth, RequireScope(db, ScopeContexts), func(c *fiber.Ctx) error {
+			return ContextRotate(c, db.Config(), db)
+		})
+
+		// audit log, super context and auditors only
+		api.Get("/audit", auth, RequireScope(db, ScopeAudit), func(c *fiber.Ctx) error {
+			return AuditList(c, db.Config(), db)
 		})
 	}
 
 	// public routes
 	{
 		router.Get("/", func(c *fiber.Ctx) error {
-			return c.Send([]byte(conf.Frontpage))
+			return c.Send([]byte(db.Config().Frontpage))
+		})
+
+		router.Get("/download/:id/:file", limitDownloads, func(c *fiber.Ctx) error {
+			return UploadFetch(c, db.Config(), db, shallExpire)
 		})
 
-		router.Get("/download/:id/:file", func(c *fiber.Ctx) error {
-			return UploadFetch(c, conf, db, shallExpire)
+		router.Get("/download/:id", limitDownloads, func(c *fiber.Ctx) error {
+			return UploadFetch(c, db.Config(), db, shallExpire)
 		})
 
-		router.Get("/download/:id", func(c *fiber.Ctx) error {
-			return UploadFetch(c, conf, db, shallExpire)
+		// password protected downloads, the password is being posted
+		router.Post("/download/:id/:file", limitDownloads, func(c *fiber.Ctx) error {
+			return UploadFetch(c, db.Config(), db, shallExpire)
 		})
 
-		router.Get("/form/:id", func(c *fiber.Ctx) error {
-			return FormPage(c, conf, db, shallExpire)
+		router.Post("/download/:id", limitDownloads, func(c *fiber.Ctx) error {
+			return UploadFetch(c, db.Config(), db, shallExpire)
+		})
+
+		// signed download links, GET to download, POST to send a password
+		router.Get("/link/:token/:file", limitDownloads, func(c *fiber.Ctx) error {
+			return UploadFetch(c, db.Config(), db, shallExpire)
+		})
+
+		router.Get("/link/:token", limitDownloads, func(c *fiber.Ctx) error {
+			return UploadFetch(c, db.Config(), db, shallExpire)
+		})
+
+		router.Post("/link/:token/:file", limitDownloads, func(c *fiber.Ctx) error {
+			return UploadFetch(c, db.Config(), db, shallExpire)
+		})
+
+		router.Post("/link/:token", limitDownloads, func(c *fiber.Ctx) error {
+			return UploadFetch(c, db.Config(), db, shallExpire)
+		})
+
+		router.Get("/form/:id", limitDownloads, func(c *fiber.Ctx) error {
+			return FormPage(c, db.Config(), db, shallExpire)
 		})
 
 		router.Get("/status", func(c *fiber.Ctx) error {
-			return Status(c, conf)
+			return Status(c, db.Config())
+		})
+
+		// protected by its own token, if configured
+		router.Get("/metrics", func(c *fiber.Ctx) error {
+			return MetricsHandler(c, db.Config(), db)
 		})
 	}
 
-	// setup cleaner
-	quitcleaner := BackgroundCleaner(conf, db)
+	// reload the config on SIGHUP, the parent forwards it to the children
+	router.Hooks().OnFork(addPreforkChild)
+	quitreload := ReloadOnSignal(db, load)
 
 	router.Hooks().OnShutdown(func() error {
-		Log("Shutting down cleaner")
-		close(quitcleaner)
+		close(quitreload)
 		return nil
 	})
 
+	// setup cleaner, in prefork mode only the parent process runs it
+	if !fiber.IsChild() {
+		quitcleaner := BackgroundCleaner(conf, db)
+
+		router.Hooks().OnShutdown(func() error {
+			Info("Shutting down cleaner")
+			close(quitcleaner)
+			return nil
+		})
+	}
+
+	if !fiber.IsChild() {
+		Info("Listening on %s", conf.Listen)
+	}
+
 	return router.Listen(conf.Listen)
 }
 
 func SetupAuthStore(conf *cfg.Config, db *Db) func(*fiber.Ctx) error {
-	AuthSetApikeys(conf.Apicontexts)
+	// merges the api contexts created at runtime, if any
+	if err := SyncContexts(conf, db); err != nil {
+		Warn("Unable to load api contexts: %s", err)
+		AuthSetApikeys(conf.Contexts())
+	}
+
+	authfail := NewRateLimiter(conf, cfg.RateAuthFail)
+	perContext := NewRateLimiter(conf, cfg.RateContext)
+
+	validate := func(c *fiber.Ctx, key string) (bool, error) {
+		conf := db.Config()
+
+		// pick up api contexts changed by another process, usually without
+		// opening the database, see ContextsVersion()
+		if err := SyncContexts(conf, db); err != nil {
+			LogFor(c).Warn("Unable to sync api contexts: %s", err)
+		}
+
+		// bearer tokens issued by the identity provider
+		if conf.Jwks != "" && looksLikeJwt(key) {
+			return AuthValidateJwt(c, conf, key)
+		}
+
+		// we use a wrapper closure to be able to forward the db object
+		formuser, err := AuthValidateOnetimeKey(c, key, db)
+
+		// form exists, but the client is not allowed to use it
+		if err == errDenied {
+			return false, err
+		}
+
+		// incoming apicontext matches a form id, accept it
+		if err == nil {
+			LogFor(c).Debug("Incoming API Context equals formuser: %t", formuser)
+			return formuser, err
+		}
+
+		// api tokens minted using the api, a cheap lookup by hash
+		if valid, err := AuthValidateToken(c, conf, db, key); err != ErrTokenUnknown {
+			return valid, err
+		}
+
+		// last resort: the configured apicontexts, argon2id hashes are expensive
+		return AuthValidateAPIKey(c, conf, key)
+	}
 
 	return keyauth.New(keyauth.Config{
 		Validator: func(c *fiber.Ctx, key string) (bool, error) {
-			// we use a wrapper closure to be able to forward the db object
-			formuser, err := AuthValidateOnetimeKey(c, key, db)
+			conf := db.Config()
+
+			// too many failed attempts, don't even look at the key
+			if authfail != nil {
+				status := authfail.Peek(ClientIP(c, conf))
+				if !status.allowed {
+					setRateHeaders(c, authfail, status)
+					return false, errRateLimited
+				}
+			}
 
-			// incoming apicontext matches a form id, accept it
-			if err == nil {
-				Log("Incoming API Context equals formuser: %t, id: %s", formuser, key)
-				return formuser, err
+			valid, err := validate(c, key)
+			if valid && err == nil && !perContext.Allow(c, GetPrincipal(c).Context) {
+				return false, errRateLimited
 			}
 
-			// nope, we need to check against regular configured apicontexts
-			return AuthValidateAPIKey(c, key)
+			return valid, err
+		},
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			conf := db.Config()
+
+			if err == errRateLimited {
+				return rateLimited(c)
+			}
+
+			// each failure counts against the client ip
+			if authfail != nil {
+				authfail.Take(ClientIP(c, conf))
+			}
+
+			// never log the presented key, just the reason
+			if err == errDenied {
+				metricAuthFailures.Inc("denied")
+				Audit(c, db, AuditDenied, "", "", "", "client ip not in allowlist")
+			} else {
+				metricAuthFailures.Inc("invalid")
+				Audit(c, db, AuditAuthFail, "", "", "", err.Error())
+			}
+			return AuthErrHandler(c, err)
 		},
-		ErrorHandler: AuthErrHandler,
 	})
 }
 
@@ -179,21 +373,32 @@ func SetupServer(conf *cfg.Config) *fiber.App {
 		AppName:       conf.AppName,
 		BodyLimit:     conf.BodyLimit,
 		Network:       conf.Network,
+
+		// the banner would break json logs
+		DisableStartupMessage: conf.LogFormat == cfg.LogJson,
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			// always respond with JSON, even to fiber.NewError()
+			return SendResponse(c, "", err)
+		},
 	})
 
 	router.Use(requestid.New())
 
-	router.Use(logger.New(logger.Config{
-		Format: "${pid} ${locals:requestid} ${status} - ${method} ${path}​\n",
-	}))
+	router.Use(RequestLogger())
 
 	router.Use(cors.New(cors.Config{
 		AllowMethods:  "GET,PUT,POST,DELETE",
-		ExposeHeaders: "Content-Type,Authorization,Accept",
+		ExposeHeaders: "Content-Type,Authorization,Accept,RateLimit-Limit,RateLimit-Remaining,RateLimit-Reset,Retry-After",
 	}))
 
 	router.Use(compress.New(compress.Config{
 		Level: compress.LevelBestSpeed,
+
+		// counted downloads are sent as is, compression would hide
+		// how many bytes actually reached the client
+		Next: func(c *fiber.Ctx) bool {
+			return strings.HasPrefix(c.Path(), "/download/") || strings.HasPrefix(c.Path(), "/link/")
+		},
 	}))
 
 	return router
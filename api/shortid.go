@@ -0,0 +1,311 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+// maps short ids to the uuid of the upload or form
+const ShortIdBucket string = "shortids"
+
+// id styles, configurable per api context
+const (
+	IdStyleUUID   = "uuid"
+	IdStyleWords  = "words"
+	IdStyleBase32 = "base32"
+)
+
+// number of attempts to find an unused short id
+const shortIdAttempts = 16
+
+/*
+   Short ids are bearer secrets just like uuids, anyone knowing one can
+   download. 6 words are 48 bits, 11 base32 characters 55 bits.
+*/
+const (
+	shortIdWordCount    = 6
+	shortIdBase32Length = 11
+)
+
+var regUUID = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+/*
+   Crockford's base32 alphabet, it omits I, L, O and U, which are easily
+   confused with other characters (or words).
+*/
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// 256 easy to spell words with 4 letters each, see shortIdWordCount
+var shortIdWords = []string{
+	"able", "acid", "aged", "also", "area", "army", "away", "baby", "back",
+	"ball", "band", "bank", "base", "bath", "bear", "beat", "bell", "belt",
+	"best", "bird", "blow", "blue", "boat", "body", "bone", "book", "boot",
+	"born", "boss", "both", "bowl", "bulk", "burn", "bush", "busy", "cafe",
+	"cake", "calm", "came", "camp", "card", "care", "cart", "case", "cash",
+	"cast", "cell", "chef", "chip", "city", "clay", "club", "coal", "coat",
+	"code", "coin", "cold", "come", "cook", "cool", "copy", "cord", "corn",
+	"cost", "crew", "crop", "cube", "cure", "dark", "data", "date", "dawn",
+	"deal", "dear", "deep", "deer", "desk", "dial", "diet", "dirt", "dish",
+	"dock", "door", "dose", "down", "draw", "drop", "drum", "duck", "dust",
+	"duty", "earn", "east", "easy", "edge", "exit", "face", "fact", "fair",
+	"farm", "fast", "fear", "feed", "feel", "fern", "file", "film", "fine",
+	"fire", "firm", "fish", "flag", "flat", "flow", "fold", "folk", "food",
+	"foot", "fork", "form", "fort", "four", "free", "frog", "fuel", "full",
+	"fund", "gain", "game", "gate", "gear", "gift", "girl", "glad", "glow",
+	"goal", "gold", "golf", "good", "gray", "grid", "grow", "gulf", "hair",
+	"half", "hall", "hand", "hard", "harp", "hawk", "head", "heat", "herb",
+	"hero", "high", "hill", "hint", "hold", "hole", "home", "hook", "hope",
+	"horn", "host", "hour", "huge", "hunt", "idea", "inch", "iron", "item",
+	"jazz", "join", "joke", "jump", "jury", "keen", "keep", "kind", "king",
+	"kite", "knee", "knot", "lake", "lamp", "land", "lane", "last", "lawn",
+	"lead", "leaf", "lean", "left", "lens", "life", "lift", "lime", "line",
+	"lion", "list", "load", "loan", "lock", "loft", "long", "loop", "lord",
+	"loud", "love", "luck", "lung", "mail", "main", "make", "mall", "many",
+	"mark", "mask", "meal", "meat", "mild", "milk", "mill", "mind", "mint",
+	"mode", "mood", "moon", "moss", "most", "move", "much", "nail", "name",
+	"navy", "near", "neat", "neck", "nest", "news", "nice", "nine", "node",
+	"noon", "nose", "note", "yard", "oven", "pack", "page", "pair", "palm",
+	"park", "part", "path", "peak",
+}
+
+func randomInt(max int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n.Int64()), nil
+}
+
+// e.g. "lake-moon-fern-gold-hawk-mint"
+func newWordId() (string, error) {
+	words := make([]string, shortIdWordCount)
+
+	for i := range words {
+		n, err := randomInt(len(shortIdWords))
+		if err != nil {
+			return "", err
+		}
+		words[i] = shortIdWords[n]
+	}
+
+	return strings.Join(words, "-"), nil
+}
+
+/*
+   Checksum character of a base32 id. Every character is weighted with
+   an odd  number, so  that any  single wrong  character and  most
+   swapped neighbours are detected.
+*/
+func crockfordCheck(id string) byte {
+	sum := 0
+	for i := 0; i < len(id); i++ {
+		sum += (2*i + 1) * strings.IndexByte(crockford, id[i])
+	}
+
+	return crockford[sum%len(crockford)]
+}
+
+// e.g. "7K3M-Q9PX-RD2F", 11 random characters plus a check character
+func newBase32Id() (string, error) {
+	id := make([]byte, shortIdBase32Length)
+
+	for i := range id {
+		n, err := randomInt(len(crockford))
+		if err != nil {
+			return "", err
+		}
+		id[i] = crockford[n]
+	}
+
+	full := string(id) + string(crockfordCheck(string(id)))
+
+	return full[0:4] + "-" + full[4:8] + "-" + full[8:12], nil
+}
+
+/*
+   Normalize a  short id as  typed by a  human: case and  dashes don't
+   matter, characters looking similar are mapped to their base32
+   counterpart. Returns an error if the checksum doesn't match.
+*/
+func normalizeBase32Id(id string) (string, error) {
+	id = strings.ToUpper(strings.ReplaceAll(id, "-", ""))
+	id = strings.NewReplacer("I", "1", "L", "1", "O", "0").Replace(id)
+
+	if len(id) != shortIdBase32Length+1 {
+		return "", errors.New("invalid short id length")
+	}
+
+	for i := 0; i < len(id); i++ {
+		if strings.IndexByte(crockford, id[i]) < 0 {
+			return "", errors.New("invalid short id character")
+		}
+	}
+
+	if crockfordCheck(id[:len(id)-1]) != id[len(id)-1] {
+		return "", errors.New("short id checksum mismatch")
+	}
+
+	return id, nil
+}
+
+// the key under which a short id is stored
+func shortIdKey(shortid string) string {
+	if normalized, err := normalizeBase32Id(shortid); err == nil {
+		return normalized
+	}
+
+	return strings.ToLower(shortid)
+}
+
+/*
+   Allocate a short id for the given uuid using the given style. The
+   id is reserved within a single transaction, so it is unique. Returns
+   an empty string for the uuid style.
+*/
+func (db *Db) AllocateShortId(style string, id string) (string, error) {
+	var generate func() (string, error)
+
+	switch style {
+	case IdStyleWords:
+		generate = newWordId
+	case IdStyleBase32:
+		generate = newBase32Id
+	default:
+		return "", nil
+	}
+
+	var shortid string
+
+	err := db.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(ShortIdBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+
+		for i := 0; i < shortIdAttempts; i++ {
+			candidate, err := generate()
+			if err != nil {
+				return err
+			}
+
+			if bucket.Get([]byte(shortIdKey(candidate))) == nil {
+				shortid = candidate
+				return bucket.Put([]byte(shortIdKey(candidate)), []byte(id))
+			}
+		}
+
+		return errors.New("unable to find an unused short id")
+	})
+
+	if err != nil {
+		Error("DB error: %s", err.Error())
+	}
+
+	return shortid, err
+}
+
+// remove a short id within an already running transaction
+func deleteShortId(tx *bolt.Tx, j []byte) error {
+	var entry struct {
+		ShortId string `json:"shortid"`
+	}
+
+	if err := json.Unmarshal(j, &entry); err != nil || entry.ShortId == "" {
+		return nil
+	}
+
+	bucket := tx.Bucket([]byte(ShortIdBucket))
+	if bucket == nil {
+		return nil
+	}
+
+	return bucket.Delete([]byte(shortIdKey(entry.ShortId)))
+}
+
+// give back a short id of an object which has never been stored
+func (db *Db) ReleaseShortId(shortid string) {
+	if shortid == "" {
+		return
+	}
+
+	err := db.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(ShortIdBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.Delete([]byte(shortIdKey(shortid)))
+	})
+
+	if err != nil {
+		Error("Failed to release short id %s: %s", shortid, err.Error())
+	}
+}
+
+/*
+   Return the uuid of a  short id. Uuids and unknown ids are returned
+   unchanged, the caller will not find them anyway.
+*/
+func (db *Db) ResolveId(id string) string {
+	if id == "" || regUUID.MatchString(id) {
+		return id
+	}
+
+	resolved := id
+
+	err := db.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(ShortIdBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		if uuid := bucket.Get([]byte(shortIdKey(id))); uuid != nil {
+			resolved = string(uuid)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		Error("DB error: %s", err.Error())
+	}
+
+	return resolved
+}
+
+// untaint the id parameter of a request and resolve short ids
+func ParamId(c *fiber.Ctx, conf *cfg.Config, db *Db) (string, error) {
+	id, err := common.Untaint(c.Params("id"), conf.RegKey)
+	if err != nil {
+		return "", err
+	}
+
+	return db.ResolveId(id), nil
+}
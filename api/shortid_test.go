@@ -0,0 +1,127 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+)
+
+func TestShortIds(t *testing.T) {
+	c := &cfg.Config{DbFile: "shortidtest.db"}
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	id := "cc2c965a-64b5-4b09-9f8b-61e4f1b1c7a1"
+
+	var tests = []struct {
+		name  string
+		style string
+	}{
+		{"words", IdStyleWords},
+		{"base32", IdStyleBase32},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shortid, err := db.AllocateShortId(tt.style, id)
+			if err != nil || shortid == "" {
+				t.Fatalf("Could not allocate short id: %v", err)
+			}
+
+			// short ids are bearer secrets, at least 48 random bits
+			if tt.style == IdStyleWords && len(strings.Split(shortid, "-")) != shortIdWordCount {
+				t.Errorf("short id %s doesn't consist of %d words", shortid, shortIdWordCount)
+			}
+
+			if tt.style == IdStyleBase32 && len(strings.ReplaceAll(shortid, "-", "")) != shortIdBase32Length+1 {
+				t.Errorf("short id %s doesn't consist of %d characters", shortid, shortIdBase32Length+1)
+			}
+
+			// as typed by a human: uppercased, without dashes
+			typed := strings.ToUpper(strings.ReplaceAll(shortid, "-", ""))
+			if tt.style == IdStyleWords {
+				typed = strings.ToUpper(shortid)
+			}
+
+			for _, variant := range []string{shortid, typed} {
+				if resolved := db.ResolveId(variant); resolved != id {
+					t.Errorf("%s resolved to %s, want %s", variant, resolved, id)
+				}
+			}
+		})
+	}
+
+	if shortid, _ := db.AllocateShortId(IdStyleUUID, id); shortid != "" {
+		t.Errorf("uuid style allocated short id %s", shortid)
+	}
+
+	if resolved := db.ResolveId(id); resolved != id {
+		t.Errorf("uuid resolved to %s", resolved)
+	}
+
+	// deleting an entry removes its short id
+	shortid, _ := db.AllocateShortId(IdStyleBase32, id)
+	upload := &common.Upload{Id: id, ShortId: shortid, Type: common.TypeUpload}
+	if err := db.Insert(id, upload); err != nil {
+		t.Fatalf("Could not insert upload: " + err.Error())
+	}
+
+	if err := db.Delete("", id); err != nil {
+		t.Fatalf("Could not delete upload: " + err.Error())
+	}
+
+	if resolved := db.ResolveId(shortid); resolved != shortid {
+		t.Errorf("short id %s still resolves to %s after deletion", shortid, resolved)
+	}
+}
+
+func TestBase32Checksum(t *testing.T) {
+	shortid, err := newBase32Id()
+	if err != nil {
+		t.Fatalf("Could not create short id: " + err.Error())
+	}
+
+	if _, err := normalizeBase32Id(shortid); err != nil {
+		t.Errorf("valid id %s rejected: %s", shortid, err.Error())
+	}
+
+	// shorter ids with a valid checksum are too easy to guess
+	short := "7K3MQ9PX"
+	if _, err := normalizeBase32Id(short + string(crockfordCheck(short))); err == nil {
+		t.Errorf("short id %s accepted", short)
+	}
+
+	// change every single character, the checksum must catch it
+	normalized := strings.ReplaceAll(shortid, "-", "")
+	for i := 0; i < len(normalized); i++ {
+		typo := []byte(normalized)
+		pos := strings.IndexByte(crockford, typo[i])
+		typo[i] = crockford[(pos+1)%len(crockford)]
+
+		if _, err := normalizeBase32Id(string(typo)); err == nil {
+			t.Errorf("typo %s of %s not detected", typo, shortid)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+// api tokens, key is the sha256 hash of the token secret
+const TokenBucket string = "tokens"
+
+// used if the client doesn't specify an expire setting
+const DefaultTokenExpire = "30d"
+
+// scopes which can be granted to api tokens
+var TokenScopes = []string{ScopeUpload, ScopeModify, ScopeList, ScopeDownload, ScopeDelete, ScopeForms}
+
+var (
+	ErrTokenUnknown = errors.New("unknown api token")
+	ErrTokenExpired = errors.New("api token expired")
+	ErrTokenRevoked = errors.New("api context of the token lost its permissions")
+)
+
+// incoming token request
+type TokenRequest struct {
+	Label  string   `json:"label" form:"label"`
+	Scopes []string `json:"scopes" form:"scopes"`
+	Expire string   `json:"expire" form:"expire"` // duration or date, default: DefaultTokenExpire
+}
+
+func tokenKey(secret string) []byte {
+	hash := sha256.Sum256([]byte(secret))
+	return []byte(hex.EncodeToString(hash[:]))
+}
+
+// validate the requested scopes, at least one is required
+func untaintScopes(scopes []string) ([]string, error) {
+	normalized := []string{}
+
+	for _, entry := range scopes {
+		for _, scope := range strings.Split(entry, ",") {
+			scope = strings.ToLower(strings.TrimSpace(scope))
+			if scope == "" {
+				continue
+			}
+
+			valid := false
+			for _, allowed := range TokenScopes {
+				if scope == allowed {
+					valid = true
+					break
+				}
+			}
+
+			if !valid {
+				return nil, fmt.Errorf("unknown scope %s, allowed: %s", scope, strings.Join(TokenScopes, ", "))
+			}
+
+			normalized = append(normalized, scope)
+		}
+	}
+
+	if len(normalized) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+
+	return normalized, nil
+}
+
+/*
+   Create a new token.  Only the hash of the secret is stored, so the
+   secret is only part of the returned token.
+*/
+func (db *Db) TokenCreate(token *common.Token) error {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+
+	secret := hex.EncodeToString(random)
+
+	err := db.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(TokenBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+
+		jsonentry, err := json.Marshal(token)
+		if err != nil {
+			return fmt.Errorf("json marshalling failure: %s", err)
+		}
+
+		return bucket.Put(tokenKey(secret), jsonentry)
+	})
+
+	if err != nil {
+		Error("DB error: %s", err.Error())
+		return err
+	}
+
+	token.Secret = secret
+
+	return nil
+}
+
+// find the token of a secret, expired tokens are rejected
+func (db *Db) TokenLookup(secret string) (*common.Token, error) {
+	token := &common.Token{}
+
+	err := db.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(TokenBucket))
+		if bucket == nil {
+			return ErrTokenUnknown
+		}
+
+		j := bucket.Get(tokenKey(secret))
+		if j == nil {
+			return ErrTokenUnknown
+		}
+
+		if err := json.Unmarshal(j, token); err != nil {
+			return fmt.Errorf("unable to unmarshal json: %s", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !time.Now().Before(token.ExpiresAt.Time) {
+		return nil, ErrTokenExpired
+	}
+
+	return token, nil
+}
+
+// iterate over all tokens, delete those for which fn returns true
+func (db *Db) tokenWalk(fn func(token *common.Token) bool) error {
+	return db.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(TokenBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		remove := [][]byte{}
+		err := bucket.ForEach(func(k, j []byte) error {
+			token := &common.Token{}
+			if err := json.Unmarshal(j, token); err != nil {
+				return fmt.Errorf("unable to unmarshal json: %s", err)
+			}
+
+			if fn(token) {
+				remove = append(remove, append([]byte{}, k...))
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range remove {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// list the tokens of a context, all of them for the super context
+func (db *Db) TokenList(apicontext string) ([]*common.Token, error) {
+	tokens := []*common.Token{}
+
+	err := db.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(TokenBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, j []byte) error {
+			token := &common.Token{}
+			if err := json.Unmarshal(j, token); err != nil {
+				return fmt.Errorf("unable to unmarshal json: %s", err)
+			}
+
+			if apicontext == "" || token.Context == apicontext {
+				tokens = append(tokens, token)
+			}
+
+			return nil
+		})
+	})
+
+	return tokens, err
+}
+
+// delete a token of a context, any token if apicontext is empty
+func (db *Db) TokenRevoke(apicontext, id string) (*common.Token, error) {
+	var revoked *common.Token
+
+	err := db.tokenWalk(func(token *common.Token) bool {
+		if token.Id == id && (apicontext == "" || token.Context == apicontext) {
+			revoked = token
+			return true
+		}
+		return false
+	})
+
+	if err == nil && revoked == nil {
+		err = fmt.Errorf("token %s not found", id)
+	}
+
+	return revoked, err
+}
+
+// remove expired tokens, called by the background cleaner
+func DeleteExpiredTokens(db *Db) error {
+	now := time.Now()
+
+	return db.tokenWalk(func(token *common.Token) bool {
+		if !now.Before(token.ExpiresAt.Time) {
+			Info("Cleaned up expired api token %s", token.Id)
+			metricDeletions.Inc(AuditToken)
+			return true
+		}
+		return false
+	})
+}
+
+// validator hook, checks the incoming key against the minted api tokens
+func AuthValidateToken(c *fiber.Ctx, conf *cfg.Config, db *Db, key string) (bool, error) {
+	token, err := db.TokenLookup(key)
+	if err != nil {
+		return false, err
+	}
+
+	if !ClientAllowed(c, conf, conf.ContextAllow(token.Context)) {
+		return false, errDenied
+	}
+
+	// the role of the context may have changed since the token was minted
+	scopes := []string{}
+	for _, scope := range token.Scopes {
+		if ContextAllowed(conf, token.Context, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	if len(scopes) == 0 {
+		return false, ErrTokenRevoked
+	}
+
+	SetPrincipal(c, &Principal{Context: token.Context, Scopes: scopes})
+
+	return true, nil
+}
+
+// mint a new api token for the context of the caller
+func TokenCreate(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
+	// the API Context the request has been authenticated for
+	apicontext := GetPrincipal(c).Context
+
+	tokendata := new(TokenRequest)
+	if err := c.BodyParser(tokendata); err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Unable to parse body: "+err.Error())
+	}
+
+	if err := untaintField(c, &tokendata.Label, cfg.RegText, "label"); err != nil {
+		return err
+	}
+
+	scopes, err := untaintScopes(tokendata.Scopes)
+	if err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Invalid scopes provided: "+err.Error())
+	}
+
+	// tokens can't have more permissions than their creator
+	for _, scope := range scopes {
+		if !GetPrincipal(c).Allowed(scope) {
+			return JsonStatus(c, fiber.StatusForbidden,
+				"Invalid scopes provided: scope "+scope+" not granted to the api context!")
+		}
+	}
+
+	if tokendata.Expire == "" {
+		tokendata.Expire = DefaultTokenExpire
+	}
+
+	if err := untaintExpire(c, cfg, &tokendata.Expire); err != nil {
+		return err
+	}
+
+	if tokendata.Expire == "asap" {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Invalid expire data provided: tokens require a duration or a date!")
+	}
+
+	now := time.Now()
+	token := &common.Token{
+		Id:        uuid.NewString(),
+		Label:     tokendata.Label,
+		Context:   apicontext,
+		Scopes:    scopes,
+		Created:   common.Timestamp{Time: now},
+		ExpiresAt: common.Timestamp{Time: ExpiresAt(cfg, now, tokendata.Expire)},
+	}
+
+	if err := db.TokenCreate(token); err != nil {
+		return JsonStatus(c, fiber.StatusInternalServerError,
+			"Unable to create token: "+err.Error())
+	}
+
+	Audit(c, db, AuditCreate, AuditToken, token.Id, apicontext,
+		fmt.Sprintf("label: %s, scopes: %s, expires: %s", token.Label,
+			strings.Join(token.Scopes, ","), token.ExpiresAt.Format(time.RFC3339)))
+
+	res := &common.Response{Tokens: []*common.Token{token}}
+	res.Success = true
+	res.Code = fiber.StatusOK
+	return c.Status(fiber.StatusOK).JSON(res)
+}
+
+// list the api tokens of the context of the caller, without secrets
+func TokenList(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
+	apicontext := GetPrincipal(c).Context
+
+	filter := apicontext
+	if IsSuper(cfg, apicontext) {
+		filter = ""
+	}
+
+	tokens, err := db.TokenList(filter)
+	if err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Unable to list tokens: "+err.Error())
+	}
+
+	res := &common.Response{Tokens: tokens}
+	res.Success = true
+	res.Code = fiber.StatusOK
+	return c.Status(fiber.StatusOK).JSON(res)
+}
+
+// revoke an api token, the super context may revoke any token
+func TokenRevoke(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
+	apicontext := GetPrincipal(c).Context
+
+	id, err := common.Untaint(c.Params("id"), cfg.RegKey)
+	if err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Invalid id provided!")
+	}
+
+	filter := apicontext
+	if IsSuper(cfg, apicontext) {
+		filter = ""
+	}
+
+	token, err := db.TokenRevoke(filter, id)
+	if err != nil {
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Unable to revoke token: "+err.Error())
+	}
+
+	Audit(c, db, AuditDelete, AuditToken, id, token.Context, "label: "+token.Label)
+
+	return JsonStatus(c, fiber.StatusOK, "Token "+id+" has been revoked")
+}
@@ -0,0 +1,179 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+)
+
+func TestTokens(t *testing.T) {
+	c := &cfg.Config{DbFile: "tokentest.db"}
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	now := time.Now()
+	valid := &common.Token{Id: "1", Context: "foo", Scopes: []string{ScopeList},
+		ExpiresAt: common.Timestamp{Time: now.Add(time.Hour)}}
+	expired := &common.Token{Id: "2", Context: "bar", Scopes: []string{ScopeList},
+		ExpiresAt: common.Timestamp{Time: now.Add(-time.Hour)}}
+
+	for _, token := range []*common.Token{valid, expired} {
+		if err := db.TokenCreate(token); err != nil {
+			t.Fatalf("Could not create token: " + err.Error())
+		}
+	}
+
+	if token, err := db.TokenLookup(valid.Secret); err != nil || token.Id != valid.Id {
+		t.Errorf("Could not lookup valid token: %v", err)
+	}
+
+	if _, err := db.TokenLookup(expired.Secret); err != ErrTokenExpired {
+		t.Errorf("expected ErrTokenExpired, got: %v", err)
+	}
+
+	if _, err := db.TokenLookup("nonexistent"); err != ErrTokenUnknown {
+		t.Errorf("expected ErrTokenUnknown, got: %v", err)
+	}
+
+	// the secret is never stored
+	tokens, err := db.TokenList("foo")
+	if err != nil || len(tokens) != 1 || tokens[0].Secret != "" {
+		t.Errorf("unexpected token list for context foo: %v", err)
+	}
+
+	if _, err := db.TokenRevoke("foo", expired.Id); err == nil {
+		t.Errorf("revoked the token of another context")
+	}
+
+	if err := DeleteExpiredTokens(db); err != nil {
+		t.Errorf("Could not delete expired tokens: " + err.Error())
+	}
+
+	if tokens, _ := db.TokenList(""); len(tokens) != 1 {
+		t.Errorf("got %d tokens after cleanup, want 1", len(tokens))
+	}
+
+	if _, err := db.TokenRevoke("foo", valid.Id); err != nil {
+		t.Errorf("Could not revoke token: " + err.Error())
+	}
+
+	if _, err := db.TokenLookup(valid.Secret); err != ErrTokenUnknown {
+		t.Errorf("revoked token still valid: %v", err)
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	c := &cfg.Config{
+		DbFile:      "tokenscopetest.db",
+		Apicontexts: []cfg.Apicontext{{Context: "foo", Key: "fookey"}},
+	}
+
+	if err := c.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply config defaults: " + err.Error())
+	}
+
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	auth := SetupAuthStore(c, db)
+	defer AuthSetApikeys(nil)
+
+	app := fiber.New()
+	app.Post("/tokens", auth, RequireScope(db, ScopeTokens), func(ctx *fiber.Ctx) error {
+		return TokenCreate(ctx, c, db)
+	})
+	app.Get("/uploads", auth, RequireScope(db, ScopeList), func(ctx *fiber.Ctx) error {
+		return ctx.SendString(GetPrincipal(ctx).Context)
+	})
+	app.Delete("/uploads/:id", auth, RequireScope(db, ScopeDelete), func(ctx *fiber.Ctx) error {
+		return ctx.SendString("deleted")
+	})
+
+	request := func(method, path, key, body string) (int, *common.Response) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Request failed: " + err.Error())
+		}
+
+		response := &common.Response{}
+		json.NewDecoder(resp.Body).Decode(response)
+
+		return resp.StatusCode, response
+	}
+
+	status, response := request("POST", "/tokens", "fookey",
+		`{"label":"ci","scopes":["list","upload"],"expire":"1d"}`)
+	if status != fiber.StatusOK || len(response.Tokens) != 1 {
+		t.Fatalf("Could not create token: %d %s", status, response.Message)
+	}
+
+	secret := response.Tokens[0].Secret
+
+	var tests = []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		body   string
+		status int
+	}{
+		{"list", "GET", "/uploads", secret, "", fiber.StatusOK},
+		{"delete-without-scope", "DELETE", "/uploads/1", secret, "", fiber.StatusForbidden},
+		{"mint-with-token", "POST", "/tokens", secret, `{"scopes":["list"]}`, fiber.StatusForbidden},
+		{"invalid-scope", "POST", "/tokens", "fookey", `{"scopes":["tokens"]}`, fiber.StatusForbidden},
+		{"no-scope", "POST", "/tokens", "fookey", `{"label":"none"}`, fiber.StatusForbidden},
+		{"unknown-token", "GET", "/uploads", "nonexistent", "", fiber.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, _ := request(tt.method, tt.path, tt.key, tt.body); status != tt.status {
+				t.Errorf("got status %d, want %d", status, tt.status)
+			}
+		})
+	}
+
+	// tokens are looked up before the expensive api key verification
+	if keyRejected(sha256.Sum256([]byte(secret))) {
+		t.Errorf("token has been checked against the api keys")
+	}
+
+	if !keyRejected(sha256.Sum256([]byte("nonexistent"))) {
+		t.Errorf("unknown key has not been remembered as rejected")
+	}
+}
@@ -23,10 +23,14 @@ import (
 	"github.com/tlinden/ephemerup/cfg"
 	"github.com/tlinden/ephemerup/common"
 
+	"bytes"
 	"fmt"
+	"html/template"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,6 +39,20 @@ type SetContext struct {
 	Query      string `json:"query" form:"query"`
 }
 
+// untaint the api context filter of list requests, see matchContextFilter()
+func untaintContextFilter(cfg *cfg.Config, filter string) (string, error) {
+	apicontext, err := common.Untaint(strings.TrimSuffix(filter, ContextSubtree), cfg.RegKey)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasSuffix(filter, ContextSubtree) {
+		return apicontext + ContextSubtree, nil
+	}
+
+	return apicontext, nil
+}
+
 func UploadPost(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 	// supports upload of multiple files with:
 	//
@@ -48,16 +66,17 @@ func UploadPost(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 	//
 	// Returns the  name of the uploaded file.
 
+	atomic.AddInt64(&metricActiveUploads, 1)
+	defer atomic.AddInt64(&metricActiveUploads, -1)
+
+	// also used in the background, c is gone by then
+	log := LogFor(c)
+
 	id := uuid.NewString()
 
 	var returnUrl string
 	var formdata Meta
 
-	if err := os.MkdirAll(filepath.Join(cfg.StorageDir, id), os.ModePerm); err != nil {
-		return JsonStatus(c, fiber.StatusInternalServerError,
-			"Unable to initialize directories: "+err.Error())
-	}
-
 	// fetch auxiliary form data
 	form, err := c.MultipartForm()
 	if err != nil {
@@ -68,18 +87,43 @@ func UploadPost(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 	// init upload obj
 	entry := &common.Upload{Id: id, Created: common.Timestamp{Time: time.Now()}, Type: common.TypeUpload}
 
-	// retrieve the API Context name from the session
-	apicontext, err := SessionGetApicontext(c)
-	if err != nil {
+	// the API Context the request has been authenticated for
+	principal := GetPrincipal(c)
+	apicontext := principal.Context
+	entry.Context = apicontext
+
+	// uploaded using a form token?
+	entry.FormId = principal.FormId
+
+	// recorded in the journal, so a crash can be recovered from at startup
+	if err := db.JournalBegin(id); err != nil {
 		return JsonStatus(c, fiber.StatusInternalServerError,
-			"Unable to initialize session store from context: "+err.Error())
+			"Unable to initialize upload: "+err.Error())
+	}
+
+	// rolls back the upload, in case anything goes wrong
+	failed := false
+	defer func() {
+		if failed {
+			if err := rollbackUpload(cfg, db, id); err != nil {
+				log.Error("Unable to roll back upload %s: %s", id, err.Error())
+			}
+		}
+	}()
+
+	// files are received into the staging dir, see CommitFiles()
+	staged := stagingDir(cfg, id)
+	if err := os.MkdirAll(staged, os.ModePerm); err != nil {
+		failed = true
+		return JsonStatus(c, fiber.StatusInternalServerError,
+			"Unable to initialize directories: "+err.Error())
 	}
-	entry.Context = apicontext
 
 	// retrieve files, if any
 	files := form.File["upload[]"]
 	members, err := SaveFormFiles(c, cfg, files, id)
 	if err != nil {
+		failed = true
 		return JsonStatus(c, fiber.StatusInternalServerError,
 			"Could not store uploaded file[s]: "+err.Error())
 	}
@@ -87,6 +131,7 @@ func UploadPost(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 
 	// extract auxiliary form data (expire field et al)
 	if err := c.BodyParser(&formdata); err != nil {
+		failed = true
 		return JsonStatus(c, fiber.StatusInternalServerError,
 			"bodyparser error : "+err.Error())
 	}
@@ -95,33 +140,97 @@ func UploadPost(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 	if len(formdata.Expire) == 0 {
 		entry.Expire = "asap"
 	} else {
-		ex, err := common.Untaint(formdata.Expire, cfg.RegDuration) // duration or asap allowed
+		// duration, date or asap allowed
+		if err := untaintExpire(c, cfg, &formdata.Expire); err != nil {
+			failed = true
+			return err
+		}
+		entry.Expire = formdata.Expire
+	}
+	entry.ExpiresAt = common.Timestamp{Time: ExpiresAt(cfg, entry.Created.Time, entry.Expire)}
+
+	// password protected?
+	var hash string
+	if formdata.Password != "" {
+		hash, err = HashPassword(formdata.Password)
 		if err != nil {
-			return JsonStatus(c, fiber.StatusForbidden,
-				"Invalid data: "+err.Error())
+			failed = true
+			return JsonStatus(c, fiber.StatusInternalServerError,
+				"Unable to hash password: "+err.Error())
 		}
-		entry.Expire = ex
+		entry.Protected = true
+	}
+
+	if formdata.MaxDownloads < 0 {
+		failed = true
+		return JsonStatus(c, fiber.StatusForbidden,
+			"Invalid data: maxdownloads must not be negative!")
+	}
+	entry.MaxDownloads = formdata.MaxDownloads
+
+	// restrict downloads to some networks?
+	entry.Allow, err = untaintAllow(cfg, formdata.Allow, apicontext)
+	if err != nil {
+		failed = true
+		return err
 	}
 
 	// get url [and zip if there are multiple files]
 	returnUrl, Newfilename, err := ProcessFormFiles(cfg, entry.Members, id)
 	if err != nil {
+		failed = true
 		return JsonStatus(c, fiber.StatusInternalServerError,
 			"Could not process uploaded file[s]: "+err.Error())
 	}
 	entry.File = Newfilename
+
+	// human friendly id, if configured for the api context
+	entry.ShortId, err = db.AllocateShortId(cfg.ContextIdStyle(apicontext), id)
+	if err != nil {
+		failed = true
+		return JsonStatus(c, fiber.StatusInternalServerError,
+			"Unable to allocate short id: "+err.Error())
+	}
+
+	// contains the short id, or is a signed link if plain links are disabled
+	returnUrl = DownloadUrl(cfg, entry)
 	entry.Url = returnUrl
 
-	Log("Now serving %s from %s/%s", returnUrl, cfg.StorageDir, id)
-	Log("Expire set to: %s", entry.Expire)
-	Log("Uploaded with API-Context %s", entry.Context)
+	/*
+	   Commit  the upload before we  respond: move the files into place,
+	   then store the  metadata. If either fails, nothing remains, the
+	   client never got an url.
+	*/
+	if err := db.JournalCommit(entry, hash); err != nil {
+		failed = true
+		return JsonStatus(c, fiber.StatusInternalServerError,
+			"Unable to store upload: "+err.Error())
+	}
 
-	// we do this in the background to not thwart the server
-	go func() {
-		if err := db.Insert(id, entry); err != nil {
-			Log("Failed to insert: " + err.Error())
-		}
-	}()
+	if err := CommitFiles(cfg, id); err != nil {
+		failed = true
+		return JsonStatus(c, fiber.StatusInternalServerError,
+			"Unable to store upload: "+err.Error())
+	}
+
+	if err := db.InsertUpload(entry, hash); err != nil {
+		failed = true
+		return JsonStatus(c, fiber.StatusInternalServerError,
+			"Unable to store upload: "+err.Error())
+	}
+
+	log.Debug("Now serving %s from %s/%s", returnUrl, cfg.StorageDir, id)
+	log.Debug("Expire set to: %s", entry.Expire)
+	log.Debug("Max downloads set to: %d", entry.MaxDownloads)
+	log.Debug("Uploaded with API-Context %s", entry.Context)
+
+	Audit(c, db, AuditCreate, AuditUpload, id, apicontext, "expire: "+entry.Expire)
+
+	var uploaded int64
+	for _, file := range files {
+		uploaded += file.Size
+	}
+	metricUploaded.Add(float64(uploaded), apicontext)
 
 	// everything went well so far
 	res := &common.Response{Uploads: []*common.Upload{entry}}
@@ -131,15 +240,17 @@ func UploadPost(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 	// ok, check  if we need to remove  a form, if so we do  it in the
 	// background.  delete error  doesn't lead  to upload  failure, we
 	// only log it. same applies to mail notification.
-	formid, _ := SessionGetFormId(c)
+	formid := entry.FormId
 	if formid != "" {
 		go func() {
 			r, err := db.Get(apicontext, formid, common.TypeForm)
 			if err == nil {
 				if len(r.Forms) == 1 {
 					if r.Forms[0].Expire == "asap" {
-						if err := db.Delete(apicontext, formid); err != nil {
-							Log("Failed to delete formid %s: %s", formid, err.Error())
+						if err := db.Delete("", formid); err != nil {
+							log.Error("Failed to delete formid %s: %s", formid, err.Error())
+						} else {
+							auditExpired(db, AuditForm, formid, apicontext, "asap")
 						}
 					}
 
@@ -149,7 +260,7 @@ func UploadPost(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 						subject := fmt.Sprintf("Upload form %s has been used", formid)
 						err := Sendmail(cfg, r.Forms[0].Notify, body, subject)
 						if err != nil {
-							Log("Failed to send mail: %s", err.Error())
+							log.Error("Failed to send mail: %s", err.Error())
 						}
 					}
 				}
@@ -163,18 +274,37 @@ func UploadPost(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 func UploadFetch(c *fiber.Ctx, cfg *cfg.Config, db *Db, shallExpire ...bool) error {
 	// deliver  a file and delete  it if expire is set to asap
 
+	// also used after the download has been sent, c is gone by then
+	log := LogFor(c)
+
+	// the API Context the request has been authenticated for
+	apicontext := GetPrincipal(c).Context
+
 	// we ignore c.Params("file"), cause  it may be malign. Also we've
 	// got it in the db anyway
-	id, err := common.Untaint(c.Params("id"), cfg.RegKey)
-	if err != nil {
-		return fiber.NewError(403, "Invalid id provided!")
-	}
+	var id string
+	var link *LinkClaims
+	var err error
 
-	// retrieve the API Context name from the session
-	apicontext, err := SessionGetApicontext(c)
-	if err != nil {
-		return JsonStatus(c, fiber.StatusInternalServerError,
-			"Unable to initialize session store from context: "+err.Error())
+	if token := c.Params("token"); token != "" {
+		// signed link, the id is part of the signed token
+		link, err = ParseLink(cfg, token)
+		if err != nil {
+			if err == ErrLinkExpired {
+				return fiber.NewError(fiber.StatusGone, "Download link has expired!")
+			}
+			return fiber.NewError(fiber.StatusForbidden, "Invalid download link provided!")
+		}
+		id = link.Id
+	} else {
+		if cfg.SignedOnly && apicontext == "" {
+			return fiber.NewError(fiber.StatusForbidden, "Only signed download links are allowed!")
+		}
+
+		id, err = ParamId(c, cfg, db)
+		if err != nil {
+			return fiber.NewError(403, "Invalid id provided!")
+		}
 	}
 
 	response, err := db.Lookup(apicontext, id, common.TypeUpload)
@@ -188,43 +318,308 @@ func UploadFetch(c *fiber.Ctx, cfg *cfg.Config, db *Db, shallExpire ...bool) err
 		upload = response.Uploads[0]
 	}
 
+	// access checks go first, before any page or header is sent
+	if !ClientAllowed(c, cfg, upload.Allow) {
+		return denyClient(c, db, AuditUpload, id, upload.Context)
+	}
+
+	if link != nil && link.Generation != upload.LinkGeneration {
+		return fiber.NewError(fiber.StatusGone, "Download link has been revoked!")
+	}
+
+	// nothing about a protected upload is revealed without the password,
+	// neither to HEAD requests nor to preview crawlers or on the landing
+	// page. Browsers  get the password  prompt, posting the password
+	// confirms the download.
+	if upload.Protected {
+		if ok, err := checkDownloadPassword(c, cfg, db, upload); !ok {
+			return err
+		}
+	}
+
+	expire := len(shallExpire) > 0 && shallExpire[0]
+
+	if expire {
+		// HEAD requests  get the headers of  the file only,  they never
+		// consume the upload
+		if c.Method() == fiber.MethodHead {
+			Audit(c, db, AuditPreview, AuditUpload, id, upload.Context, "HEAD request, not consumed")
+			return c.Download(filepath.Join(cfg.StorageDir, id, upload.File), upload.File)
+		}
+
+		// link  preview crawlers  get the  landing page,  never the
+		// file. They don't post, so the confirmation goes through.
+		if agent := PreviewAgent(c, cfg); agent != "" && c.Method() == fiber.MethodGet {
+			Audit(c, db, AuditPreview, AuditUpload, id, upload.Context,
+				"link preview crawler "+agent+", not consumed")
+			return DownloadPage(c, cfg, upload)
+		}
+	}
+
+	// browsers get a landing page first, the download starts after
+	// they confirmed it  using a POST request. Link  unfurlers don't
+	// post, so they can't consume uploads.
+	if expire && WantsHTML(c) && c.Method() == fiber.MethodGet {
+		return DownloadPage(c, cfg, upload)
+	}
+
+	// single use links are consumed by the first download
+	if link != nil && link.Nonce != "" {
+		if err := db.ClaimNonce(link.Nonce, link.Expires); err != nil {
+			if err == ErrLinkUsed {
+				return fiber.NewError(fiber.StatusGone, "Download link has already been used!")
+			}
+			return fiber.NewError(fiber.StatusInternalServerError, "Unable to verify download link!")
+		}
+	}
+
+	// give the link back if the download doesn't happen
+	releaseNonce := func() {
+		if link != nil && link.Nonce != "" {
+			if err := db.ReleaseNonce(link.Nonce); err != nil {
+				log.Error("Unable to release link of %s: %s", id, err.Error())
+			}
+		}
+	}
+
+	if expire {
+		/*
+		   Count the download, this also enforces the download limit and
+		   claims asap uploads. That happens in one transaction before
+		   anything is sent, so concurrent requests can't both get the
+		   file. The losers get a 410.
+		*/
+		upload, err = db.CountDownload(id)
+		if err != nil {
+			releaseNonce()
+
+			switch err {
+			case ErrDownloadClaimed:
+				return fiber.NewError(fiber.StatusGone, "This upload has already been downloaded!")
+			case ErrDownloadLimit:
+				return fiber.NewError(fiber.StatusGone, "Download limit of this upload has been reached!")
+			}
+			return fiber.NewError(404, "No download with that id could be found!")
+		}
+	}
+
+	// give the claim back, if the file could not be delivered completely
+	release := func() {
+		if _, err := db.ReleaseDownload(id); err != nil {
+			log.Error("Unable to release download of %s: %s", id, err.Error())
+		}
+
+		releaseNonce()
+	}
+
 	file := upload.File
 	filename := filepath.Join(cfg.StorageDir, id, file)
 
-	if _, err := os.Stat(filename); err != nil {
+	stat, err := os.Stat(filename)
+	if err != nil {
 		// db entry is there, but file isn't (anymore?)
 		go func() {
-			if err := db.Delete(apicontext, id); err != nil {
-				Log("Unable to delete entry id %s: %s", id, err.Error())
+			if err := db.Delete("", id); err != nil {
+				log.Error("Unable to delete entry id %s: %s", id, err.Error())
 			}
 		}()
 		return fiber.NewError(404, "No download with that id could be found!")
 	}
 
-	// finally put the file to the client
-	err = c.Download(filename, file)
+	if !expire {
+		// api access, no accounting required
+		if err := c.Download(filename, file); err != nil {
+			return err
+		}
 
-	if len(shallExpire) > 0 {
-		if shallExpire[0] {
-			go func() {
-				// check if we need to delete the file now and do it in the background
-				if upload.Expire == "asap" {
-					cleanup(filepath.Join(cfg.StorageDir, id))
-					if err := db.Delete(apicontext, id); err != nil {
-						Log("Unable to delete entry id %s: %s", id, err.Error())
-					}
-				}
-			}()
+		metricDownloaded.Add(float64(stat.Size()), upload.Context)
+		Audit(c, db, AuditDownload, AuditUpload, id, upload.Context, "")
+		return nil
+	}
+
+	/*
+	   Finally put the file to the client. The download only counts, if
+	   the whole file has been delivered. That's known after the handler
+	   returned, so  we prepare the audit entry  now, the context can't
+	   be used by then.
+	*/
+	entry := newAuditEntry(c, db, AuditDownload, AuditUpload, id, upload.Context, "")
+
+	err = sendDownload(c, filename, file, func(sent, size int64) {
+		metricDownloaded.Add(float64(sent), upload.Context)
+
+		if sent < size {
+			// client went away, give the download back
+			release()
+
+			entry.Action = AuditAborted
+			entry.Message = fmt.Sprintf("%d of %d bytes delivered, not counted", sent, size)
+			auditInsert(db, entry)
+			return
+		}
+
+		entry.Message = fmt.Sprintf("%d bytes delivered", sent)
+		auditInsert(db, entry)
+
+		// check if we need to delete the file now
+		reason := ""
+		switch {
+		case upload.Expire == "asap":
+			reason = "asap"
+		case upload.DownloadsExhausted():
+			reason = fmt.Sprintf("download limit of %d reached", upload.MaxDownloads)
+		default:
+			return
+		}
+
+		cleanup(filepath.Join(cfg.StorageDir, id))
+		if err := db.Delete("", id); err != nil {
+			log.Error("Unable to delete entry id %s: %s", id, err.Error())
+		} else {
+			auditExpired(db, AuditUpload, id, upload.Context, reason)
+		}
+	})
+
+	if err != nil {
+		release()
+		return fiber.NewError(fiber.StatusInternalServerError, "Unable to deliver the download!")
+	}
+
+	return nil
+}
+
+/*
+   Check the password of  a protected upload. Browsers get a password
+   prompt, API  clients have to  send the password using  the header
+   X-Download-Password. Returns  false if the download  is not allowed,
+   in which case the returned error (or nil if a page has been rendered)
+   has to be returned by the handler.
+*/
+func checkDownloadPassword(c *fiber.Ctx, cfg *cfg.Config, db *Db, upload *common.Upload) (bool, error) {
+	ip := ClientIP(c, cfg)
+
+	if locked, left := PasswordLocked(db, upload.Id, ip); locked {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(left.Seconds())+1))
+		return false, fiber.NewError(fiber.StatusTooManyRequests,
+			"Too many failed password attempts, try again later!")
+	}
+
+	password := c.Get(PasswordHeader)
+	if password == "" {
+		password = c.FormValue("password")
+	}
+
+	if password == "" {
+		if WantsHTML(c) {
+			return false, PasswordPage(c, cfg, upload, "")
+		}
+
+		return false, fiber.NewError(fiber.StatusUnauthorized, "This download is password protected!")
+	}
+
+	hash, err := db.GetPassword(upload.Id)
+	if err != nil {
+		return false, fiber.NewError(404, "No download with that id could be found!")
+	}
+
+	ok, err := VerifyPassword(password, hash)
+	if err != nil {
+		LogFor(c).Error("Unable to verify password of %s: %s", upload.Id, err.Error())
+	}
+
+	if !ok {
+		PasswordFailed(db, upload.Id, ip)
+		Audit(c, db, AuditAuthFail, AuditUpload, upload.Id, upload.Context, "wrong download password")
+
+		if WantsHTML(c) {
+			return false, PasswordPage(c, cfg, upload, "Wrong password!")
 		}
+
+		return false, fiber.NewError(fiber.StatusForbidden, "Wrong password!")
 	}
 
-	return err
+	PasswordSucceeded(db, upload.Id, ip)
+
+	return true, nil
+}
+
+/*
+   Render  the password  prompt of  a protected  download. Template
+   given by --passwordpage, stored as text in cfg.Passwordpage.
+*/
+func PasswordPage(c *fiber.Ctx, cfg *cfg.Config, upload *common.Upload, message string) error {
+	t := template.New("password")
+	t, err := t.Parse(cfg.Passwordpage)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).
+			SendString("Unable to load password template: " + err.Error())
+	}
+
+	// no details of the upload, the password has not been verified yet
+	data := struct {
+		Id      string
+		Url     string // where to post the password to
+		Message string
+	}{upload.Id, c.OriginalURL(), message}
+
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return c.Status(fiber.StatusInternalServerError).
+			SendString("Unable to render password template: " + err.Error())
+	}
+
+	c.Set("Content-type", "text/html; charset=utf-8")
+	return c.Status(fiber.StatusUnauthorized).SendString(out.String())
+}
+
+/*
+   Render the landing page of a download. Template given by
+   --downloadpage, stored as text in cfg.Downloadpage. The page posts
+   to the download url to start the actual download.
+*/
+func DownloadPage(c *fiber.Ctx, cfg *cfg.Config, upload *common.Upload) error {
+	t := template.New("download")
+	t, err := t.Parse(cfg.Downloadpage)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).
+			SendString("Unable to load download template: " + err.Error())
+	}
+
+	size := "unknown size"
+	if stat, err := os.Stat(filepath.Join(cfg.StorageDir, upload.Id, upload.File)); err == nil {
+		size = common.HumanSize(stat.Size())
+	}
+
+	expire := upload.ExpiresAt.Format("2006-01-02 15:04:05 MST")
+	if upload.Expire == "asap" {
+		expire = "after the first download"
+	}
+
+	data := struct {
+		Id          string
+		File        string
+		Size        string
+		Description string
+		Members     []string
+		Expire      string
+		Url         string // where to post the confirmation to
+	}{upload.Id, upload.File, size, upload.Description, upload.Members,
+		expire, c.OriginalURL()}
+
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return c.Status(fiber.StatusInternalServerError).
+			SendString("Unable to render download template: " + err.Error())
+	}
+
+	c.Set("Content-type", "text/html; charset=utf-8")
+	return c.Status(fiber.StatusOK).SendString(out.String())
 }
 
 // delete file, id dir and db entry
 func UploadDelete(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 
-	id, err := common.Untaint(c.Params("id"), cfg.RegKey)
+	id, err := ParamId(c, cfg, db)
 	if err != nil {
 		return JsonStatus(c, fiber.StatusForbidden,
 			"Invalid id provided!")
@@ -235,14 +630,14 @@ func UploadDelete(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 			"No id specified!")
 	}
 
-	// retrieve the API Context name from the session
-	apicontext, err := SessionGetApicontext(c)
-	if err != nil {
-		return JsonStatus(c, fiber.StatusInternalServerError,
-			"Unable to initialize session store from context: "+err.Error())
-	}
+	// the API Context the request has been authenticated for
+	apicontext := GetPrincipal(c).Context
 
 	err = db.Delete(apicontext, id)
+	if err == ErrForbidden {
+		return scopeDenied(c, db, GetPrincipal(c))
+	}
+
 	if err != nil {
 		// non existent db entry with that id, or other db error, see logs
 		return JsonStatus(c, fiber.StatusForbidden,
@@ -251,6 +646,8 @@ func UploadDelete(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 
 	cleanup(filepath.Join(cfg.StorageDir, id))
 
+	Audit(c, db, AuditDelete, AuditUpload, id, apicontext, "")
+
 	return nil
 }
 
@@ -263,7 +660,7 @@ func UploadsList(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 			"Unable to parse body: "+err.Error())
 	}
 
-	apifilter, err := common.Untaint(setcontext.Apicontext, cfg.RegKey)
+	apifilter, err := untaintContextFilter(cfg, setcontext.Apicontext)
 	if err != nil {
 		return JsonStatus(c, fiber.StatusForbidden,
 			"Invalid api context apifilter provided!")
@@ -275,15 +672,15 @@ func UploadsList(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 			"Invalid query provided!")
 	}
 
-	// retrieve the API Context name from the session
-	apicontext, err := SessionGetApicontext(c)
-	if err != nil {
-		return JsonStatus(c, fiber.StatusInternalServerError,
-			"Unable to initialize session store from context: "+err.Error())
-	}
+	// the API Context the request has been authenticated for
+	apicontext := GetPrincipal(c).Context
 
 	// get list
 	uploads, err := db.List(apicontext, apifilter, query, common.TypeUpload)
+	if err == ErrForbidden {
+		return scopeDenied(c, db, GetPrincipal(c))
+	}
+
 	if err != nil {
 		return JsonStatus(c, fiber.StatusForbidden,
 			"Unable to list uploads: "+err.Error())
@@ -298,18 +695,14 @@ func UploadsList(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 
 // returns just one upload obj + error code, no post processing by server
 func UploadDescribe(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
-	id, err := common.Untaint(c.Params("id"), cfg.RegKey)
+	id, err := ParamId(c, cfg, db)
 	if err != nil {
 		return JsonStatus(c, fiber.StatusForbidden,
 			"Invalid id provided!")
 	}
 
-	// retrieve the API Context name from the session
-	apicontext, err := SessionGetApicontext(c)
-	if err != nil {
-		return JsonStatus(c, fiber.StatusInternalServerError,
-			"Unable to initialize session store from context: "+err.Error())
-	}
+	// the API Context the request has been authenticated for
+	apicontext := GetPrincipal(c).Context
 
 	response, err := db.Get(apicontext, id, common.TypeUpload)
 	if err != nil {
@@ -318,7 +711,7 @@ func UploadDescribe(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 	}
 
 	for _, upload := range response.Uploads {
-		upload.Url = strings.Join([]string{cfg.Url, "download", id, upload.File}, "/")
+		upload.Url = DownloadUrl(cfg, upload)
 	}
 
 	// if we reached this point we can signal success
@@ -331,14 +724,10 @@ func UploadDescribe(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 func UploadModify(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 	var formdata common.Upload
 
-	// retrieve the API Context name from the session
-	apicontext, err := SessionGetApicontext(c)
-	if err != nil {
-		return JsonStatus(c, fiber.StatusInternalServerError,
-			"Unable to initialize session store from context: "+err.Error())
-	}
+	// the API Context the request has been authenticated for
+	apicontext := GetPrincipal(c).Context
 
-	id, err := common.Untaint(c.Params("id"), cfg.RegKey)
+	id, err := ParamId(c, cfg, db)
 	if err != nil {
 		return JsonStatus(c, fiber.StatusForbidden,
 			"Invalid id provided!")
@@ -351,38 +740,43 @@ func UploadModify(c *fiber.Ctx, cfg *cfg.Config, db *Db) error {
 	}
 
 	// post process input data
-	if err := untaintField(c, &formdata.Expire, cfg.RegDuration, "expire data"); err != nil {
+	if err := untaintExpire(c, cfg, &formdata.Expire); err != nil {
 		return err
 	}
 
-	if err := untaintField(c, &formdata.Description, cfg.RegDuration, "description"); err != nil {
+	if err := untaintField(c, &formdata.Description, cfg.RegText, "description"); err != nil {
 		return err
 	}
 
-	// lookup orig entry
-	response, err := db.Get(apicontext, id, common.TypeUpload)
-	if err != nil || len(response.Uploads) == 0 {
+	allow, err := common.NormalizeAllowlist(formdata.Allow)
+	if err != nil {
 		return JsonStatus(c, fiber.StatusForbidden,
-			"No upload with that id could be found!")
+			"Invalid allow list: "+err.Error())
 	}
 
-	upload := response.Uploads[0]
-
-	// modify fields
-	if formdata.Expire != "" {
-		upload.Expire = formdata.Expire
+	changes := &common.Upload{
+		Expire:       formdata.Expire,
+		Description:  formdata.Description,
+		MaxDownloads: formdata.MaxDownloads, // a negative value removes the limit
 	}
 
-	if formdata.Description != "" {
-		upload.Description = formdata.Description
+	// an allowlist of "any" removes the restriction
+	switch {
+	case len(allow) > 0:
+		changes.Allow = allow
+	case len(formdata.Allow) > 0:
+		changes.Allow = []string{}
 	}
 
-	// run in foreground because we need the feedback here
-	if err := db.Insert(id, upload); err != nil {
+	// modified in place, downloads may happen at the same time
+	upload, err := db.ModifyUpload(apicontext, id, changes)
+	if err != nil {
 		return JsonStatus(c, fiber.StatusForbidden,
-			"Failed to insert: "+err.Error())
+			"No upload with that id could be found!")
 	}
 
+	Audit(c, db, AuditModify, AuditUpload, id, apicontext, "")
+
 	res := &common.Response{Uploads: []*common.Upload{upload}}
 	res.Success = true
 	res.Code = fiber.StatusOK
@@ -0,0 +1,208 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tlinden/ephemerup/cfg"
+	"github.com/tlinden/ephemerup/common"
+)
+
+func TestUploadCommit(t *testing.T) {
+	c := &cfg.Config{
+		DbFile:     "uploadtest.db",
+		StorageDir: t.TempDir(),
+		Url:        "http://localhost",
+	}
+
+	if err := c.ApplyDefaults(); err != nil {
+		t.Fatalf("Could not apply config defaults: " + err.Error())
+	}
+
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	app := fiber.New()
+	app.Post("/uploads", func(ctx *fiber.Ctx) error {
+		return UploadPost(ctx, c, db)
+	})
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("upload[]", "t1")
+	part.Write([]byte("content"))
+	writer.WriteField("expire", "1d")
+	writer.WriteField("password", "secret")
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/uploads", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Request failed: " + err.Error())
+	}
+
+	response := &common.Response{}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil || len(response.Uploads) != 1 {
+		t.Fatalf("Unexpected response: %d %v", resp.StatusCode, err)
+	}
+
+	id := response.Uploads[0].Id
+
+	// the upload has to be there once the client got the response
+	if _, err := db.Lookup("", id, common.TypeUpload); err != nil {
+		t.Errorf("Upload not stored: " + err.Error())
+	}
+
+	if _, err := db.GetPassword(id); err != nil {
+		t.Errorf("Password not stored: " + err.Error())
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(c.StorageDir, id, "t1"))
+	if err != nil || string(content) != "content" {
+		t.Errorf("Upload file not committed: %v", err)
+	}
+
+	if _, err := os.Stat(stagingDir(c, id)); !os.IsNotExist(err) {
+		t.Errorf("Staging dir of %s has not been removed", id)
+	}
+}
+
+func TestDeleteStaleStaging(t *testing.T) {
+	c := &cfg.Config{StorageDir: t.TempDir()}
+
+	for _, id := range []string{"stale", "fresh"} {
+		if err := os.MkdirAll(stagingDir(c, id), os.ModePerm); err != nil {
+			t.Fatalf("Could not create staging dir: " + err.Error())
+		}
+	}
+
+	old := time.Now().Add(-2 * stagingRetention)
+	if err := os.Chtimes(stagingDir(c, "stale"), old, old); err != nil {
+		t.Fatalf("Could not change mtime: " + err.Error())
+	}
+
+	if err := DeleteStaleStaging(c); err != nil {
+		t.Errorf("Could not delete stale staging entries: " + err.Error())
+	}
+
+	if _, err := os.Stat(stagingDir(c, "stale")); !os.IsNotExist(err) {
+		t.Errorf("Stale staging dir has not been removed")
+	}
+
+	if _, err := os.Stat(stagingDir(c, "fresh")); err != nil {
+		t.Errorf("Fresh staging dir has been removed")
+	}
+}
+
+func TestRecoverUploads(t *testing.T) {
+	c := &cfg.Config{DbFile: "recovertest.db", StorageDir: t.TempDir()}
+
+	db, err := NewDb(c)
+	defer finalize(db)
+
+	if err != nil {
+		t.Fatalf("Could not open new DB: " + err.Error())
+	}
+
+	// write a file into the staging dir or the storage dir
+	stage := func(id string, committed bool) {
+		dir := stagingDir(c, id)
+		if committed {
+			dir = filepath.Join(c.StorageDir, id)
+		}
+
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatalf("Could not create dir: " + err.Error())
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, "t1"), []byte("content"), 0644); err != nil {
+			t.Fatalf("Could not create file: " + err.Error())
+		}
+	}
+
+	now := common.Timestamp{Time: time.Now()}
+
+	// crashed while receiving files
+	if err := db.JournalBegin("staging"); err != nil {
+		t.Fatalf("Could not write journal: " + err.Error())
+	}
+	stage("staging", false)
+
+	shortid, err := db.AllocateShortId(IdStyleWords, "staging")
+	if err != nil {
+		t.Fatalf("Could not allocate short id: " + err.Error())
+	}
+
+	// crashed before and after moving the files into place
+	for _, tt := range []struct {
+		id        string
+		committed bool
+	}{{"commit", false}, {"renamed", true}} {
+		upload := &common.Upload{Id: tt.id, File: "t1", Type: common.TypeUpload, Expire: "1d", Created: now}
+		if err := db.JournalCommit(upload, "hash"); err != nil {
+			t.Fatalf("Could not write journal: " + err.Error())
+		}
+		stage(tt.id, tt.committed)
+	}
+
+	if err := RecoverUploads(c, db); err != nil {
+		t.Fatalf("Could not recover uploads: " + err.Error())
+	}
+
+	if _, err := os.Stat(stagingDir(c, "staging")); !os.IsNotExist(err) {
+		t.Errorf("Staging dir of interrupted upload has not been removed")
+	}
+
+	if db.ResolveId(shortid) != shortid {
+		t.Errorf("Short id of interrupted upload has not been released")
+	}
+
+	for _, id := range []string{"commit", "renamed"} {
+		if _, err := db.Lookup("", id, common.TypeUpload); err != nil {
+			t.Errorf("Upload %s has not been recovered: %s", id, err)
+		}
+
+		if _, err := os.Stat(filepath.Join(c.StorageDir, id, "t1")); err != nil {
+			t.Errorf("File of upload %s has not been recovered: %s", id, err)
+		}
+
+		if _, err := db.GetPassword(id); err != nil {
+			t.Errorf("Password of upload %s has not been recovered: %s", id, err)
+		}
+	}
+
+	entries, err := db.journalList()
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Journal not empty after recovery: %d entries, %v", len(entries), err)
+	}
+}
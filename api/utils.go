@@ -17,10 +17,11 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package api
 
 import (
-	"fmt"
 	"github.com/gofiber/fiber/v2"
 	"github.com/tlinden/ephemerup/cfg"
 	"github.com/tlinden/ephemerup/common"
+	"net"
+	"strings"
 	"time"
 )
 
@@ -28,7 +29,10 @@ const ApiVersion string = "/v1"
 
 // Binding from JSON, data coming from user, not tainted
 type Meta struct {
-	Expire string `json:"expire" form:"expire"`
+	Expire       string   `json:"expire" form:"expire"`
+	MaxDownloads int      `json:"maxdownloads" form:"maxdownloads"`
+	Password     string   `json:"password" form:"password"`
+	Allow        []string `json:"allow" form:"allow"`
 }
 
 // incoming id
@@ -37,78 +41,75 @@ type Id struct {
 }
 
 // vaious helbers
-func Log(format string, values ...any) {
-	fmt.Printf("[DEBUG] "+format+"\n", values...)
-}
-
 func Ts() string {
 	t := time.Now()
 	return t.Format("2006-01-02-15-04-")
 }
 
-/*
-   Retrieve the  API Context  name from the  session, assuming  is has
-   been  successfully  authenticated. However,  if  there  are no  api
-   contexts     defined,    we'll     use     'default'    (set     in
-   auth.validateAPIKey()).
+// true if the client is a browser, which gets html instead of JSON
+func WantsHTML(c *fiber.Ctx) bool {
+	return strings.Contains(c.Get(fiber.HeaderAccept), fiber.MIMETextHTML)
+}
 
-   If there's no apicontext in the session, assume unauth user, return ""
+/*
+   The ip  address of the  client. If the  request comes in  through a
+   trusted reverse proxy, the proxy header is evaluated from right to
+   left, every hop added by a trusted proxy is skipped. The first hop
+   not being a trusted proxy is the client. Hops left of it could have
+   been forged by the client itself, so we never look at them.
 */
-func SessionGetApicontext(c *fiber.Ctx) (string, error) {
-	sess, err := Sessionstore.Get(c)
-	if err != nil {
-		return "", fmt.Errorf("Unable to initialize session store from context: " + err.Error())
-	}
+func ClientIP(c *fiber.Ctx, conf *cfg.Config) string {
+	remote := c.Context().RemoteIP()
 
-	apicontext := sess.Get("apicontext")
-	if apicontext != nil {
-		return apicontext.(string), nil
+	if conf.ProxyHeader == "" || !conf.IsTrustedProxy(remote) {
+		return remote.String()
 	}
 
-	return "", nil
-}
+	client := remote
+	hops := strings.Split(c.Get(conf.ProxyHeader), ",")
 
-/*
-   Retrieve the formid  (aka onetime api key) from the  session. It is
-   configured if an upload request has been successfully authenticated
-   using a onetime key.
-*/
-func SessionGetFormId(c *fiber.Ctx) (string, error) {
-	sess, err := Sessionstore.Get(c)
-	if err != nil {
-		return "", fmt.Errorf("Unable to initialize session store from context: " + err.Error())
-	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
 
-	formid := sess.Get("formid")
-	if formid != nil {
-		return formid.(string), nil
+		client = ip
+		if !conf.IsTrustedProxy(ip) {
+			break
+		}
 	}
 
-	return "", nil
+	return client.String()
 }
 
 /*
    Calculate   if  time   is   up  based   on   start  time.Time   and
-   duration. Returns  true if time  is expired. Start time  comes from
+   expire setting. Returns  true if time  is expired. Start time  comes from
    the database.
 
 aka:
-   if(now - start) >= duration { time is up}
+   if now >= expires_at { time is up}
+
+Entries with an invalid expire setting (stored before it has been
+validated) expire after the default expire time.
 */
 func IsExpired(conf *cfg.Config, start time.Time, duration string) bool {
-	var expiretime int // seconds
-
-	now := time.Now()
-
-	if duration == "asap" {
-		expiretime = conf.DefaultExpire
-	} else {
-		expiretime = common.Duration2int(duration)
+	if duration != "asap" {
+		if _, err := common.ExpiresAt(start, duration, 0); err == nil {
+			return common.IsExpired(start, duration)
+		}
 	}
 
-	if now.Unix()-start.Unix() >= int64(expiretime) {
-		return true
+	return !time.Now().Before(ExpiresAt(conf, start, duration))
+}
+
+// calculate the absolute expire time of an entry
+func ExpiresAt(conf *cfg.Config, start time.Time, expire string) time.Time {
+	expiresat, err := common.ExpiresAt(start, expire, conf.DefaultExpire)
+	if err != nil {
+		return start.Add(time.Duration(conf.DefaultExpire) * time.Second)
 	}
 
-	return false
+	return expiresat
 }
@@ -17,10 +17,16 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cfg
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/tlinden/ephemerup/common"
 )
 
 const Version string = "v0.0.3"
@@ -28,10 +34,38 @@ const Version string = "v0.0.3"
 var VERSION string // maintained by -x
 
 type Apicontext struct {
-	Context string `koanf:"context"` // aka name or tenant
-	Key     string `koanf:"key"`
+	Context string   `koanf:"context"`  // aka name or tenant
+	Key     string   `koanf:"key"`      // plaintext, deprecated in favor of KeyHash
+	KeyHash string   `koanf:"key_hash"` // argon2id or sha256 hex of the key
+	Allow   []string `koanf:"allow"`    // networks allowed to use the key, default for uploads+forms
+	IdStyle string   `koanf:"idstyle"`  // style of the ids of new uploads and forms
+	Role    string   `koanf:"role"`     // what the context may do, default: admin
+	Parent  string   `koanf:"parent"`   // sees and manages the entries of this context
+}
+
+// roles of api contexts
+const (
+	RoleAdmin       = "admin"        // everything within the own context
+	RoleReadOnly    = "read-only"    // list and download
+	RoleUploadOnly  = "upload-only"  // create uploads only
+	RoleFormManager = "form-manager" // manage forms
+	RoleAuditor     = "auditor"      // list everything in all contexts, read the audit log
+)
+
+// api contexts managed at runtime using the admin api
+type runtimeContexts struct {
+	sync.RWMutex
+	contexts []Apicontext
 }
 
+// supported formats of Apicontext.KeyHash
+const (
+	KeyHashSha256   = "sha256"
+	KeyHashArgon2id = "argon2id"
+)
+
+var regSha256Hex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
 type Mailsettings struct {
 	Server   string `koanf:"server"`
 	Port     string `koanf:"port"`
@@ -39,11 +73,54 @@ type Mailsettings struct {
 	Password string `koanf:"password"`
 }
 
+/*
+   Rate limits  as "<requests>/<duration>",  e.g. "60/1m", allowing short
+   bursts of up to <requests>. Empty or "0" means unlimited.
+*/
+type Ratelimits struct {
+	Ip        string `koanf:"ip"`        // requests per client ip, all routes
+	Context   string `koanf:"context"`   // authenticated requests per api context
+	Uploads   string `koanf:"uploads"`   // uploads per api context
+	Downloads string `koanf:"downloads"` // downloads and form pages per client ip
+	AuthFail  string `koanf:"authfail"`  // failed authentications per client ip
+}
+
+// names of the rate limits, see Config.Rates
+const (
+	RateIp        = "ip"
+	RateContext   = "context"
+	RateUploads   = "uploads"
+	RateDownloads = "downloads"
+	RateAuthFail  = "authfail"
+)
+
+// used if authfail is not configured
+const DefaultRateAuthFail = "30/1m"
+
+// log levels and formats
+const (
+	LogDebug = "debug"
+	LogInfo  = "info"
+	LogWarn  = "warn"
+	LogError = "error"
+
+	LogText = "text"
+	LogJson = "json"
+)
+
+// a parsed rate limit
+type Rate struct {
+	Requests int
+	Period   time.Duration
+}
+
 // holds the whole configs, filled by commandline flags, env and config file
 type Config struct {
 	// Flags+config file settings
-	ApiPrefix  string `koanf:"apiprefix"` // path prefix
-	Debug      bool   `koanf:"debug"`
+	ApiPrefix  string `koanf:"apiprefix"`  // path prefix
+	Debug      bool   `koanf:"debug"`      // same as loglevel debug
+	LogLevel   string `koanf:"loglevel"`   // debug, info, warn or error
+	LogFormat  string `koanf:"logformat"`  // text or json
 	Listen     string `koanf:"listen"`     // [host]:port
 	StorageDir string `koanf:"storagedir"` // db and uploads go there
 	Url        string `koanf:"url"`        // public visible url, might be different from Listen
@@ -52,6 +129,37 @@ type Config struct {
 	Frontpage  string `koanf:"frontpage"` // a html file
 	Formpage   string `koanf:"formpage"`  // a html file
 
+	Passwordpage string `koanf:"passwordpage"` // a html file
+	Downloadpage string `koanf:"downloadpage"` // a html file
+
+	AuditRetention string `koanf:"auditretention"` // how long to keep audit entries
+
+	// reverse proxies we accept the client ip header from
+	TrustedProxies []string `koanf:"trustedproxies"` // ips or networks
+	ProxyHeader    string   `koanf:"proxyheader"`    // e.g. X-Forwarded-For
+
+	// additional user agents of link preview crawlers
+	PreviewAgents []string `koanf:"previewagents"`
+
+	// uuid, words or base32, may be overridden per api context
+	IdStyle string `koanf:"idstyle"`
+
+	// signed download links
+	SigningKey         string `koanf:"signingkey"`         // generated if empty
+	PreviousSigningKey string `koanf:"previoussigningkey"` // still accepted after a key rotation
+	LinkValidity       string `koanf:"linkvalidity"`       // default validity of signed links
+	SignedOnly         bool   `koanf:"signedonly"`         // disable plain /download/:id links
+
+	// jwt bearer authentication, tokens issued by an identity provider
+	Jwks            string `koanf:"jwks"`            // file or url of the signing keys
+	JwtIssuer       string `koanf:"jwtissuer"`       // expected iss claim, if set
+	JwtAudience     string `koanf:"jwtaudience"`     // expected aud claim, if set
+	JwtContextClaim string `koanf:"jwtcontextclaim"` // claim containing the api context
+	JwtRoleClaim    string `koanf:"jwtroleclaim"`    // claim containing the role, optional
+
+	// prometheus metrics on /metrics
+	MetricsToken string `koanf:"metricstoken"` // bearer token required to scrape, if set
+
 	// fiber settings, see:
 	// https://docs.gofiber.io/api/fiber/#config
 	Prefork   bool   `koanf:"prefork"`   // default: nope
@@ -67,6 +175,9 @@ type Config struct {
 	// smtp settings
 	Mail Mailsettings `koanf:"mail"`
 
+	// request rate limits
+	Ratelimit Ratelimits `koanf:"ratelimit"`
+
 	// Internals only
 	RegNormalizedFilename *regexp.Regexp
 	RegDuration           *regexp.Regexp
@@ -75,8 +186,17 @@ type Config struct {
 	RegText               *regexp.Regexp
 	RegQuery              *regexp.Regexp
 
-	CleanInterval time.Duration
-	DefaultExpire int
+	CleanInterval  time.Duration
+	DefaultExpire  int
+	AuditExpire    int // seconds, 0 means keep forever
+	TrustedNets    []*net.IPNet
+	LinkExpire     int // seconds
+	SigningSecret  []byte
+	PreviousSecret []byte          // from PreviousSigningKey, verification only
+	Rates          map[string]Rate // configured rate limits, see Ratelimits
+	ConfigFiles    []string        // config files which have been loaded
+
+	runtime *runtimeContexts // see Contexts()
 }
 
 func Getversion() string {
@@ -94,7 +214,7 @@ func (c *Config) GetVersion() string {
 }
 
 // post processing of options, if any
-func (c *Config) ApplyDefaults() {
+func (c *Config) ApplyDefaults() error {
 	if len(c.Url) == 0 {
 		if strings.HasPrefix(c.Listen, ":") {
 			c.Url = "http://localhost" + c.Listen
@@ -119,7 +239,7 @@ func (c *Config) ApplyDefaults() {
 	}
 
 	c.RegNormalizedFilename = regexp.MustCompile(`[^\w\d\-_\.]`)
-	c.RegDuration = regexp.MustCompile(`[^dhms0-9]`)
+	c.RegDuration = regexp.MustCompile(`[^a-zA-Z0-9:\.\-\+]`) // validated by common.ValidateExpire()
 	c.RegKey = regexp.MustCompile(`[^a-zA-Z0-9\-]`)
 	c.RegEmail = regexp.MustCompile(`[^a-zA-Z0-9._%+\-@0-9]`)
 	c.RegText = regexp.MustCompile(`[^a-zA-Z0-9_%+\-@0-9 #/\.]`)
@@ -127,4 +247,370 @@ func (c *Config) ApplyDefaults() {
 
 	c.CleanInterval = 10 * time.Second
 	c.DefaultExpire = 30 * 86400 // 1 month
+
+	if c.AuditRetention != "" && c.AuditRetention != "0" {
+		seconds, err := common.Duration2int(c.AuditRetention)
+		if err != nil {
+			return errors.New("invalid auditretention: " + err.Error())
+		}
+		c.AuditExpire = seconds
+	}
+
+	c.LinkExpire = 3600
+	if c.LinkValidity != "" {
+		seconds, err := common.Duration2int(c.LinkValidity)
+		if err != nil {
+			return errors.New("invalid linkvalidity: " + err.Error())
+		}
+		c.LinkExpire = seconds
+	}
+
+	if c.Ratelimit.AuthFail == "" {
+		c.Ratelimit.AuthFail = DefaultRateAuthFail
+	}
+
+	c.Rates = map[string]Rate{}
+	for name, limit := range map[string]string{
+		RateIp:        c.Ratelimit.Ip,
+		RateContext:   c.Ratelimit.Context,
+		RateUploads:   c.Ratelimit.Uploads,
+		RateDownloads: c.Ratelimit.Downloads,
+		RateAuthFail:  c.Ratelimit.AuthFail,
+	} {
+		rate, err := ParseRate(limit)
+		if err != nil {
+			return fmt.Errorf("invalid ratelimit %s: %s", name, err)
+		}
+
+		if rate.Requests > 0 {
+			c.Rates[name] = rate
+		}
+	}
+
+	if c.JwtContextClaim == "" {
+		c.JwtContextClaim = "apicontext"
+	}
+
+	c.TrustedNets = []*net.IPNet{}
+	for _, proxy := range c.TrustedProxies {
+		network, err := common.ParseCIDR(proxy)
+		if err != nil {
+			return errors.New("invalid trustedproxies: " + err.Error())
+		}
+		c.TrustedNets = append(c.TrustedNets, network)
+	}
+
+	if err := validIdStyle(c.IdStyle); err != nil {
+		return err
+	}
+
+	if err := c.applyLogDefaults(); err != nil {
+		return err
+	}
+
+	for i := range c.Apicontexts {
+		if err := c.Apicontexts[i].Normalize(); err != nil {
+			return err
+		}
+	}
+
+	if err := ValidateContexts(c.Apicontexts); err != nil {
+		return err
+	}
+
+	if c.runtime == nil {
+		c.runtime = &runtimeContexts{}
+	}
+
+	return nil
+}
+
+// check the settings of an api context and fill in defaults
+func (a *Apicontext) Normalize() error {
+	if err := validIdStyle(a.IdStyle); err != nil {
+		return fmt.Errorf("api context %s: %s", a.Context, err)
+	}
+
+	allow, err := common.NormalizeAllowlist(a.Allow)
+	if err != nil {
+		return fmt.Errorf("invalid allow list of api context %s: %s", a.Context, err)
+	}
+	a.Allow = allow
+
+	if err := a.normalizeKeyHash(); err != nil {
+		return fmt.Errorf("api context %s: %s", a.Context, err)
+	}
+
+	if a.Role == "" {
+		a.Role = RoleAdmin
+	} else if err := validRole(a.Role); err != nil {
+		return fmt.Errorf("api context %s: %s", a.Context, err)
+	}
+
+	return nil
+}
+
+// check the key settings of an api context, sha256 hashes are lowercased
+func (a *Apicontext) normalizeKeyHash() error {
+	switch {
+	case a.Key != "" && a.KeyHash != "":
+		return errors.New("key and key_hash are mutually exclusive")
+	case a.Key == "" && a.KeyHash == "":
+		return errors.New("either key or key_hash is required")
+	case a.Key != "":
+		return nil
+	}
+
+	a.KeyHash = strings.TrimSpace(a.KeyHash)
+	if strings.HasPrefix(a.KeyHash, "argon2id$") {
+		a.KeyHash = "$" + a.KeyHash
+	}
+
+	if a.KeyHashType() == "" {
+		a.KeyHash = strings.ToLower(a.KeyHash)
+		if a.KeyHashType() == "" {
+			return errors.New("invalid key_hash, expected an argon2id hash or a sha256 hex digest")
+		}
+	}
+
+	return nil
+}
+
+// format of the key hash, empty if there is none or it is invalid
+func (a *Apicontext) KeyHashType() string {
+	switch {
+	case strings.HasPrefix(a.KeyHash, "$argon2id$"):
+		return KeyHashArgon2id
+	case regSha256Hex.MatchString(a.KeyHash):
+		return KeyHashSha256
+	}
+
+	return ""
+}
+
+// true if ip belongs to one of the configured trusted proxies
+func (c *Config) IsTrustedProxy(ip net.IP) bool {
+	for _, network := range c.TrustedNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parse a rate limit like "60/1m", empty or "0" means unlimited
+func ParseRate(limit string) (Rate, error) {
+	limit = strings.TrimSpace(limit)
+	if limit == "" || limit == "0" {
+		return Rate{}, nil
+	}
+
+	requests, period, found := strings.Cut(limit, "/")
+	if !found {
+		return Rate{}, errors.New("expected <requests>/<duration>, e.g. 60/1m")
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(requests))
+	if err != nil || count < 0 {
+		return Rate{}, fmt.Errorf("invalid number of requests %q", requests)
+	}
+
+	seconds, err := common.Duration2int(strings.TrimSpace(period))
+	if err != nil {
+		return Rate{}, err
+	}
+
+	return Rate{Requests: count, Period: time.Duration(seconds) * time.Second}, nil
+}
+
+func validIdStyle(style string) error {
+	switch style {
+	case "", "uuid", "words", "base32":
+		return nil
+	}
+
+	return errors.New("invalid idstyle " + style + ", expected uuid, words or base32")
+}
+
+func (c *Config) applyLogDefaults() error {
+	if c.Debug {
+		c.LogLevel = LogDebug
+	}
+
+	if c.LogLevel == "" {
+		c.LogLevel = LogInfo
+	}
+
+	switch c.LogLevel {
+	case LogDebug, LogInfo, LogWarn, LogError:
+	default:
+		return errors.New("invalid loglevel " + c.LogLevel + ", expected debug, info, warn or error")
+	}
+
+	switch c.LogFormat {
+	case "":
+		c.LogFormat = LogText
+	case LogText, LogJson:
+	default:
+		return errors.New("invalid logformat " + c.LogFormat + ", expected text or json")
+	}
+
+	return nil
+}
+
+func validRole(role string) error {
+	switch role {
+	case RoleAdmin, RoleReadOnly, RoleUploadOnly, RoleFormManager, RoleAuditor:
+		return nil
+	}
+
+	return errors.New("invalid role " + role +
+		", expected admin, read-only, upload-only, form-manager or auditor")
+}
+
+/*
+   All api contexts: the configured ones  plus those managed at runtime
+   using the admin api. Returns a snapshot, so  it's safe to use while
+   the runtime contexts change.
+*/
+func (c *Config) Contexts() []Apicontext {
+	if c.runtime == nil {
+		return c.Apicontexts
+	}
+
+	c.runtime.RLock()
+	defer c.runtime.RUnlock()
+
+	if len(c.runtime.contexts) == 0 {
+		return c.Apicontexts
+	}
+
+	return append(append([]Apicontext{}, c.Apicontexts...), c.runtime.contexts...)
+}
+
+// replace the api contexts managed at runtime, see Contexts()
+func (c *Config) SetRuntimeContexts(contexts []Apicontext) {
+	if c.runtime == nil {
+		c.runtime = &runtimeContexts{}
+	}
+
+	c.runtime.Lock()
+	defer c.runtime.Unlock()
+
+	c.runtime.contexts = contexts
+}
+
+// true if the api context is defined in the config, not at runtime
+func (c *Config) IsConfigContext(apicontext string) bool {
+	return findContext(c.Apicontexts, apicontext) != nil
+}
+
+func findContext(contexts []Apicontext, apicontext string) *Apicontext {
+	for i := range contexts {
+		if contexts[i].Context == apicontext {
+			return &contexts[i]
+		}
+	}
+
+	return nil
+}
+
+/*
+   The role of an api context. Without configured api contexts the
+   server  is unauthenticated and everyone  is admin, unknown contexts
+   have no role at all.
+*/
+func (c *Config) ContextRole(apicontext string) string {
+	contexts := c.Contexts()
+	if len(contexts) == 0 {
+		return RoleAdmin
+	}
+
+	if context := findContext(contexts, apicontext); context != nil {
+		if context.Role == "" {
+			return RoleAdmin
+		}
+		return context.Role
+	}
+
+	return ""
+}
+
+// names have to be unique, parents have to exist and must not form a cycle
+func ValidateContexts(contexts []Apicontext) error {
+	for i, apicontext := range contexts {
+		if findContext(contexts[:i], apicontext.Context) != nil {
+			return fmt.Errorf("api context %s: defined twice", apicontext.Context)
+		}
+	}
+
+	for _, apicontext := range contexts {
+		if apicontext.Parent == "" {
+			continue
+		}
+
+		if findContext(contexts, apicontext.Parent) == nil {
+			return fmt.Errorf("api context %s: unknown parent %s", apicontext.Context, apicontext.Parent)
+		}
+
+		// a chain can't be longer than the number of contexts
+		current := apicontext.Parent
+		for depth := 0; current != ""; depth++ {
+			if current == apicontext.Context || depth > len(contexts) {
+				return fmt.Errorf("api context %s: parents form a cycle", apicontext.Context)
+			}
+			current = contextParent(contexts, current)
+		}
+	}
+
+	return nil
+}
+
+func contextParent(contexts []Apicontext, apicontext string) string {
+	if context := findContext(contexts, apicontext); context != nil {
+		return context.Parent
+	}
+
+	return ""
+}
+
+// the parent of an api context, empty if it has none
+func (c *Config) ContextParent(apicontext string) string {
+	return contextParent(c.Contexts(), apicontext)
+}
+
+/*
+   True if apicontext is ancestor itself or one of its descendants, that
+   is, entries of apicontext are visible to ancestor.
+*/
+func (c *Config) ContextWithin(apicontext, ancestor string) bool {
+	contexts := c.Contexts()
+
+	for depth := 0; apicontext != "" && depth <= len(contexts); depth++ {
+		if apicontext == ancestor {
+			return true
+		}
+		apicontext = contextParent(contexts, apicontext)
+	}
+
+	return false
+}
+
+// the id style of an api context, falls back to the global one
+func (c *Config) ContextIdStyle(apicontext string) string {
+	if context := findContext(c.Contexts(), apicontext); context != nil && context.IdStyle != "" {
+		return context.IdStyle
+	}
+
+	return c.IdStyle
+}
+
+// the default allowlist of an api context, empty if unrestricted
+func (c *Config) ContextAllow(apicontext string) []string {
+	if context := findContext(c.Contexts(), apicontext); context != nil {
+		return context.Allow
+	}
+
+	return nil
 }
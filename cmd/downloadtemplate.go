@@ -0,0 +1,57 @@
+package cmd
+
+const downloadtemplate = `
+<!DOCTYPE html>
+<!-- -*-web-*- -->
+<html lang="en">
+  <head>
+    <meta charset="UTF-8">
+    <meta http-equiv="Content-Type" content="text/html; charset=UTF-8" />
+    <meta http-equiv="X-UA-Compatible" content="IE=edge" />
+    <meta name="description" content="file download" />
+    <meta name="viewport" content="width=device-width, initial-scale=1.0" />
+    <meta name="robots" content="noindex, nofollow" />
+    <title>Download {{ .File }}</title>
+    <link href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.0-alpha2/dist/css/bootstrap.min.css"
+          rel="stylesheet" integrity="sha384-aFq/bzH65dt+w6FI2ooMVUpc+21e0SRygnTpmBvdBgSdnuTN7QbdgL+OapgHtvPp" crossorigin="anonymous">
+    <link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/bootstrap-icons@1.5.0/font/bootstrap-icons.css">
+  </head>
+  <body>
+    <div class="container">
+    <h4><i class="bi-file-earmark-arrow-down"></i> Download {{ .File }}</h4>
+
+    <div class="col-lg-12">
+      <form id="DownloadForm" action="{{ .Url }}" method="POST">
+        <div class="mb-3 row">
+          <label class="col-sm-2 col-form-label">File</label>
+          <label class="col-sm-10 col-form-label">{{ .File }} ({{ .Size }})</label>
+        </div>
+        {{ if .Description }}
+        <div class="mb-3 row">
+          <label class="col-sm-2 col-form-label">Description</label>
+          <label class="col-sm-10 col-form-label">{{ .Description }}</label>
+        </div>
+        {{ end }}
+        {{ if gt (len .Members) 1 }}
+        <div class="mb-3 row">
+          <label class="col-sm-2 col-form-label">Contains</label>
+          <div class="col-sm-10">
+            <ul class="list-unstyled col-form-label">
+              {{ range .Members }}<li>{{ . }}</li>{{ end }}
+            </ul>
+          </div>
+        </div>
+        {{ end }}
+        <div class="mb-3 row">
+          <label class="col-sm-2 col-form-label">Expires</label>
+          <label class="col-sm-10 col-form-label">{{ .Expire }}</label>
+        </div>
+
+        <input type="hidden" name="confirm" value="1"/>
+        <input type="submit" name="submit" class="btn btn-success" value="Download"/>
+      </form>
+    </div>
+    </div>
+  </body>
+</html>
+`
@@ -72,7 +72,7 @@ const formtemplate = `
            beforeSend: function(xhr){
                $('.submitBtn').attr("disabled","disabled");
                $('#UploadForm').css("opacity",".5");
-               xhr.setRequestHeader('Authorization', 'Bearer {{.Id}}');
+               xhr.setRequestHeader('Authorization', 'Bearer {{.Token}}');
            },
            success: function(response){
              $('.statusMsg').html('');
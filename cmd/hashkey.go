@@ -0,0 +1,80 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/tlinden/ephemerup/api"
+)
+
+/*
+   Implements `ephemerupd hash-key [--sha256] [key]`. Prints the hash of
+   an api key, to  be used as `key_hash` of an api context. The key is
+   read from stdin if not given, so it doesn't end up in the shell history.
+*/
+func HashKey(w io.Writer, r io.Reader, args []string) error {
+	var useSha256 bool
+
+	f := flag.NewFlagSet("hash-key", flag.ContinueOnError)
+	f.BoolVarP(&useSha256, "sha256", "", false, "Create a sha256 hex digest instead of an argon2id hash")
+
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+
+	var key string
+	switch f.NArg() {
+	case 0:
+		line, err := bufio.NewReader(r).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return errors.New("error reading key: " + err.Error())
+		}
+		key = strings.TrimSpace(line)
+	case 1:
+		key = f.Arg(0)
+	default:
+		return errors.New("usage: ephemerupd hash-key [--sha256] [key]")
+	}
+
+	if key == "" {
+		return errors.New("no key given")
+	}
+
+	if useSha256 {
+		hash := sha256.Sum256([]byte(key))
+		fmt.Fprintln(w, hex.EncodeToString(hash[:]))
+		return nil
+	}
+
+	hash, err := api.HashPassword(key)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, hash)
+
+	return nil
+}
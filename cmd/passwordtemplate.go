@@ -0,0 +1,47 @@
+package cmd
+
+const passwordtemplate = `
+<!DOCTYPE html>
+<!-- -*-web-*- -->
+<html lang="en">
+  <head>
+    <meta charset="UTF-8">
+    <meta http-equiv="Content-Type" content="text/html; charset=UTF-8" />
+    <meta http-equiv="X-UA-Compatible" content="IE=edge" />
+    <meta name="description" content="password protected download" />
+    <meta name="viewport" content="width=device-width, initial-scale=1.0" />
+    <meta name="robots" content="noindex, nofollow" />
+    <title>Password protected download</title>
+    <link href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.0-alpha2/dist/css/bootstrap.min.css"
+          rel="stylesheet" integrity="sha384-aFq/bzH65dt+w6FI2ooMVUpc+21e0SRygnTpmBvdBgSdnuTN7QbdgL+OapgHtvPp" crossorigin="anonymous">
+    <link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/bootstrap-icons@1.5.0/font/bootstrap-icons.css">
+  </head>
+  <body>
+    <div class="container">
+    <h4><i class="bi-lock"></i> Protected download</h4>
+
+    {{ if .Message }}
+    <p class="alert alert-danger">{{ .Message }}</p>
+    {{ end }}
+
+    <div class="col-lg-12">
+      <form id="PasswordForm" action="{{ .Url }}" method="POST">
+        <div class="mb-3 row">
+          <p>
+            This download is protected by a password. Please enter it to start the download.
+          </p>
+        </div>
+        <div class="mb-3 row">
+          <label for="password" class="col-sm-2 col-form-label">Password</label>
+          <div class="col-sm-10">
+            <input type="password" class="form-control" id="password" name="password" autofocus required/>
+          </div>
+        </div>
+
+        <input type="submit" name="submit" class="btn btn-success" value="Download"/>
+      </form>
+    </div>
+    </div>
+  </body>
+</html>
+`
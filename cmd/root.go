@@ -28,7 +28,6 @@ import (
 
 	flag "github.com/spf13/pflag"
 
-	"github.com/alecthomas/repr"
 	"github.com/tlinden/ephemerup/api"
 	"github.com/tlinden/ephemerup/cfg"
 
@@ -48,6 +47,11 @@ func Execute() error {
 		ShowVersion bool
 	)
 
+	// helper to create key hashes for the config
+	if len(os.Args) > 1 && os.Args[1] == "hash-key" {
+		return HashKey(os.Stdout, os.Stdin, os.Args[2:])
+	}
+
 	f := flag.NewFlagSet("config", flag.ContinueOnError)
 	f.Usage = func() {
 		fmt.Println(f.FlagUsages())
@@ -57,6 +61,8 @@ func Execute() error {
 	f.BoolVarP(&ShowVersion, "version", "v", false, "Print program version")
 	f.StringVarP(&cfgFile, "config", "c", "", "custom config file")
 	f.BoolVarP(&conf.Debug, "debug", "d", false, "Enable debugging")
+	f.StringVarP(&conf.LogLevel, "loglevel", "", "info", "Log level: debug, info, warn or error")
+	f.StringVarP(&conf.LogFormat, "logformat", "", "text", "Log format: text or json")
 	f.StringVarP(&conf.Listen, "listen", "l", ":8080", "listen to custom ip:port (use [ip]:port for ipv6)")
 	f.StringVarP(&conf.StorageDir, "storagedir", "s", "/tmp", "storage directory for uploaded files")
 	f.StringVarP(&conf.ApiPrefix, "apiprefix", "a", "", "API endpoint path")
@@ -66,11 +72,40 @@ func Execute() error {
 	f.StringVarP(&conf.Frontpage, "frontpage", "", "welcome to upload api, use /api enpoint!",
 		"Content or filename to be displayed on / in case someone visits")
 	f.StringVarP(&conf.Formpage, "formpage", "", "", "Content or filename to be displayed for forms (must be a go template)")
+	f.StringVarP(&conf.Passwordpage, "passwordpage", "", "",
+		"Content or filename to be displayed for password protected downloads (must be a go template)")
+	f.StringVarP(&conf.Downloadpage, "downloadpage", "", "",
+		"Content or filename to be displayed to browsers before downloading (must be a go template)")
+	f.StringVarP(&conf.AuditRetention, "auditretention", "", "90d", "How long to keep audit log entries (0: forever)")
+
+	f.StringSliceVarP(&conf.PreviewAgents, "previewagents", "", []string{},
+		"Additional user agents of link preview crawlers, which must not consume uploads")
+	f.StringVarP(&conf.IdStyle, "idstyle", "", "uuid", "Style of upload and form ids: uuid, words or base32")
+	f.StringVarP(&conf.SigningKey, "signingkey", "", "",
+		"Secret used to sign download links (generated and stored in the db if unset)")
+	f.StringVarP(&conf.PreviousSigningKey, "previoussigningkey", "", "",
+		"Former signing key, links and form tokens signed with it stay valid")
+	f.StringVarP(&conf.LinkValidity, "linkvalidity", "", "1h", "Default validity of signed download links")
+	f.BoolVarP(&conf.SignedOnly, "signedonly", "", false, "Only allow downloads using signed links")
+
+	f.StringVarP(&conf.Jwks, "jwks", "", "", "File or url of the JWKS to verify JWT bearer tokens with")
+	f.StringVarP(&conf.JwtIssuer, "jwtissuer", "", "", "Required issuer of JWT bearer tokens")
+	f.StringVarP(&conf.JwtAudience, "jwtaudience", "", "", "Required audience of JWT bearer tokens")
+	f.StringVarP(&conf.JwtContextClaim, "jwtcontextclaim", "", "apicontext",
+		"JWT claim containing the API context")
+	f.StringVarP(&conf.JwtRoleClaim, "jwtroleclaim", "", "role", "JWT claim containing the role")
+
+	f.StringVarP(&conf.MetricsToken, "metricstoken", "", "", "Bearer token required to fetch /metrics")
 
 	// server settings
 	f.BoolVarP(&conf.V4only, "ipv4", "4", false, "Only listen on ipv4")
 	f.BoolVarP(&conf.V6only, "ipv6", "6", false, "Only listen on ipv6")
 
+	f.StringSliceVarP(&conf.TrustedProxies, "trustedproxies", "", []string{},
+		"Ips or networks of reverse proxies whose client ip header is trusted")
+	f.StringVarP(&conf.ProxyHeader, "proxyheader", "", "X-Forwarded-For",
+		"Header containing the client ip, set by trusted proxies")
+
 	f.BoolVarP(&conf.Prefork, "prefork", "p", false, "Prefork server threads")
 	f.StringVarP(&conf.AppName, "appname", "n", "ephemerupd "+conf.GetVersion(), "App name to say hi as")
 	f.IntVarP(&conf.BodyLimit, "bodylimit", "b", 10250000000, "Max allowed upload size in bytes")
@@ -84,6 +119,36 @@ func Execute() error {
 		return errors.New("You cannot mix -4 and -6!")
 	}
 
+	if err := loadConfig(f, &conf); err != nil {
+		return err
+	}
+
+	switch {
+	case ShowVersion:
+		fmt.Println(cfg.Getversion())
+		return nil
+	default:
+		if err := conf.ApplyDefaults(); err != nil {
+			return err
+		}
+		return api.Runserver(&conf, flag.Args(), func() (*cfg.Config, error) {
+			// on reload, start from scratch using the same sources
+			reloaded := &cfg.Config{}
+			if err := loadConfig(f, reloaded); err != nil {
+				return nil, err
+			}
+
+			return reloaded, reloaded.ApplyDefaults()
+		})
+	}
+}
+
+/*
+   Load  the config  from the config  files, the environment  and the
+   commandline flags  (in this order) into conf. Files given for pages
+   are read. Also used to reload the config, see api.Reload().
+*/
+func loadConfig(f *flag.FlagSet, conf *cfg.Config) error {
 	// config provider
 	var k = koanf.New(".")
 
@@ -100,12 +165,13 @@ func Execute() error {
 			"ephemerup.hcl",
 		}
 	}
-	repr.Print(configfiles)
+	loaded := []string{}
 	for _, cfgfile := range configfiles {
 		if _, err := os.Stat(cfgfile); err == nil {
 			if err := k.Load(file.Provider(cfgfile), hcl.Parser(true)); err != nil {
 				return errors.New("error loading config file: " + err.Error())
 			}
+			loaded = append(loaded, cfgfile)
 		}
 		// else: we ignore the file if it doesn't exists
 	}
@@ -124,16 +190,15 @@ func Execute() error {
 	}
 
 	// fetch values
-	if err := k.Unmarshal("", &conf); err != nil {
+	if err := k.Unmarshal("", conf); err != nil {
 		return errors.New("error unmarshalling: " + err.Error())
 	}
 
 	// there may exist some api context variables
-	GetApicontextsFromEnv(&conf)
+	GetApicontextsFromEnv(conf)
 
-	if conf.Debug {
-		repr.Print(conf)
-	}
+	// logged by the server, secrets redacted
+	conf.ConfigFiles = loaded
 
 	// Frontpage?
 	if conf.Frontpage != "" {
@@ -166,14 +231,41 @@ func Execute() error {
 		conf.Formpage = formtemplate
 	}
 
-	switch {
-	case ShowVersion:
-		fmt.Println(cfg.Getversion())
-		return nil
-	default:
-		conf.ApplyDefaults()
-		return api.Runserver(&conf, flag.Args())
+	// Passwordpage?
+	if conf.Passwordpage != "" {
+		if _, err := os.Stat(conf.Passwordpage); err == nil {
+			// it's a filename, try to use it
+			content, err := ioutil.ReadFile(conf.Passwordpage)
+			if err != nil {
+				return errors.New("error loading config: " + err.Error())
+			}
+
+			// replace the filename
+			conf.Passwordpage = string(content)
+		}
+	} else {
+		// use builtin default
+		conf.Passwordpage = passwordtemplate
+	}
+
+	// Downloadpage?
+	if conf.Downloadpage != "" {
+		if _, err := os.Stat(conf.Downloadpage); err == nil {
+			// it's a filename, try to use it
+			content, err := ioutil.ReadFile(conf.Downloadpage)
+			if err != nil {
+				return errors.New("error loading config: " + err.Error())
+			}
+
+			// replace the filename
+			conf.Downloadpage = string(content)
+		}
+	} else {
+		// use builtin default
+		conf.Downloadpage = downloadtemplate
 	}
+
+	return nil
 }
 
 /*
@@ -188,6 +280,10 @@ eg:
    EPHEMERUPD_CONTEXT_SUPPORT="support:tymag-fycyh-gymof-dysuf-doseb-puxyx"
                       ^^^^^^^- doesn't matter.
 
+   Hashed keys (see `ephemerupd hash-key`) use this format:
+
+   EPHEMERUPD_CONTEXTHASH_$(NAME)="<context>:<key hash>"
+
    Modifies cfg.Config directly
 */
 func GetApicontextsFromEnv(conf *cfg.Config) {
@@ -201,6 +297,13 @@ func GetApicontextsFromEnv(conf *cfg.Config) {
 				contexts = append(contexts, cfg.Apicontext{Context: c[0], Key: c[1]})
 			}
 		}
+
+		if strings.HasPrefix(pair[0], "EPHEMERUPD_CONTEXTHASH_") {
+			c := strings.SplitN(pair[1], ":", 2)
+			if len(c) == 2 {
+				contexts = append(contexts, cfg.Apicontext{Context: c[0], KeyHash: c[1]})
+			}
+		}
 	}
 
 	contexts = append(contexts, conf.Apicontexts...)
@@ -2,30 +2,98 @@ package common
 
 import (
 	"fmt"
+	"net"
+	"regexp"
 	"testing"
 	"time"
 )
 
 func TestDuration2Seconds(t *testing.T) {
 	var tests = []struct {
-		dur    string
-		expect int
+		dur     string
+		expect  int
+		wanterr bool
 	}{
-		{"1d", 60 * 60 * 24},
-		{"1h", 60 * 60},
-		{"10m", 60 * 10},
-		{"2h4m10s", (60 * 120) + (4 * 60) + 10},
-		{"88u", 0},
-		{"19t77X what?4s", 4},
+		{"1d", 60 * 60 * 24, false},
+		{"1h", 60 * 60, false},
+		{"10m", 60 * 10, false},
+		{"2h4m10s", (60 * 120) + (4 * 60) + 10, false},
+		{"2w", 60 * 60 * 24 * 14, false},
+		{"1M1d", 60 * 60 * 24 * 31, false},
+		{"88u", 0, true},
+		{"10x", 0, true},
+		{"19t77X what?4s", 0, true},
+		{"", 0, true},
+		{"0s", 0, true},
+		{"0d0h", 0, true},
+		{"-1d", 0, true},
+		{"68w", 60 * 60 * 24 * 7 * 68, false},
+		{"99999999999999999999s", 0, true},
+		{"9223372036854775807M", 0, true},
+		{"3000M", 0, true},
+		{"2147483647s1s", 0, true},
 	}
 
 	for _, tt := range tests {
 		testname := fmt.Sprintf("duration-%s", tt.dur)
 		t.Run(testname, func(t *testing.T) {
-			seconds := duration2int(tt.dur)
+			seconds, err := Duration2int(tt.dur)
 			if seconds != tt.expect {
 				t.Errorf("got %d, want %d", seconds, tt.expect)
 			}
+			if (err != nil) != tt.wanterr {
+				t.Errorf("got error: %v, wanterr: %t", err, tt.wanterr)
+			}
+		})
+	}
+}
+
+func TestValidateExpire(t *testing.T) {
+	var tests = []struct {
+		expire  string
+		wanterr bool
+	}{
+		{"asap", false},
+		{"3d12h", false},
+		{time.Now().Add(time.Hour).Format(time.RFC3339), false},
+		{time.Now().Add(-time.Hour).Format(time.RFC3339), true},
+		{"10x", true},
+		{"tomorrow", true},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("validateexpire-%s", tt.expire)
+		t.Run(testname, func(t *testing.T) {
+			err := ValidateExpire(tt.expire)
+			if (err != nil) != tt.wanterr {
+				t.Errorf("got error: %v, wanterr: %t", err, tt.wanterr)
+			}
+		})
+	}
+}
+
+func TestExpiresAt(t *testing.T) {
+	start := time.Date(2023, 3, 10, 11, 45, 0, 0, time.UTC)
+
+	var tests = []struct {
+		expire string
+		expect time.Time
+	}{
+		{"asap", start.Add(time.Hour)},
+		{"1w", start.Add(7 * 24 * time.Hour)},
+		{"2023-04-01T00:00:00Z", time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("expiresat-%s", tt.expire)
+		t.Run(testname, func(t *testing.T) {
+			got, err := ExpiresAt(start, tt.expire, 3600)
+			if err != nil {
+				t.Errorf("got error: %s", err)
+			}
+			if !got.Equal(tt.expect) {
+				t.Errorf("got %s, want %s", got, tt.expect)
+			}
 		})
 	}
 }
@@ -66,7 +134,7 @@ func TestUntaint(t *testing.T) {
 	for _, tt := range tests {
 		testname := fmt.Sprintf("untaint-%s-%s", tt.want, tt.expect)
 		t.Run(testname, func(t *testing.T) {
-			untainted, err := Untaint(tt.input, tt.want)
+			untainted, err := Untaint(tt.input, regexp.MustCompile(tt.want))
 			if untainted != tt.expect {
 				t.Errorf("got %s, want %s", untainted, tt.expect)
 			}
@@ -76,3 +144,83 @@ func TestUntaint(t *testing.T) {
 		})
 	}
 }
+
+func TestIPAllowed(t *testing.T) {
+	var tests = []struct {
+		ip     string
+		allow  []string
+		expect bool
+	}{
+		{"10.0.0.1", []string{}, true},
+		{"10.0.0.1", []string{"10.0.0.0/8"}, true},
+		{"10.0.0.1", []string{"10.0.0.1"}, true},
+		{"10.0.0.2", []string{"10.0.0.1"}, false},
+		{"192.168.1.1", []string{"10.0.0.0/8", "172.16.0.0/12"}, false},
+		{"2001:db8::1", []string{"2001:db8::/32"}, true},
+		{"2001:db9::1", []string{"2001:db8::/32"}, false},
+		{"10.0.0.1", []string{"2001:db8::/32"}, false},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("ipallowed-%s-%v", tt.ip, tt.allow)
+		t.Run(testname, func(t *testing.T) {
+			allowed := IPAllowed(net.ParseIP(tt.ip), tt.allow)
+			if allowed != tt.expect {
+				t.Errorf("got %t, want %t", allowed, tt.expect)
+			}
+		})
+	}
+}
+
+func TestNormalizeAllowlist(t *testing.T) {
+	var tests = []struct {
+		allow   []string
+		expect  []string
+		wanterr bool
+	}{
+		{[]string{"10.1.2.3/8"}, []string{"10.0.0.0/8"}, false},
+		{[]string{"10.1.2.3"}, []string{"10.1.2.3/32"}, false},
+		{[]string{"10.1.2.3, 2001:db8::1"}, []string{"10.1.2.3/32", "2001:db8::1/128"}, false},
+		{[]string{""}, []string{}, false},
+		{[]string{"10.1.2.3", "any"}, []string{}, false},
+		{[]string{"10.1.2.300"}, nil, true},
+		{[]string{"10.0.0.0/33"}, nil, true},
+		{[]string{"example.com"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("normalize-%v", tt.allow)
+		t.Run(testname, func(t *testing.T) {
+			allow, err := NormalizeAllowlist(tt.allow)
+			if (err != nil) != tt.wanterr {
+				t.Errorf("got error: %v, wanterr: %t", err, tt.wanterr)
+			}
+			if fmt.Sprint(allow) != fmt.Sprint(tt.expect) {
+				t.Errorf("got %v, want %v", allow, tt.expect)
+			}
+		})
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	var tests = []struct {
+		size   int64
+		expect string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KB"},
+		{1536, "1.5 KB"},
+		{5 * 1024 * 1024, "5.0 MB"},
+		{3 * 1024 * 1024 * 1024, "3.0 GB"},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("humansize-%d", tt.size)
+		t.Run(testname, func(t *testing.T) {
+			if got := HumanSize(tt.size); got != tt.expect {
+				t.Errorf("got %s, want %s", got, tt.expect)
+			}
+		})
+	}
+}
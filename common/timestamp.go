@@ -17,6 +17,8 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package common
 
 import (
+	"fmt"
+	"math"
 	"regexp"
 	"strconv"
 	"time"
@@ -62,6 +64,25 @@ func (t *Timestamp) parseUnix(data []byte) error {
 	return nil
 }
 
+var (
+	regDuration     = regexp.MustCompile(`(\d+)([Mwdhms])`)
+	regDurationFull = regexp.MustCompile(`^(\d+[Mwdhms])+$`)
+)
+
+// seconds per duration unit
+var units = map[byte]int64{
+	'M': 86400 * 30,
+	'w': 86400 * 7,
+	'd': 86400,
+	'h': 3600,
+	'm': 60,
+	's': 1,
+}
+
+// longest duration in seconds, which still fits into a time.Duration
+// and an int on 32 bit platforms
+const maxSeconds = math.MaxInt32
+
 /*
    We could use time.ParseDuration(), but this doesn't support days.
 
@@ -70,27 +91,94 @@ func (t *Timestamp) parseUnix(data []byte) error {
    gem. And  we don't need a  time.Time value.
 
    Convert a  duration into  seconds (int).
-   Valid  time units  are "s", "m", "h" and "d".
+   Valid  time units  are "s", "m", "h", "d", "w" (7 days) and "M" (30
+   days). Anything else leads to an error, as do durations of zero and
+   durations too long to be represented as time.Duration.
+*/
+func Duration2int(duration string) (int, error) {
+	if !regDurationFull.MatchString(duration) {
+		return 0, fmt.Errorf("invalid duration %q, use numbers and the units M,w,d,h,m,s", duration)
+	}
+
+	var seconds int64
+
+	for _, match := range regDuration.FindAllStringSubmatch(duration, -1) {
+		v, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q: %s", duration, err)
+		}
+
+		unit := units[match[2][0]]
+		if v > (maxSeconds-seconds)/unit {
+			return 0, fmt.Errorf("invalid duration %q: too long", duration)
+		}
+
+		seconds += v * unit
+	}
+
+	if seconds == 0 {
+		return 0, fmt.Errorf("invalid duration %q: must not be zero", duration)
+	}
+
+	return int(seconds), nil
+}
+
+/*
+   Calculate  the  absolute  expiry time  of  an  entry created  at
+   start. Expire  may be "asap",  a duration (see  Duration2int()) or
+   an RFC3339  timestamp. Entries expiring asap  are being removed at
+   the latest after asapdefault seconds.
+*/
+func ExpiresAt(start time.Time, expire string, asapdefault int) (time.Time, error) {
+	if expire == "asap" {
+		return start.Add(time.Duration(asapdefault) * time.Second), nil
+	}
+
+	if ts, err := time.Parse(time.RFC3339, expire); err == nil {
+		return ts, nil
+	}
+
+	seconds, err := Duration2int(expire)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return start.Add(time.Duration(seconds) * time.Second), nil
+}
+
+/*
+   Check  user  input for  a  valid  expire  setting. Durations  must
+   consist of valid units only and absolute dates must lie in the future.
 */
-func Duration2int(duration string) int {
-	re := regexp.MustCompile(`(\d+)([dhms])`)
-	seconds := 0
-
-	for _, match := range re.FindAllStringSubmatch(duration, -1) {
-		if len(match) == 3 {
-			v, _ := strconv.Atoi(match[1])
-			switch match[2][0] {
-			case 'd':
-				seconds += v * 86400
-			case 'h':
-				seconds += v * 3600
-			case 'm':
-				seconds += v * 60
-			case 's':
-				seconds += v
-			}
+func ValidateExpire(expire string) error {
+	if expire == "asap" {
+		return nil
+	}
+
+	if ts, err := time.Parse(time.RFC3339, expire); err == nil {
+		if !ts.After(time.Now()) {
+			return fmt.Errorf("expire date %s lies in the past", expire)
 		}
+		return nil
+	}
+
+	_, err := Duration2int(expire)
+	return err
+}
+
+/*
+   Returns true if the  expire time of an entry  created at start has
+   been reached. Entries expiring asap never expire by time here.
+*/
+func IsExpired(start time.Time, expire string) bool {
+	if expire == "asap" {
+		return false
+	}
+
+	ts, err := ExpiresAt(start, expire, 0)
+	if err != nil {
+		return false
 	}
 
-	return seconds
+	return !time.Now().Before(ts)
 }
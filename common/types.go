@@ -41,40 +41,101 @@ type Dbentry interface {
 }
 
 type Upload struct {
-	Type        int       `json:"type"`
-	Id          string    `json:"id"`
-	Expire      string    `json:"expire"`
-	File        string    `json:"file"`    // final filename (visible to the downloader)
-	Members     []string  `json:"members"` // contains multiple files, so File is an archive
-	Created     Timestamp `json:"uploaded"`
-	Context     string    `json:"context"`
-	Description string    `json:"description"`
-	Url         string    `json:"url"`
+	Type         int       `json:"type"`
+	Id           string    `json:"id"`
+	ShortId      string    `json:"shortid"` // optional human friendly id
+	Expire       string    `json:"expire"`
+	File         string    `json:"file"`    // final filename (visible to the downloader)
+	Members      []string  `json:"members"` // contains multiple files, so File is an archive
+	Created      Timestamp `json:"uploaded"`
+	Context      string    `json:"context"`
+	Description  string    `json:"description"`
+	Url          string    `json:"url"`
+	MaxDownloads int       `json:"maxdownloads"` // 0: unlimited
+	Downloads    int       `json:"downloads"`    // maintained by the server
+	ExpiresAt    Timestamp `json:"expires_at"`   // computed by the server
+	Protected    bool      `json:"protected"`    // true if a password is required to download
+	Allow        []string  `json:"allow"`        // networks allowed to download, empty: everyone
+
+	LinkGeneration int    `json:"linkgeneration"` // incremented to revoke all signed links
+	FormId         string `json:"formid"`         // set if uploaded using a form
+}
+
+// a signed download link of an upload
+type Link struct {
+	Id        string    `json:"id"` // the upload id
+	Url       string    `json:"url"`
+	ExpiresAt Timestamp `json:"expires_at"`
+	SingleUse bool      `json:"singleuse"`
+}
+
+// a scoped api token, the secret is only returned once when created
+type Token struct {
+	Id        string    `json:"id"`
+	Label     string    `json:"label"`
+	Context   string    `json:"context"`
+	Scopes    []string  `json:"scopes"`
+	Created   Timestamp `json:"created"`
+	ExpiresAt Timestamp `json:"expires_at"`
+	Secret    string    `json:"secret,omitempty"`
+}
+
+// api contexts, as returned by the admin api
+type ApiContext struct {
+	Context string   `json:"context"`
+	Role    string   `json:"role"`
+	Parent  string   `json:"parent,omitempty"`
+	Allow   []string `json:"allow,omitempty"`
+	IdStyle string   `json:"idstyle,omitempty"`
+	Source  string   `json:"source"`        // config or runtime
+	Key     string   `json:"key,omitempty"` // only returned on creation and rotation
 }
 
 // this one is also used for marshalling to the client
 type Response struct {
-	Uploads []*Upload `json:"uploads"`
-	Forms   []*Form   `json:"forms"`
+	Uploads  []*Upload     `json:"uploads"`
+	Forms    []*Form       `json:"forms"`
+	Audit    []*AuditEntry `json:"audit,omitempty"`
+	Links    []*Link       `json:"links,omitempty"`
+	Tokens   []*Token      `json:"tokens,omitempty"`
+	Contexts []*ApiContext `json:"contexts,omitempty"`
 
 	// integrate the Result struct so we can signal success
 	Result
 }
 
 type Form struct {
-	// Note the dual use of the Id: it will be used as onetime api key
-	// from generated upload forms and  stored in the session store so
-	// that the upload handler is able to check if the form object has
-	// to be deleted immediately (if  its expire field has been set to
-	// asap)
+	// Uploads using a form  are authenticated with the form token, it
+	// is separate from the public form id. The form id is stored in the
+	// request principal so that the upload handler is able to check if
+	// the form object has to be deleted immediately (if its expire field
+	// has been set to asap)
 	Type        int       `json:"type"`
 	Id          string    `json:"id"`
+	ShortId     string    `json:"shortid"` // optional human friendly id
 	Expire      string    `json:"expire"`
 	Description string    `json:"description"`
 	Created     Timestamp `json:"uploaded"`
 	Context     string    `json:"context"`
 	Url         string    `json:"url"`
 	Notify      string    `json:"notify"`
+	ExpiresAt   Timestamp `json:"expires_at"`      // computed by the server
+	Allow       []string  `json:"allow"`           // networks allowed to use the form, empty: everyone
+	Token       string    `json:"token,omitempty"` // upload secret, derived from the id, never stored
+}
+
+// one entry of the append-only audit trail
+type AuditEntry struct {
+	Id        string    `json:"id"`
+	Time      Timestamp `json:"time"`
+	Action    string    `json:"action"`  // create, modify, delete, download, expire, authfail
+	Object    string    `json:"object"`  // upload or form, empty for auth failures
+	Target    string    `json:"target"`  // id of the upload or form
+	Context   string    `json:"context"` // the API context the operation happened in
+	RequestId string    `json:"requestid"`
+	Ip        string    `json:"ip"`
+	UserAgent string    `json:"useragent"`
+	Message   string    `json:"message"`
 }
 
 const (
@@ -151,6 +212,11 @@ func (form Form) MatchFile(r *regexp.Regexp) bool {
 	return false
 }
 
+// true if the upload has been downloaded as often as allowed
+func (upload Upload) DownloadsExhausted() bool {
+	return upload.MaxDownloads > 0 && upload.Downloads >= upload.MaxDownloads
+}
+
 func (upload Upload) IsType(t int) bool {
 	if upload.Type == t {
 		return true
@@ -18,7 +18,10 @@ package common
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"regexp"
+	"strings"
 )
 
 /*
@@ -43,3 +46,103 @@ func Untaint(input string, wanted *regexp.Regexp) (string, error) {
 
 	return untainted, nil
 }
+
+/*
+   Parse an allowlist entry, which is  either a network in CIDR notation
+   or a plain ip address, which is treated as a /32 (ipv4) or /128 (ipv6)
+   network.
+*/
+func ParseCIDR(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip address %q", entry)
+		}
+
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(entry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %q", entry)
+	}
+
+	return network, nil
+}
+
+/*
+   Validate  and normalize  an allowlist.  Returns the  networks in CIDR
+   notation or an error if one of them is invalid. Entries may contain
+   multiple comma separated networks. The keyword "any" results in an
+   empty list, which means unrestricted.
+*/
+func NormalizeAllowlist(allow []string) ([]string, error) {
+	normalized := []string{}
+
+	for _, entries := range allow {
+		for _, entry := range strings.Split(entries, ",") {
+			switch strings.TrimSpace(entry) {
+			case "":
+				continue
+			case "any":
+				return []string{}, nil
+			}
+
+			network, err := ParseCIDR(entry)
+			if err != nil {
+				return nil, err
+			}
+
+			normalized = append(normalized, network.String())
+		}
+	}
+
+	return normalized, nil
+}
+
+// true if ip is part of one of the networks, an empty list allows everyone
+func IPAllowed(ip net.IP, allow []string) bool {
+	if len(allow) == 0 {
+		return true
+	}
+
+	if ip == nil {
+		return false
+	}
+
+	for _, entry := range allow {
+		network, err := ParseCIDR(entry)
+		if err != nil {
+			continue
+		}
+
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// human readable file size, e.g. 1.5 MB
+func HumanSize(size int64) string {
+	const unit = 1024
+
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
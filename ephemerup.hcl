@@ -10,6 +10,16 @@ apicontexts = [
   {
     context = "foo",
     key = "970b391f22f515d96b3e9b86a2c62c627968828e47b356994d2e583188b4190a"
+    # instead of a plaintext key, use the output of `ephemerupd hash-key`:
+    # key_hash = "$argon2id$v=19$m=65536,t=1,p=4$..."
+    # restrict the key and uploads/forms of this context to some networks
+    # allow = ["10.0.0.0/8", "192.168.1.5"]
+    # what the context may do: admin (default), read-only, upload-only, form-manager or auditor
+    # role = "read-only"
+    # parent context, which sees and manages the uploads and forms of this one
+    # parent = "root"
+    # human friendly ids for uploads and forms of this context: uuid, words or base32
+    # idstyle = "words"
   }
 ]
 
@@ -24,3 +34,25 @@ mail = {
   from = "root@localhost"
   password = ""
 }
+
+# rate limits as "<requests>/<duration>", unlimited if unset or "0"
+# ratelimit = {
+#   ip = "300/1m"        # requests per client ip, all routes
+#   context = "600/1m"   # authenticated requests per api context
+#   uploads = "30/1m"    # uploads per api context
+#   downloads = "120/1m" # downloads and form pages per client ip
+#   authfail = "30/1m"   # failed authentications per client ip (default)
+# }
+
+# log level (debug, info, warn or error) and format (text or json)
+# loglevel = "info"
+# logformat = "json"
+
+# bearer token required to scrape /metrics, open if unset
+# metricstoken = "secret"
+
+# how long to keep audit log entries
+auditretention = "90d"
+
+# reverse proxies whose X-Forwarded-For header is trusted
+# trustedproxies = ["127.0.0.1"]
@@ -3,7 +3,6 @@ module github.com/tlinden/ephemerup
 go 1.18
 
 require (
-	github.com/alecthomas/repr v0.2.0
 	github.com/gofiber/fiber/v2 v2.42.0
 	github.com/gofiber/keyauth/v2 v2.1.32
 	github.com/google/uuid v1.3.0
@@ -12,9 +11,12 @@ require (
 	github.com/knadh/koanf/providers/file v0.1.0
 	github.com/knadh/koanf/providers/posflag v0.1.0
 	github.com/knadh/koanf/v2 v2.0.0
+	github.com/maxatome/go-testdeep v1.13.0
 	github.com/spf13/pflag v1.0.5
 	github.com/tlinden/ephemerup/common v0.0.0-00010101000000-000000000000
+	github.com/valyala/fasthttp v1.44.0
 	go.etcd.io/bbolt v1.3.7
+	golang.org/x/crypto v0.4.0
 )
 
 require (
@@ -27,7 +29,6 @@ require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.17 // indirect
 	github.com/mattn/go-runewidth v0.0.14 // indirect
-	github.com/maxatome/go-testdeep v1.13.0 // indirect
 	github.com/mitchellh/copystructure v1.2.0 // indirect
 	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/mitchellh/reflectwalk v1.0.2 // indirect
@@ -37,7 +38,6 @@ require (
 	github.com/savsgio/gotils v0.0.0-20220530130905-52f3993e8d6d // indirect
 	github.com/tinylib/msgp v1.1.6 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	github.com/valyala/fasthttp v1.44.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
 	golang.org/x/sys v0.4.0 // indirect
 )
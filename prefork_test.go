@@ -0,0 +1,219 @@
+//go:build !windows
+
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tlinden/ephemerup/common"
+)
+
+const preforkKey = "testkey"
+
+// output of the server and all its children
+type serverOutput struct {
+	sync.Mutex
+	lines []string
+}
+
+// number of lines containing the given string
+func (o *serverOutput) count(match string) int {
+	o.Lock()
+	defer o.Unlock()
+
+	n := 0
+	for _, l := range o.lines {
+		if strings.Contains(l, match) {
+			n++
+		}
+	}
+
+	return n
+}
+
+/*
+   Build ephemerupd and start it  in prefork mode with 3 children. The
+   server is killed including its children when the test is done.
+*/
+func startPreforkServer(t *testing.T) (string, *serverOutput) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "ephemerupd")
+
+	build := exec.Command("go", "build", "-o", binary, ".")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("Could not build server: %s\n%s", err, out)
+	}
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not find a free port: " + err.Error())
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	url := "http://" + addr
+	config := filepath.Join(dir, "ephemerup.hcl")
+	err = ioutil.WriteFile(config, []byte(fmt.Sprintf(`
+listen = "%s"
+url = "%s"
+dbfile = "%s"
+storagedir = "%s"
+prefork = true
+apicontexts = [ { context = "test", key = "%s" } ]
+`, addr, url, filepath.Join(dir, "uploads.db"), dir, preforkKey)), 0644)
+	if err != nil {
+		t.Fatalf("Could not write config: " + err.Error())
+	}
+
+	server := exec.Command(binary, "--config", config)
+	server.Env = append(os.Environ(), "GOMAXPROCS=3")
+	server.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdout, err := server.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Could not capture output: " + err.Error())
+	}
+	server.Stderr = server.Stdout
+
+	if err := server.Start(); err != nil {
+		t.Fatalf("Could not start server: " + err.Error())
+	}
+
+	output := &serverOutput{}
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			output.Lock()
+			output.lines = append(output.lines, strings.TrimSpace(scanner.Text()))
+			output.Unlock()
+		}
+	}()
+
+	t.Cleanup(func() {
+		// kill the process group, so the children go as well
+		syscall.Kill(-server.Process.Pid, syscall.SIGKILL)
+		server.Wait()
+	})
+
+	for i := 0; i < 100; i++ {
+		if resp, err := http.Get(url + "/status"); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return url, output
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatalf("Server did not start")
+	return "", nil
+}
+
+func preforkRequest(t *testing.T, client *http.Client, req *http.Request) (int, *common.Response) {
+	req.Header.Set("Authorization", "Bearer "+preforkKey)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	response := &common.Response{}
+	json.NewDecoder(resp.Body).Decode(response)
+
+	return resp.StatusCode, response
+}
+
+func TestPrefork(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping prefork integration test in short mode")
+	}
+
+	url, output := startPreforkServer(t)
+
+	// a new connection for every request, so they hit different children
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("upload[]", "t1")
+	part.Write([]byte("content"))
+	writer.WriteField("expire", "asap")
+	writer.Close()
+
+	req, _ := http.NewRequest("POST", url+"/v1/uploads", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	status, response := preforkRequest(t, client, req)
+	if status != http.StatusOK || len(response.Uploads) != 1 {
+		t.Fatalf("Upload failed: %d %s", status, response.Message)
+	}
+
+	id := response.Uploads[0].Id
+
+	// every child sees the upload
+	for i := 0; i < 10; i++ {
+		req, _ := http.NewRequest("GET", url+"/v1/uploads/"+id, nil)
+		if status, _ := preforkRequest(t, client, req); status != http.StatusOK {
+			t.Errorf("Describe %d failed with status %d", i, status)
+		}
+	}
+
+	// the asap upload can be downloaded exactly once
+	resp, err := client.Get(url + "/download/" + id)
+	if err != nil {
+		t.Fatalf("Download failed: " + err.Error())
+	}
+	content, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(content) != "content" {
+		t.Errorf("got %d %q, want 200 %q", resp.StatusCode, content, "content")
+	}
+
+	resp, err = client.Get(url + "/download/" + id)
+	if err != nil {
+		t.Fatalf("Download failed: " + err.Error())
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("asap upload has been downloaded twice")
+	}
+
+	// exactly one process runs the cleaner
+	if n := output.count("Starting background cleaner"); n != 1 {
+		t.Errorf("got %d background cleaners, want 1", n)
+	}
+}
@@ -33,10 +33,24 @@ type Config struct {
 	Silent   bool
 
 	// used for authentication
-	Apikey string
+	Apikey        string
+	ApikeyFile    string // read the key or token from this file
+	ApikeyCommand string // or from the output of this command
 
 	// upload
-	Expire string
+	Expire       string
+	MaxDownloads int
+
+	// upload and download of password protected uploads
+	Password string
+
+	// networks allowed to download an upload or use a form
+	Allow []string
+
+	// signed download links
+	Validity  string
+	SingleUse bool
+	Revoke    bool
 
 	// used for filtering (list command)
 	Apicontext string
@@ -50,6 +64,15 @@ type Config struct {
 	// required for forms
 	Description string
 	Notify      string
+
+	// required for api tokens
+	Label  string
+	Scopes []string
+
+	// required to manage api contexts
+	Role    string
+	Parent  string
+	IdStyle string
 }
 
 func Getversion() string {
@@ -0,0 +1,165 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"errors"
+	"github.com/spf13/cobra"
+	"github.com/tlinden/ephemerup/upctl/cfg"
+	"github.com/tlinden/ephemerup/upctl/lib"
+	"os"
+)
+
+func AdminCommand(conf *cfg.Config) *cobra.Command {
+	var adminCmd = &cobra.Command{
+		Use:   "admin {context}",
+		Short: "Admin commands",
+		Long:  `Administrative commands, require the key of the super API context.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return cmd.Help()
+			}
+			return nil
+		},
+	}
+
+	adminCmd.AddCommand(AdminContextCommand(conf))
+
+	return adminCmd
+}
+
+func AdminContextCommand(conf *cfg.Config) *cobra.Command {
+	var contextCmd = &cobra.Command{
+		Use:   "context {add|list|remove|rotate}",
+		Short: "Api context commands",
+		Long: `Manage API contexts at runtime. Changes take effect immediately,
+contexts defined in the server config can't be changed.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return cmd.Help()
+			}
+			return nil
+		},
+	}
+
+	contextCmd.Aliases = append(contextCmd.Aliases, "ctx")
+	contextCmd.Aliases = append(contextCmd.Aliases, "c")
+
+	contextCmd.AddCommand(AdminContextAddCommand(conf))
+	contextCmd.AddCommand(AdminContextListCommand(conf))
+	contextCmd.AddCommand(AdminContextRemoveCommand(conf))
+	contextCmd.AddCommand(AdminContextRotateCommand(conf))
+
+	return contextCmd
+}
+
+func AdminContextAddCommand(conf *cfg.Config) *cobra.Command {
+	var addCmd = &cobra.Command{
+		Use:   "add [options] <name>",
+		Short: "Add an api context",
+		Long: `Add a new API context. The generated key of the context is only
+shown once.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("No api context specified to add!")
+			}
+
+			// errors at this stage do not cause the usage to be shown
+			cmd.SilenceUsage = true
+
+			return lib.AddContext(os.Stdout, conf, args)
+		},
+	}
+
+	// options
+	addCmd.PersistentFlags().StringVarP(&conf.Role, "role", "r", "",
+		"Role of the context: admin, read-only, upload-only, form-manager, auditor (default: admin)")
+	addCmd.PersistentFlags().StringVarP(&conf.Parent, "parent", "p", "",
+		"Parent api context")
+	addCmd.PersistentFlags().StringSliceVarP(&conf.Allow, "allow", "", []string{},
+		"IP addresses or networks allowed to use the context (default: any)")
+	addCmd.PersistentFlags().StringVarP(&conf.IdStyle, "idstyle", "i", "",
+		"Style of upload and form ids of the context: uuid, words or base32")
+
+	addCmd.Aliases = append(addCmd.Aliases, "create")
+	addCmd.Aliases = append(addCmd.Aliases, "+")
+
+	return addCmd
+}
+
+func AdminContextListCommand(conf *cfg.Config) *cobra.Command {
+	var listCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List api contexts",
+		Long:  `List all API contexts, those from the config and those added at runtime.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// errors at this stage do not cause the usage to be shown
+			cmd.SilenceUsage = true
+
+			return lib.ListContexts(os.Stdout, conf)
+		},
+	}
+
+	listCmd.Aliases = append(listCmd.Aliases, "ls")
+	listCmd.Aliases = append(listCmd.Aliases, "l")
+
+	return listCmd
+}
+
+func AdminContextRemoveCommand(conf *cfg.Config) *cobra.Command {
+	var removeCmd = &cobra.Command{
+		Use:   "remove <name>",
+		Short: "Remove an api context",
+		Long:  `Remove an API context added at runtime, its key stops working immediately.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("No api context specified to remove!")
+			}
+
+			// errors at this stage do not cause the usage to be shown
+			cmd.SilenceUsage = true
+
+			return lib.RemoveContexts(os.Stdout, conf, args)
+		},
+	}
+
+	removeCmd.Aliases = append(removeCmd.Aliases, "rm")
+	removeCmd.Aliases = append(removeCmd.Aliases, "d")
+
+	return removeCmd
+}
+
+func AdminContextRotateCommand(conf *cfg.Config) *cobra.Command {
+	var rotateCmd = &cobra.Command{
+		Use:   "rotate <name>",
+		Short: "Rotate the key of an api context",
+		Long: `Replace the key of an API context added at runtime. The old key
+stops working immediately, the new one is only shown once.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("No api context specified to rotate!")
+			}
+
+			// errors at this stage do not cause the usage to be shown
+			cmd.SilenceUsage = true
+
+			return lib.RotateContext(os.Stdout, conf, args)
+		},
+	}
+
+	return rotateCmd
+}
@@ -68,11 +68,13 @@ func FormCreateCommand(conf *cfg.Config) *cobra.Command {
 
 	// options
 	formCreateCmd.PersistentFlags().StringVarP(&conf.Expire, "expire", "e", "",
-		"Expire setting: asap or duration (accepted shortcuts: dmh)")
+		"Expire setting: asap, duration (units: Mwdhms) or RFC3339 date")
 	formCreateCmd.PersistentFlags().StringVarP(&conf.Description, "description", "D", "",
 		"Description of the form")
 	formCreateCmd.PersistentFlags().StringVarP(&conf.Notify, "notify", "n", "",
 		"Email address to get notified when consumer has uploaded files")
+	formCreateCmd.PersistentFlags().StringSliceVarP(&conf.Allow, "allow", "", []string{},
+		"Restrict usage of the form to these ips or networks (any: unrestricted)")
 
 	formCreateCmd.Aliases = append(formCreateCmd.Aliases, "add")
 	formCreateCmd.Aliases = append(formCreateCmd.Aliases, "+")
@@ -99,11 +101,13 @@ func FormModifyCommand(conf *cfg.Config) *cobra.Command {
 
 	// options
 	formModifyCmd.PersistentFlags().StringVarP(&conf.Expire, "expire", "e", "",
-		"Expire setting: asap or duration (accepted shortcuts: dmh)")
+		"Expire setting: asap, duration (units: Mwdhms) or RFC3339 date")
 	formModifyCmd.PersistentFlags().StringVarP(&conf.Description, "description", "D", "",
 		"Description of the form")
 	formModifyCmd.PersistentFlags().StringVarP(&conf.Notify, "notify", "n", "",
 		"Email address to get notified when consumer has uploaded files")
+	formModifyCmd.PersistentFlags().StringSliceVarP(&conf.Allow, "allow", "", []string{},
+		"Restrict usage of the form to these ips or networks (any: remove the restriction)")
 
 	formModifyCmd.Aliases = append(formModifyCmd.Aliases, "mod")
 	formModifyCmd.Aliases = append(formModifyCmd.Aliases, "change")
@@ -125,7 +129,7 @@ func FormListCommand(conf *cfg.Config) *cobra.Command {
 	}
 
 	// options
-	listCmd.PersistentFlags().StringVarP(&conf.Apicontext, "apicontext", "", "", "Filter by given API context")
+	listCmd.PersistentFlags().StringVarP(&conf.Apicontext, "apicontext", "", "", "Filter by given API context, append /... to include its descendants")
 	listCmd.PersistentFlags().StringVarP(&conf.Query, "query", "q", "", "Filter by given query regexp")
 
 	listCmd.Aliases = append(listCmd.Aliases, "ls")
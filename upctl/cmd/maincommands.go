@@ -43,8 +43,14 @@ func UploadCommand(conf *cfg.Config) *cobra.Command {
 	}
 
 	// options
-	uploadCmd.PersistentFlags().StringVarP(&conf.Expire, "expire", "e", "", "Expire setting: asap or duration (accepted shortcuts: dmh)")
+	uploadCmd.PersistentFlags().StringVarP(&conf.Expire, "expire", "e", "", "Expire setting: asap, duration (units: Mwdhms) or RFC3339 date")
 	uploadCmd.PersistentFlags().StringVarP(&conf.Description, "description", "D", "", "Description of the form")
+	uploadCmd.PersistentFlags().IntVarP(&conf.MaxDownloads, "maxdownloads", "m", 0,
+		"Maximum number of downloads, combined with expire whichever comes first (0: unlimited)")
+	uploadCmd.PersistentFlags().StringVarP(&conf.Password, "password", "P", "",
+		"Protect the download with a password")
+	uploadCmd.PersistentFlags().StringSliceVarP(&conf.Allow, "allow", "", []string{},
+		"Restrict downloads to these ips or networks (any: unrestricted)")
 
 	uploadCmd.Aliases = append(uploadCmd.Aliases, "up")
 	uploadCmd.Aliases = append(uploadCmd.Aliases, "u")
@@ -66,7 +72,7 @@ func ListCommand(conf *cfg.Config) *cobra.Command {
 	}
 
 	// options
-	listCmd.PersistentFlags().StringVarP(&conf.Apicontext, "apicontext", "", "", "Filter by given API context")
+	listCmd.PersistentFlags().StringVarP(&conf.Apicontext, "apicontext", "", "", "Filter by given API context, append /... to include its descendants")
 	listCmd.PersistentFlags().StringVarP(&conf.Query, "query", "q", "", "Filter by given query regexp")
 
 	listCmd.Aliases = append(listCmd.Aliases, "ls")
@@ -139,6 +145,10 @@ func DownloadCommand(conf *cfg.Config) *cobra.Command {
 		},
 	}
 
+	// options
+	listCmd.PersistentFlags().StringVarP(&conf.Password, "password", "P", "",
+		"Password of a protected upload")
+
 	listCmd.Aliases = append(listCmd.Aliases, "down")
 	listCmd.Aliases = append(listCmd.Aliases, "get")
 	listCmd.Aliases = append(listCmd.Aliases, "g")
@@ -166,12 +176,50 @@ func ModifyCommand(conf *cfg.Config) *cobra.Command {
 
 	// options
 	uploadModifyCmd.PersistentFlags().StringVarP(&conf.Expire, "expire", "e", "",
-		"Expire setting: asap or duration (accepted shortcuts: dmh)")
+		"Expire setting: asap, duration (units: Mwdhms) or RFC3339 date")
 	uploadModifyCmd.PersistentFlags().StringVarP(&conf.Description, "description", "D", "",
 		"Description of the upload")
+	uploadModifyCmd.PersistentFlags().IntVarP(&conf.MaxDownloads, "maxdownloads", "m", 0,
+		"Maximum number of downloads (-1: remove the limit)")
+	uploadModifyCmd.PersistentFlags().StringSliceVarP(&conf.Allow, "allow", "", []string{},
+		"Restrict downloads to these ips or networks (any: remove the restriction)")
 
 	uploadModifyCmd.Aliases = append(uploadModifyCmd.Aliases, "mod")
 	uploadModifyCmd.Aliases = append(uploadModifyCmd.Aliases, "change")
 
 	return uploadModifyCmd
 }
+
+func LinkCommand(conf *cfg.Config) *cobra.Command {
+	var linkCmd = &cobra.Command{
+		Use:   "link [options] <id>",
+		Short: "Create a signed download link",
+		Long:  `Create a signed, time limited download link of an upload or revoke all of them.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("No id specified to create a link for!")
+			}
+
+			// errors at this stage do not cause the usage to be shown
+			cmd.SilenceUsage = true
+
+			if conf.Revoke {
+				return lib.RevokeLinks(os.Stdout, conf, args)
+			}
+
+			return lib.CreateLink(os.Stdout, conf, args)
+		},
+	}
+
+	// options
+	linkCmd.PersistentFlags().StringVarP(&conf.Validity, "validity", "V", "",
+		"How long the link is valid, duration (units: Mwdhms), default: server setting")
+	linkCmd.PersistentFlags().BoolVarP(&conf.SingleUse, "singleuse", "1", false,
+		"The link can only be used once")
+	linkCmd.PersistentFlags().BoolVarP(&conf.Revoke, "revoke", "", false,
+		"Revoke all outstanding links of the upload")
+
+	linkCmd.Aliases = append(linkCmd.Aliases, "sign")
+
+	return linkCmd
+}
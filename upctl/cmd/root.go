@@ -23,6 +23,7 @@ import (
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"github.com/tlinden/ephemerup/upctl/cfg"
+	"github.com/tlinden/ephemerup/upctl/lib"
 	"os"
 	"strings"
 )
@@ -86,6 +87,10 @@ func Execute() {
 	rootCmd.PersistentFlags().IntVarP(&conf.Retries, "retries", "r", 3, "How often shall we retry to access our endpoint")
 	rootCmd.PersistentFlags().StringVarP(&conf.Endpoint, "endpoint", "p", "http://localhost:8080/api/v1", "upload api endpoint url")
 	rootCmd.PersistentFlags().StringVarP(&conf.Apikey, "apikey", "a", "", "Api key to use")
+	rootCmd.PersistentFlags().StringVarP(&conf.ApikeyFile, "apikey-file", "", "",
+		"Read the api key or token from this file")
+	rootCmd.PersistentFlags().StringVarP(&conf.ApikeyCommand, "apikey-command", "", "",
+		"Use the output of this command as api key or token")
 
 	rootCmd.AddCommand(UploadCommand(&conf))
 	rootCmd.AddCommand(ListCommand(&conf))
@@ -93,10 +98,15 @@ func Execute() {
 	rootCmd.AddCommand(DescribeCommand(&conf))
 	rootCmd.AddCommand(DownloadCommand(&conf))
 	rootCmd.AddCommand(ModifyCommand(&conf))
+	rootCmd.AddCommand(LinkCommand(&conf))
 
 	// forms are being handled with its own subcommand
 	rootCmd.AddCommand(FormCommand(&conf))
 
+	// same for api tokens
+	rootCmd.AddCommand(TokenCommand(&conf))
+	rootCmd.AddCommand(AdminCommand(&conf))
+
 	err := rootCmd.Execute()
 	if err != nil {
 		os.Exit(1)
@@ -133,7 +143,11 @@ func initConfig(cmd *cobra.Command, cfg *cfg.Config) error {
 	v.SetEnvPrefix("upctl")
 
 	// map flags to viper
-	return bindFlags(cmd, v)
+	if err := bindFlags(cmd, v); err != nil {
+		return err
+	}
+
+	return lib.LoadApikey(cfg)
 }
 
 // bind flags to viper settings (env+cfgfile)
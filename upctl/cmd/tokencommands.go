@@ -0,0 +1,122 @@
+/*
+Copyright © 2023 Thomas von Dein
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"errors"
+	"github.com/spf13/cobra"
+	"github.com/tlinden/ephemerup/upctl/cfg"
+	"github.com/tlinden/ephemerup/upctl/lib"
+	"os"
+)
+
+func TokenCommand(conf *cfg.Config) *cobra.Command {
+	var tokenCmd = &cobra.Command{
+		Use:   "token {create|list|revoke}",
+		Short: "Api token commands",
+		Long:  `Manage scoped, expiring api tokens of your API context.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return cmd.Help()
+			}
+			return nil
+		},
+	}
+
+	tokenCmd.Aliases = append(tokenCmd.Aliases, "tok")
+	tokenCmd.Aliases = append(tokenCmd.Aliases, "t")
+
+	tokenCmd.AddCommand(TokenCreateCommand(conf))
+	tokenCmd.AddCommand(TokenListCommand(conf))
+	tokenCmd.AddCommand(TokenRevokeCommand(conf))
+
+	return tokenCmd
+}
+
+func TokenCreateCommand(conf *cfg.Config) *cobra.Command {
+	var tokenCreateCmd = &cobra.Command{
+		Use:   "create [options]",
+		Short: "Create a new api token",
+		Long: `Create a new api token for the API context of the calling key.
+The secret of the token is only shown once.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(conf.Scopes) == 0 {
+				return errors.New("No scopes specified!")
+			}
+
+			// errors at this stage do not cause the usage to be shown
+			cmd.SilenceUsage = true
+
+			return lib.CreateToken(os.Stdout, conf)
+		},
+	}
+
+	// options
+	tokenCreateCmd.PersistentFlags().StringVarP(&conf.Label, "label", "l", "",
+		"Label of the token")
+	tokenCreateCmd.PersistentFlags().StringSliceVarP(&conf.Scopes, "scopes", "s", []string{},
+		"Scopes granted to the token: upload, modify, list, download, delete, forms")
+	tokenCreateCmd.PersistentFlags().StringVarP(&conf.Expire, "expire", "e", "",
+		"Expire setting: duration (units: Mwdhms) or RFC3339 date (default: 30d)")
+
+	tokenCreateCmd.Aliases = append(tokenCreateCmd.Aliases, "add")
+	tokenCreateCmd.Aliases = append(tokenCreateCmd.Aliases, "+")
+
+	return tokenCreateCmd
+}
+
+func TokenListCommand(conf *cfg.Config) *cobra.Command {
+	var listCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List api tokens",
+		Long:  `List the api tokens of your API context.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// errors at this stage do not cause the usage to be shown
+			cmd.SilenceUsage = true
+
+			return lib.ListTokens(os.Stdout, conf)
+		},
+	}
+
+	listCmd.Aliases = append(listCmd.Aliases, "ls")
+	listCmd.Aliases = append(listCmd.Aliases, "l")
+
+	return listCmd
+}
+
+func TokenRevokeCommand(conf *cfg.Config) *cobra.Command {
+	var revokeCmd = &cobra.Command{
+		Use:   "revoke <id>",
+		Short: "Revoke an api token",
+		Long:  `Revoke an api token identified by its id`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return errors.New("No id specified to revoke!")
+			}
+
+			// errors at this stage do not cause the usage to be shown
+			cmd.SilenceUsage = true
+
+			return lib.RevokeTokens(os.Stdout, conf, args)
+		},
+	}
+
+	revokeCmd.Aliases = append(revokeCmd.Aliases, "rm")
+	revokeCmd.Aliases = append(revokeCmd.Aliases, "d")
+
+	return revokeCmd
+}
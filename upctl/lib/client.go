@@ -17,6 +17,7 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package lib
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,10 +28,15 @@ import (
 	"github.com/tlinden/ephemerup/common"
 	"github.com/tlinden/ephemerup/upctl/cfg"
 	"io"
+	"math/rand"
 	"mime"
+	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -50,8 +56,70 @@ type ListParams struct {
 	Query      string `json:"query"`
 }
 
+type LinkParams struct {
+	Validity  string `json:"validity"`
+	SingleUse bool   `json:"singleuse"`
+}
+
+type TokenParams struct {
+	Label  string   `json:"label"`
+	Scopes []string `json:"scopes"`
+	Expire string   `json:"expire"`
+}
+
+type ContextParams struct {
+	Context string   `json:"context"`
+	Role    string   `json:"role"`
+	Parent  string   `json:"parent"`
+	Allow   []string `json:"allow"`
+	IdStyle string   `json:"idstyle"`
+}
+
 const Maxwidth = 12
 
+// never wait longer than this before retrying a request
+const MaxRetryWait = time.Minute
+
+// used to send the password of protected uploads
+const PasswordHeader = "X-Download-Password"
+
+/*
+   Fill in the api key from a file or  the output of a command, if not
+   given directly.  Useful for  short lived tokens (e.g. JWTs) fetched
+   by a credential helper.
+*/
+func LoadApikey(c *cfg.Config) error {
+	switch {
+	case c.Apikey != "":
+		return nil
+	case c.ApikeyFile != "":
+		key, err := os.ReadFile(c.ApikeyFile)
+		if err != nil {
+			return errors.New("Could not read api key file: " + err.Error())
+		}
+		c.Apikey = strings.TrimSpace(string(key))
+	case c.ApikeyCommand != "":
+		var stderr bytes.Buffer
+
+		cmd := exec.Command("sh", "-c", c.ApikeyCommand)
+		cmd.Stderr = &stderr
+
+		key, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("Api key command failed: %s %s", err, strings.TrimSpace(stderr.String()))
+		}
+		c.Apikey = strings.TrimSpace(string(key))
+	default:
+		return nil
+	}
+
+	if c.Apikey == "" {
+		return errors.New("Got an empty api key!")
+	}
+
+	return nil
+}
+
 /*
    Create a new request object for outgoing queries
 */
@@ -68,10 +136,12 @@ func Setup(c *cfg.Config, path string) *Request {
 	if c.Retries > 0 {
 		// Enable retry and set the maximum retry count.
 		R.SetRetryCount(c.Retries).
-			//  Set  the  retry  sleep   interval  with  a  commonly  used
-			//   algorithm:  capped   exponential   backoff  with   jitter
-			// (https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/).
-			SetRetryBackoffInterval(1*time.Second, 5*time.Second).
+			// retry on errors and if the server asks us to come back later
+			SetRetryCondition(func(resp *req.Response, err error) bool {
+				return err != nil || resp.StatusCode == http.StatusTooManyRequests ||
+					resp.StatusCode == http.StatusServiceUnavailable
+			}).
+			SetRetryInterval(RetryInterval).
 			AddRetryHook(func(resp *req.Response, err error) {
 				req := resp.Request.RawRequest
 				if c.Debug {
@@ -92,6 +162,39 @@ func Setup(c *cfg.Config, path string) *Request {
 	return &Request{Url: c.Endpoint + path, R: R}
 }
 
+/*
+   How long to wait before retrying  a request: as long as the server
+   asks  for using  Retry-After  (or RateLimit-Reset  if rate limited),
+   otherwise  capped   exponential   backoff   with  jitter
+   (https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/).
+*/
+func RetryInterval(resp *req.Response, attempt int) time.Duration {
+	if resp != nil && resp.Response != nil {
+		headers := []string{"Retry-After"}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			headers = append(headers, "RateLimit-Reset")
+		}
+
+		for _, header := range headers {
+			seconds, err := strconv.Atoi(resp.Header.Get(header))
+			if err == nil && seconds >= 0 {
+				wait := time.Duration(seconds) * time.Second
+				if wait > MaxRetryWait {
+					wait = MaxRetryWait
+				}
+				return wait
+			}
+		}
+	}
+
+	backoff := 5 * time.Second
+	if attempt > 0 && attempt < 4 {
+		backoff = time.Second << (attempt - 1)
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+}
+
 /*
    Iterate over args, considering the  elements are filenames, and add
    them to the request.
@@ -190,8 +293,11 @@ func UploadFiles(w io.Writer, c *cfg.Config, args []string) error {
 	// actual post w/ settings
 	resp, err := rq.R.
 		SetFormData(map[string]string{
-			"expire":      c.Expire,
-			"description": c.Description,
+			"expire":       c.Expire,
+			"description":  c.Description,
+			"maxdownloads": strconv.Itoa(c.MaxDownloads),
+			"password":     c.Password,
+			"allow":        strings.Join(c.Allow, ","),
 		}).
 		Post(rq.Url)
 
@@ -305,6 +411,10 @@ func Download(w io.Writer, c *cfg.Config, args []string) error {
 
 	rq := Setup(c, "/uploads/"+id+"/file")
 
+	if c.Password != "" {
+		rq.R.SetHeader(PasswordHeader, c.Password)
+	}
+
 	if !c.Silent {
 		// progres bar
 		bar := progressbar.Default(100)
@@ -329,6 +439,7 @@ func Download(w io.Writer, c *cfg.Config, args []string) error {
 	}
 
 	if !resp.IsSuccessState() {
+		os.Remove(id)
 		return fmt.Errorf("bad response: %s", resp.Status)
 	}
 
@@ -366,8 +477,10 @@ func Modify(w io.Writer, c *cfg.Config, args []string, typ int) error {
 		rq = Setup(c, "/uploads/"+id)
 		rq.R.
 			SetBody(&common.Upload{
-				Expire:      c.Expire,
-				Description: c.Description,
+				Expire:       c.Expire,
+				Description:  c.Description,
+				MaxDownloads: c.MaxDownloads,
+				Allow:        c.Allow,
 			})
 	case common.TypeForm:
 		rq = Setup(c, "/forms/"+id)
@@ -376,6 +489,7 @@ func Modify(w io.Writer, c *cfg.Config, args []string, typ int) error {
 				Expire:      c.Expire,
 				Description: c.Description,
 				Notify:      c.Notify,
+				Allow:       c.Allow,
 			})
 	}
 
@@ -393,6 +507,46 @@ func Modify(w io.Writer, c *cfg.Config, args []string, typ int) error {
 	return RespondExtended(w, resp)
 }
 
+func CreateLink(w io.Writer, c *cfg.Config, args []string) error {
+	id := args[0]
+
+	rq := Setup(c, "/uploads/"+id+"/links")
+
+	resp, err := rq.R.
+		SetBody(&LinkParams{Validity: c.Validity, SingleUse: c.SingleUse}).
+		Post(rq.Url)
+
+	if err != nil {
+		return err
+	}
+
+	if err := HandleResponse(c, resp); err != nil {
+		return err
+	}
+
+	return RespondExtended(w, resp)
+}
+
+func RevokeLinks(w io.Writer, c *cfg.Config, args []string) error {
+	for _, id := range args {
+		rq := Setup(c, "/uploads/"+id+"/links")
+
+		resp, err := rq.R.Delete(rq.Url)
+
+		if err != nil {
+			return err
+		}
+
+		if err := HandleResponse(c, resp); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "Links of upload %s successfully revoked.\n", id)
+	}
+
+	return nil
+}
+
 /**** Forms stuff ****/
 func CreateForm(w io.Writer, c *cfg.Config) error {
 	// setup url, req.Request, timeout handling etc
@@ -404,6 +558,87 @@ func CreateForm(w io.Writer, c *cfg.Config) error {
 			Expire:      c.Expire,
 			Description: c.Description,
 			Notify:      c.Notify,
+			Allow:       c.Allow,
+		}).
+		Post(rq.Url)
+
+	if err != nil {
+		return err
+	}
+
+	if err := HandleResponse(c, resp); err != nil {
+		return err
+	}
+
+	return RespondExtended(w, resp)
+}
+
+/**** Api token stuff ****/
+func CreateToken(w io.Writer, c *cfg.Config) error {
+	rq := Setup(c, "/tokens")
+
+	resp, err := rq.R.
+		SetBody(&TokenParams{Label: c.Label, Scopes: c.Scopes, Expire: c.Expire}).
+		Post(rq.Url)
+
+	if err != nil {
+		return err
+	}
+
+	if err := HandleResponse(c, resp); err != nil {
+		return err
+	}
+
+	return RespondExtended(w, resp)
+}
+
+func ListTokens(w io.Writer, c *cfg.Config) error {
+	rq := Setup(c, "/tokens")
+
+	resp, err := rq.R.Get(rq.Url)
+
+	if err != nil {
+		return err
+	}
+
+	if err := HandleResponse(c, resp); err != nil {
+		return err
+	}
+
+	return TokensRespondTable(w, resp)
+}
+
+func RevokeTokens(w io.Writer, c *cfg.Config, args []string) error {
+	for _, id := range args {
+		rq := Setup(c, "/tokens/"+id)
+
+		resp, err := rq.R.Delete(rq.Url)
+
+		if err != nil {
+			return err
+		}
+
+		if err := HandleResponse(c, resp); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "Token %s successfully revoked.\n", id)
+	}
+
+	return nil
+}
+
+/**** Api context admin stuff ****/
+func AddContext(w io.Writer, c *cfg.Config, args []string) error {
+	rq := Setup(c, "/contexts")
+
+	resp, err := rq.R.
+		SetBody(&ContextParams{
+			Context: args[0],
+			Role:    c.Role,
+			Parent:  c.Parent,
+			Allow:   c.Allow,
+			IdStyle: c.IdStyle,
 		}).
 		Post(rq.Url)
 
@@ -417,3 +652,55 @@ func CreateForm(w io.Writer, c *cfg.Config) error {
 
 	return RespondExtended(w, resp)
 }
+
+func ListContexts(w io.Writer, c *cfg.Config) error {
+	rq := Setup(c, "/contexts")
+
+	resp, err := rq.R.Get(rq.Url)
+
+	if err != nil {
+		return err
+	}
+
+	if err := HandleResponse(c, resp); err != nil {
+		return err
+	}
+
+	return ContextsRespondTable(w, resp)
+}
+
+func RemoveContexts(w io.Writer, c *cfg.Config, args []string) error {
+	for _, name := range args {
+		rq := Setup(c, "/contexts/"+name)
+
+		resp, err := rq.R.Delete(rq.Url)
+
+		if err != nil {
+			return err
+		}
+
+		if err := HandleResponse(c, resp); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "Api context %s successfully removed.\n", name)
+	}
+
+	return nil
+}
+
+func RotateContext(w io.Writer, c *cfg.Config, args []string) error {
+	rq := Setup(c, "/contexts/"+args[0]+"/rotate")
+
+	resp, err := rq.R.Post(rq.Url)
+
+	if err != nil {
+		return err
+	}
+
+	if err := HandleResponse(c, resp); err != nil {
+		return err
+	}
+
+	return RespondExtended(w, resp)
+}
@@ -20,6 +20,7 @@ import (
 	//"github.com/alecthomas/repr"
 	"bytes"
 	"fmt"
+	"github.com/imroc/req/v3"
 	"github.com/jarcoal/httpmock"
 	"github.com/tlinden/ephemerup/common"
 	"github.com/tlinden/ephemerup/upctl/cfg"
@@ -31,6 +32,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 const endpoint string = "http://localhost:8080/v1"
@@ -254,9 +256,31 @@ func TestDescribe(t *testing.T) {
                        "message":"",
                        "code":200}`
 
+	limited := `{"uploads":[
+                         {
+                              "id":"cc2c965a","expire":"7d","file":"t1","members":["t1"],
+                              "uploaded":1679396814.890502,"context":"foo","url":"",
+                              "maxdownloads":5,"downloads":2,"shortid":"lake-moon-fern"
+                         }
+                       ],
+                       "success":true,
+                       "message":"",
+                       "code":200}`
+
 	listingnoaccess := `{"success":false,"message":"invalid context","code":503}`
 
 	tests := []Unit{
+		{
+			name:     "describe-download-limit",
+			apikey:   "token",
+			wantfail: false,
+			route:    "/uploads/",
+			sendcode: 200,
+			sendjson: limited,
+			files:    []string{"cc2c965a"},
+			method:   "GET",
+			expect:   `Short-Id: lake-moon-fern[\s\S]*Downloads: 2/5`,
+		},
 		{
 			name:     "describe",
 			apikey:   "token",
@@ -360,6 +384,18 @@ func TestDownload(t *testing.T) {
 
 	listingnoaccess := `{"success":false,"message":"invalid context","code":503}`
 
+	// downloads end up in the current directory, keep the source tree clean
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Could not get cwd: " + err.Error())
+	}
+
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Could not change into %s: %s", dir, err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+
 	tests := []Unit{
 		{
 			name:     "download",
@@ -367,7 +403,7 @@ func TestDownload(t *testing.T) {
 			wantfail: false,
 			route:    "/uploads/",
 			sendcode: 200,
-			sendfile: "../t/t1",
+			sendfile: filepath.Join(wd, "../t/t1"),
 			files:    []string{"cc2c965a"},
 			method:   "GET",
 			expect:   `cc2c965a successfully downloaded to file t1`,
@@ -399,11 +435,318 @@ func TestDownload(t *testing.T) {
 		Intercept(unit)
 		Check(t, unit, &w, Download(&w, conf, unit.files))
 
-		if unit.sendfile != "" {
-			file := filepath.Base(unit.sendfile)
-			if _, err := os.Stat(file); err == nil {
-				os.Remove(file)
+		// the temporary download file never remains
+		if _, err := os.Stat(filepath.Join(dir, unit.files[0])); err == nil {
+			t.Errorf("%s: temporary download file %s left behind", unit.name, unit.files[0])
+		}
+	}
+}
+
+func TestLink(t *testing.T) {
+	conf := &cfg.Config{
+		Mock:     true,
+		Apikey:   "token",
+		Endpoint: endpoint,
+		Silent:   true,
+	}
+
+	link := `{"links": [{"id":"cc2c965a","url":"http://localhost:8080/link/abc.def/t1",
+                         "expires_at":"2023-03-21T13:33:02.853574+01:00","singleuse":true}],
+              "success": true, "message": "", "code": 200}`
+
+	tests := []Unit{
+		{
+			name:     "create-link",
+			apikey:   "token",
+			wantfail: false,
+			route:    "/uploads/cc2c965a/links",
+			sendcode: 200,
+			sendjson: link,
+			files:    []string{"cc2c965a"},
+			method:   "POST",
+			expect:   `Single use: true\s*Url: http://localhost:8080/link/abc.def/t1`,
+		},
+		{
+			name:     "create-link-catch-no-access",
+			apikey:   "token",
+			wantfail: true,
+			route:    "/uploads/cc2c965a/links",
+			sendcode: 403,
+			sendjson: `{"success":false,"message":"No upload with that id could be found!","code":403}`,
+			files:    []string{"cc2c965a"},
+			method:   "POST",
+		},
+	}
+
+	for _, unit := range tests {
+		var w bytes.Buffer
+		Intercept(unit)
+		Check(t, unit, &w, CreateLink(&w, conf, unit.files))
+	}
+
+	revoke := Unit{
+		name:     "revoke-links",
+		apikey:   "token",
+		wantfail: false,
+		route:    "/uploads/cc2c965a/links",
+		sendcode: 200,
+		sendjson: `{"success":true,"message":"","code":200}`,
+		files:    []string{"cc2c965a"},
+		method:   "DELETE",
+		expect:   `Links of upload cc2c965a successfully revoked`,
+	}
+
+	var w bytes.Buffer
+	Intercept(revoke)
+	Check(t, revoke, &w, RevokeLinks(&w, conf, revoke.files))
+}
+
+func TestToken(t *testing.T) {
+	conf := &cfg.Config{
+		Mock:     true,
+		Apikey:   "token",
+		Endpoint: endpoint,
+		Silent:   true,
+		Label:    "ci",
+		Scopes:   []string{"upload"},
+	}
+
+	token := `{"tokens": [{"id":"3f2c0d3c-6d55-4b0f-9e0c-6f1f4f6e2a10","label":"ci","context":"default",
+                           "scopes":["upload"],"created":"2023-03-21T13:33:02.853574+01:00",
+                           "expires_at":"2023-04-20T13:33:02.853574+01:00","secret":"abcdef"}],
+               "success": true, "message": "", "code": 200}`
+
+	create := Unit{
+		name:     "create-token",
+		apikey:   "token",
+		wantfail: false,
+		route:    "/tokens",
+		sendcode: 200,
+		sendjson: token,
+		method:   "POST",
+		expect:   `Scopes: upload\s*Created: .*\s*Expires: .*\s*Secret: abcdef`,
+	}
+
+	var w bytes.Buffer
+	Intercept(create)
+	Check(t, create, &w, CreateToken(&w, conf))
+
+	list := Unit{
+		name:     "list-tokens",
+		apikey:   "token",
+		wantfail: false,
+		route:    "/tokens",
+		sendcode: 200,
+		sendjson: token,
+		method:   "GET",
+		expect:   `3f2c0d3c-6d55-4b0f-9e0c-6f1f4f6e2a10\s+ci\s+default\s+upload`,
+	}
+
+	w.Reset()
+	Intercept(list)
+	Check(t, list, &w, ListTokens(&w, conf))
+
+	revoke := Unit{
+		name:     "revoke-token",
+		apikey:   "token",
+		wantfail: false,
+		route:    "/tokens/3f2c0d3c-6d55-4b0f-9e0c-6f1f4f6e2a10",
+		sendcode: 200,
+		sendjson: `{"success":true,"message":"","code":200}`,
+		files:    []string{"3f2c0d3c-6d55-4b0f-9e0c-6f1f4f6e2a10"},
+		method:   "DELETE",
+		expect:   `Token 3f2c0d3c-6d55-4b0f-9e0c-6f1f4f6e2a10 successfully revoked`,
+	}
+
+	w.Reset()
+	Intercept(revoke)
+	Check(t, revoke, &w, RevokeTokens(&w, conf, revoke.files))
+}
+
+func TestContext(t *testing.T) {
+	conf := &cfg.Config{
+		Mock:     true,
+		Apikey:   "token",
+		Endpoint: endpoint,
+		Silent:   true,
+		Role:     "read-only",
+	}
+
+	context := `{"contexts": [{"context":"ci","role":"read-only","source":"runtime","key":"abcdef"}],
+               "success": true, "message": "", "code": 200}`
+
+	add := Unit{
+		name:     "add-context",
+		apikey:   "token",
+		wantfail: false,
+		route:    "/contexts",
+		sendcode: 200,
+		sendjson: context,
+		method:   "POST",
+		expect:   `Context: ci\s*Role: read-only\s*Allow: any\s*Source: runtime\s*Key: abcdef`,
+	}
+
+	var w bytes.Buffer
+	Intercept(add)
+	Check(t, add, &w, AddContext(&w, conf, []string{"ci"}))
+
+	list := Unit{
+		name:     "list-contexts",
+		apikey:   "token",
+		wantfail: false,
+		route:    "/contexts",
+		sendcode: 200,
+		sendjson: context,
+		method:   "GET",
+		expect:   `ci\s+read-only\s+any\s+runtime`,
+	}
+
+	w.Reset()
+	Intercept(list)
+	Check(t, list, &w, ListContexts(&w, conf))
+
+	rotate := Unit{
+		name:     "rotate-context",
+		apikey:   "token",
+		wantfail: false,
+		route:    "/contexts/ci/rotate",
+		sendcode: 200,
+		sendjson: context,
+		method:   "POST",
+		expect:   `Key: abcdef`,
+	}
+
+	w.Reset()
+	Intercept(rotate)
+	Check(t, rotate, &w, RotateContext(&w, conf, []string{"ci"}))
+
+	remove := Unit{
+		name:     "remove-context",
+		apikey:   "token",
+		wantfail: false,
+		route:    "/contexts/ci",
+		sendcode: 200,
+		sendjson: `{"success":true,"message":"","code":200}`,
+		files:    []string{"ci"},
+		method:   "DELETE",
+		expect:   `Api context ci successfully removed`,
+	}
+
+	w.Reset()
+	Intercept(remove)
+	Check(t, remove, &w, RemoveContexts(&w, conf, remove.files))
+
+	denied := Unit{
+		name:     "add-context-denied",
+		apikey:   "token",
+		wantfail: true,
+		route:    "/contexts",
+		sendcode: 403,
+		sendjson: `{"success":false,"message":"Only the super context is allowed to manage api contexts!","code":403}`,
+		method:   "POST",
+	}
+
+	w.Reset()
+	Intercept(denied)
+	Check(t, denied, &w, AddContext(&w, conf, []string{"ci"}))
+}
+
+func TestRetryRateLimited(t *testing.T) {
+	conf := &cfg.Config{
+		Mock:     true,
+		Apikey:   "token",
+		Endpoint: endpoint,
+		Silent:   true,
+		Retries:  2,
+	}
+
+	// the first request is rate limited, the retry succeeds
+	calls := 0
+	httpmock.RegisterResponder("GET", endpoint+"/tokens",
+		func(request *http.Request) (*http.Response, error) {
+			calls++
+
+			if calls == 1 {
+				resp := httpmock.NewStringResponse(429,
+					`{"success":false,"message":"Rate limit exceeded, retry in 0 seconds!","code":429}`)
+				resp.Header.Set("Content-Type", "application/json; charset=utf-8")
+				resp.Header.Set("Retry-After", "0")
+				return resp, nil
 			}
+
+			resp := httpmock.NewStringResponse(200, `{"tokens":[],"success":true,"message":"","code":200}`)
+			resp.Header.Set("Content-Type", "application/json; charset=utf-8")
+			return resp, nil
+		})
+
+	var w bytes.Buffer
+	if err := ListTokens(&w, conf); err != nil {
+		t.Errorf("rate limited request not retried: %s", err)
+	}
+
+	if calls != 2 {
+		t.Errorf("got %d requests, want 2", calls)
+	}
+
+	var tests = []struct {
+		name   string
+		code   int
+		header string
+		value  string
+		expect time.Duration
+	}{
+		{"retry-after", 429, "Retry-After", "3", 3 * time.Second},
+		{"ratelimit-reset", 429, "RateLimit-Reset", "2", 2 * time.Second},
+		{"capped", 503, "Retry-After", "3600", MaxRetryWait},
+		{"reset-not-limited", 500, "RateLimit-Reset", "2", 0},
+	}
+
+	for _, tt := range tests {
+		resp := &req.Response{Response: &http.Response{StatusCode: tt.code, Header: http.Header{}}}
+		resp.Header.Set(tt.header, tt.value)
+
+		wait := RetryInterval(resp, 1)
+		if tt.expect > 0 && wait != tt.expect {
+			t.Errorf("%s: got %s, want %s", tt.name, wait, tt.expect)
+		}
+
+		// falls back to backoff
+		if tt.expect == 0 && (wait < 500*time.Millisecond || wait > time.Second) {
+			t.Errorf("%s: got %s, want backoff of about 1s", tt.name, wait)
+		}
+	}
+}
+
+func TestLoadApikey(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(keyfile, []byte("filetoken\n"), 0600); err != nil {
+		t.Fatalf("Could not write key file: %s", err)
+	}
+
+	var tests = []struct {
+		name     string
+		conf     cfg.Config
+		expect   string
+		wantfail bool
+	}{
+		{"apikey", cfg.Config{Apikey: "key", ApikeyFile: keyfile}, "key", false},
+		{"file", cfg.Config{ApikeyFile: keyfile}, "filetoken", false},
+		{"command", cfg.Config{ApikeyCommand: "echo cmdtoken"}, "cmdtoken", false},
+		{"missing-file", cfg.Config{ApikeyFile: keyfile + ".missing"}, "", true},
+		{"failing-command", cfg.Config{ApikeyCommand: "exit 1"}, "", true},
+		{"empty-command", cfg.Config{ApikeyCommand: "true"}, "", true},
+	}
+
+	for _, tt := range tests {
+		conf := tt.conf
+		err := LoadApikey(&conf)
+
+		if (err != nil) != tt.wantfail {
+			t.Errorf("%s: wantfail: %t, error: %v", tt.name, tt.wantfail, err)
+		}
+
+		if conf.Apikey != tt.expect {
+			t.Errorf("%s: got key %q, want %q", tt.name, conf.Apikey, tt.expect)
 		}
 	}
 }
@@ -26,21 +26,47 @@ import (
 	"github.com/tlinden/ephemerup/common"
 	"io"
 	"sort"
+	"strconv"
 	"strings"
-	"time"
 )
 
-// make a human readable version of the expire setting
-func prepareExpire(expire string, start common.Timestamp) string {
+// make a human readable version  of the expire setting, prefer the
+// expire time computed by the server, if any
+func prepareExpire(expire string, start common.Timestamp, expiresat common.Timestamp) string {
 	switch expire {
 	case "asap":
 		return "On first access"
 	default:
-		return time.Unix(start.Unix()+int64(common.Duration2int(expire)), 0).
-			Format("2006-01-02 15:04:05")
+		if expiresat.IsZero() {
+			ts, err := common.ExpiresAt(start.Time, expire, 0)
+			if err != nil {
+				return expire
+			}
+			expiresat = common.Timestamp{Time: ts}
+		}
+
+		return expiresat.Local().Format("2006-01-02 15:04:05")
 	}
 }
 
+// make a human readable version of the download counter
+func prepareDownloads(upload *common.Upload) string {
+	if upload.MaxDownloads == 0 {
+		return fmt.Sprintf("%d", upload.Downloads)
+	}
+
+	return fmt.Sprintf("%d/%d", upload.Downloads, upload.MaxDownloads)
+}
+
+// make a human readable version of an allowlist
+func prepareAllow(allow []string) string {
+	if len(allow) == 0 {
+		return "any"
+	}
+
+	return strings.Join(allow, ", ")
+}
+
 // generic table writer
 func WriteTable(w io.Writer, headers []string, data [][]string) {
 	tableString := &strings.Builder{}
@@ -77,26 +103,81 @@ func WriteExtended(w io.Writer, response *common.Response) {
 
 	// we shall only have 1 element, however, if we ever support more, here we go
 	for _, entry := range response.Uploads {
-		expire := prepareExpire(entry.Expire, entry.Created)
+		expire := prepareExpire(entry.Expire, entry.Created, entry.ExpiresAt)
 		fmt.Fprintf(w, format, "Upload-Id", entry.Id)
+		if entry.ShortId != "" {
+			fmt.Fprintf(w, format, "Short-Id", entry.ShortId)
+		}
 		fmt.Fprintf(w, format, "Description", entry.Description)
 		fmt.Fprintf(w, format, "Expire", expire)
+		fmt.Fprintf(w, format, "Downloads", prepareDownloads(entry))
 		fmt.Fprintf(w, format, "Context", entry.Context)
 		fmt.Fprintf(w, format, "Created", entry.Created)
 		fmt.Fprintf(w, format, "Filename", entry.File)
+		fmt.Fprintf(w, format, "Protected", strconv.FormatBool(entry.Protected))
+		fmt.Fprintf(w, format, "Allow", prepareAllow(entry.Allow))
+		if entry.FormId != "" {
+			fmt.Fprintf(w, format, "Form-Id", entry.FormId)
+		}
+		fmt.Fprintf(w, format, "Url", entry.Url)
+		fmt.Fprintln(w)
+	}
+
+	for _, entry := range response.Links {
+		fmt.Fprintf(w, format, "Upload-Id", entry.Id)
+		fmt.Fprintf(w, format, "Expires", entry.ExpiresAt.Local().Format("2006-01-02 15:04:05"))
+		fmt.Fprintf(w, format, "Single use", strconv.FormatBool(entry.SingleUse))
 		fmt.Fprintf(w, format, "Url", entry.Url)
 		fmt.Fprintln(w)
 	}
 
 	for _, entry := range response.Forms {
-		expire := prepareExpire(entry.Expire, entry.Created)
+		expire := prepareExpire(entry.Expire, entry.Created, entry.ExpiresAt)
 		fmt.Fprintf(w, format, "Form-Id", entry.Id)
+		if entry.ShortId != "" {
+			fmt.Fprintf(w, format, "Short-Id", entry.ShortId)
+		}
 		fmt.Fprintf(w, format, "Description", entry.Description)
 		fmt.Fprintf(w, format, "Expire", expire)
 		fmt.Fprintf(w, format, "Context", entry.Context)
 		fmt.Fprintf(w, format, "Created", entry.Created)
 		fmt.Fprintf(w, format, "Notify", entry.Notify)
+		fmt.Fprintf(w, format, "Allow", prepareAllow(entry.Allow))
 		fmt.Fprintf(w, format, "Url", entry.Url)
+		if entry.Token != "" {
+			fmt.Fprintf(w, format, "Token", entry.Token)
+		}
+		fmt.Fprintln(w)
+	}
+
+	for _, entry := range response.Tokens {
+		fmt.Fprintf(w, format, "Token-Id", entry.Id)
+		fmt.Fprintf(w, format, "Label", entry.Label)
+		fmt.Fprintf(w, format, "Context", entry.Context)
+		fmt.Fprintf(w, format, "Scopes", strings.Join(entry.Scopes, ","))
+		fmt.Fprintf(w, format, "Created", entry.Created)
+		fmt.Fprintf(w, format, "Expires", entry.ExpiresAt.Local().Format("2006-01-02 15:04:05"))
+		if entry.Secret != "" {
+			// only returned once, on creation
+			fmt.Fprintf(w, format, "Secret", entry.Secret)
+			fmt.Fprintln(w, "\nStore the secret now, it will not be shown again!")
+		}
+		fmt.Fprintln(w)
+	}
+
+	for _, entry := range response.Contexts {
+		fmt.Fprintf(w, format, "Context", entry.Context)
+		fmt.Fprintf(w, format, "Role", entry.Role)
+		if entry.Parent != "" {
+			fmt.Fprintf(w, format, "Parent", entry.Parent)
+		}
+		fmt.Fprintf(w, format, "Allow", prepareAllow(entry.Allow))
+		fmt.Fprintf(w, format, "Source", entry.Source)
+		if entry.Key != "" {
+			// only returned once, on creation or rotation
+			fmt.Fprintf(w, format, "Key", entry.Key)
+			fmt.Fprintln(w, "\nStore the key now, it will not be shown again!")
+		}
 		fmt.Fprintln(w)
 	}
 }
@@ -136,11 +217,11 @@ func UploadsRespondTable(w io.Writer, resp *req.Response) error {
 	for _, entry := range response.Uploads {
 		data = append(data, []string{
 			entry.Id, entry.Description, entry.Expire, entry.Context,
-			entry.Created.Format("2006-01-02 15:04:05"), entry.File,
+			entry.Created.Format("2006-01-02 15:04:05"), entry.File, prepareDownloads(entry),
 		})
 	}
 
-	WriteTable(w, []string{"UPLOAD-ID", "DESCRIPTION", "EXPIRE", "CONTEXT", "CREATED", "FILE"}, data)
+	WriteTable(w, []string{"UPLOAD-ID", "DESCRIPTION", "EXPIRE", "CONTEXT", "CREATED", "FILE", "DOWNLOADS"}, data)
 
 	return nil
 }
@@ -174,6 +255,64 @@ func FormsRespondTable(w io.Writer, resp *req.Response) error {
 	return nil
 }
 
+// turn the Tokens{} struct into a table and print it
+func TokensRespondTable(w io.Writer, resp *req.Response) error {
+	response, err := GetResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	if response.Message != "" {
+		fmt.Fprintln(w, response.Message)
+	}
+
+	sort.SliceStable(response.Tokens, func(i, j int) bool {
+		return response.Tokens[i].Created.Time.Unix() < response.Tokens[j].Created.Time.Unix()
+	})
+
+	// tablewriter
+	data := [][]string{}
+	for _, entry := range response.Tokens {
+		data = append(data, []string{
+			entry.Id, entry.Label, entry.Context, strings.Join(entry.Scopes, ","),
+			entry.Created.Format("2006-01-02 15:04:05"),
+			entry.ExpiresAt.Local().Format("2006-01-02 15:04:05"),
+		})
+	}
+
+	WriteTable(w, []string{"TOKEN-ID", "LABEL", "CONTEXT", "SCOPES", "CREATED", "EXPIRES"}, data)
+
+	return nil
+}
+
+// turn the Contexts{} struct into a table and print it
+func ContextsRespondTable(w io.Writer, resp *req.Response) error {
+	response, err := GetResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	if response.Message != "" {
+		fmt.Fprintln(w, response.Message)
+	}
+
+	sort.SliceStable(response.Contexts, func(i, j int) bool {
+		return response.Contexts[i].Context < response.Contexts[j].Context
+	})
+
+	// tablewriter
+	data := [][]string{}
+	for _, entry := range response.Contexts {
+		data = append(data, []string{
+			entry.Context, entry.Role, entry.Parent, prepareAllow(entry.Allow), entry.Source,
+		})
+	}
+
+	WriteTable(w, []string{"CONTEXT", "ROLE", "PARENT", "ALLOW", "SOURCE"}, data)
+
+	return nil
+}
+
 // turn the Uploads{} struct into xtnd output and print it
 func RespondExtended(w io.Writer, resp *req.Response) error {
 	response, err := GetResponse(resp)